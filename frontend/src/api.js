@@ -48,21 +48,98 @@ export default {
   logout() {
     return retryRequest(() => goServiceClient.post("/logout"));
   },
-  addTransaction(transactionData) {
-    return retryRequest(() => goServiceClient.post("/add-transaction", transactionData));
+  addTransaction(transactionData, idempotencyKey = crypto.randomUUID()) {
+    // Dùng cùng Idempotency-Key cho mọi lần retry để giao dịch không bị ghi hai lần
+    return retryRequest(() =>
+      goServiceClient.post("/add-transaction", transactionData, { headers: { "Idempotency-Key": idempotencyKey } })
+    );
   },
-  getTransactions() {
-    return retryRequest(() => goServiceClient.get("/transactions"));
+  getTransactions(params = {}) {
+    // params: limit, cursor, sort, order, q, from, to, coin, type, status, portfolio_id, account_id
+    return retryRequest(() => goServiceClient.get("/transactions", { params }));
   },
-  getPortfolio() {
-    return retryRequest(() => goServiceClient.get("/portfolio"));
+  getPortfolio(portfolioId = "all") {
+    // portfolioId: ID một danh mục hoặc "all" để xem tổng hợp mọi danh mục chưa lưu trữ
+    return retryRequest(() => goServiceClient.get("/portfolio", { params: { portfolio_id: portfolioId } }));
   },
-  getPortfolioData() {
-    return retryRequest(() => goServiceClient.get("/dashboard"));
+  getPortfolioData(portfolioId = "all") {
+    return retryRequest(() => goServiceClient.get("/dashboard", { params: { portfolio_id: portfolioId } }));
+  },
+  getPortfolioHistory(params = {}) {
+    // params: portfolio_id, range (1W, 1M, YTD, 1Y, ALL), resolution (day, week, month), currency
+    return retryRequest(() => goServiceClient.get("/portfolio/history", { params }));
+  },
+  getPortfolios() {
+    return retryRequest(() => goServiceClient.get("/portfolios"));
+  },
+  createPortfolio(name) {
+    return retryRequest(() => goServiceClient.post("/portfolios", { name }));
+  },
+  updatePortfolio(portfolioId, changes) {
+    // changes: name, archived, default
+    return retryRequest(() => goServiceClient.patch(`/portfolios/${portfolioId}`, changes));
+  },
+  deletePortfolio(portfolioId) {
+    return retryRequest(() => goServiceClient.delete(`/portfolios/${portfolioId}`));
+  },
+  getAccounts(portfolioId = "all") {
+    return retryRequest(() => goServiceClient.get(`/portfolios/${portfolioId}/accounts`));
+  },
+  createAccount(portfolioId, account) {
+    // account: name, type (exchange, wallet, hardware_wallet, other), address
+    return retryRequest(() => goServiceClient.post(`/portfolios/${portfolioId}/accounts`, account));
+  },
+  updateAccount(accountId, changes) {
+    return retryRequest(() => goServiceClient.patch(`/accounts/${accountId}`, changes));
+  },
+  deleteAccount(accountId) {
+    return retryRequest(() => goServiceClient.delete(`/accounts/${accountId}`));
+  },
+  exportTransactions(params = {}) {
+    // params: format (csv, ndjson, ofx, qif), currency, from, to, coin, type, status, portfolio_id, account_id
+    return retryRequest(() => goServiceClient.get("/transactions/export", { params, responseType: "blob" }));
   },
   updateTransaction(transactionData) {
     return retryRequest(() => goServiceClient.put(`/update-transaction/${transactionData.id}`, transactionData));
   },
+  deleteTransaction(transactionId) {
+    return retryRequest(() => goServiceClient.delete(`/transactions/${transactionId}`));
+  },
+  voidTransaction(transactionId, reason) {
+    return retryRequest(() => goServiceClient.post(`/transactions/${transactionId}/void`, { reason }));
+  },
+  importTransactions(exchange, file, dryRun = false, idempotencyKey = crypto.randomUUID()) {
+    const formData = new FormData();
+    formData.append("file", file);
+    return retryRequest(() =>
+      goServiceClient.post(`/import/${exchange}?dry_run=${dryRun}`, formData, { headers: { "Idempotency-Key": idempotencyKey } })
+    );
+  },
+  importWithTemplate(file, template, dryRun = false, idempotencyKey = crypto.randomUUID()) {
+    // template là ID của template đã lưu hoặc object ánh xạ cột dùng một lần
+    const formData = new FormData();
+    formData.append("file", file);
+    if (typeof template === "string") {
+      formData.append("template_id", template);
+    } else {
+      formData.append("template", JSON.stringify(template));
+    }
+    return retryRequest(() =>
+      goServiceClient.post(`/import/custom?dry_run=${dryRun}`, formData, { headers: { "Idempotency-Key": idempotencyKey } })
+    );
+  },
+  getImportTemplates() {
+    return retryRequest(() => goServiceClient.get("/import-templates"));
+  },
+  saveImportTemplate(template) {
+    if (template._id) {
+      return retryRequest(() => goServiceClient.put(`/import-templates/${template._id}`, template));
+    }
+    return retryRequest(() => goServiceClient.post("/import-templates", template));
+  },
+  deleteImportTemplate(templateId) {
+    return retryRequest(() => goServiceClient.delete(`/import-templates/${templateId}`));
+  },
   getWatchlist() {
     return retryRequest(() => goServiceClient.get("/watchlist"));
   },
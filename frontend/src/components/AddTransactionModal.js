@@ -293,6 +293,13 @@ const AddTransactionModal = ({ show, onClose, onAdd, onUpdate, transaction }) =>
           >
             <option value="buy">Buy</option>
             <option value="sell">Sell</option>
+            <option value="deposit">Deposit</option>
+            <option value="withdrawal">Withdrawal</option>
+            <option value="transfer">Transfer</option>
+            <option value="staking">Staking reward</option>
+            <option value="airdrop">Airdrop</option>
+            <option value="mining">Mining</option>
+            <option value="interest">Interest</option>
           </select>
           <input
             type="text"
@@ -21,7 +21,7 @@ const Dashboard = () => {
       try {
         // Gọi API lấy dữ liệu danh mục đầu tư
         const response = await api.getPortfolioData();
-        setPortfolioData(response.data || []); // Cập nhật state với dữ liệu trả về hoặc mảng rỗng nếu không có dữ liệu
+        setPortfolioData(response.data.holdings || []); // Cập nhật state với danh sách coin đang nắm giữ hoặc mảng rỗng nếu không có dữ liệu
       } catch (error) {
         // Xử lý lỗi nếu gọi API thất bại
         console.error("Failed to fetch portfolio data:", error);
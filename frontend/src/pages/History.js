@@ -1,4 +1,4 @@
-import React, { useState, useEffect } from 'react';
+import React, { useState, useEffect, useCallback } from 'react';
 import AddTransactionModal from '../components/AddTransactionModal';
 import TransactionRow from '../components/TransactionRow';
 import { FaPlus } from "react-icons/fa";
@@ -11,28 +11,46 @@ const History = () => {
   const [highlightedRow, setHighlightedRow] = useState(null);
   const [selectedTransaction, setSelectedTransaction] = useState(null);
   const [ setCurrentPage] = useState(1);
+  const [nextCursor, setNextCursor] = useState(null);
+  const [hasMore, setHasMore] = useState(false);
+  const [loadingMore, setLoadingMore] = useState(false);
 
 
-  // useEffect để lấy dữ liệu giao dịch khi component được render lần đầu
-  useEffect(() => {
-    const fetchTransactions = async () => {
-      try {
-        // Gọi API để lấy dữ liệu giao dịch
-        const response = await api.getTransactions();
-        // Lọc ra các giao dịch hợp lệ (đảm bảo các trường cần thiết đều có giá trị)
-        const validTransactions = (response.data || []).filter(transaction =>
-          transaction.transaction_type && transaction.coin && transaction.amount && transaction.price
-        );
-        setTransactionHistory(validTransactions); // Cập nhật danh sách giao dịch hợp lệ vào state
-      } catch (error) {
-        // Xử lý lỗi nếu gọi API thất bại
-        console.error("Failed to fetch transactions:", error);
-        setTransactionHistory([]); // Đặt danh sách giao dịch thành mảng rỗng nếu có lỗi
+  // Lấy một trang giao dịch; cursor rỗng là trang đầu, trang sau được nối vào cuối danh sách
+  const fetchTransactions = useCallback(async (cursor) => {
+    try {
+      // Gọi API để lấy dữ liệu giao dịch
+      const params = { limit: 200 };
+      if (cursor) params.cursor = cursor;
+      const response = await api.getTransactions(params);
+      // Lọc ra các giao dịch hợp lệ (đảm bảo các trường cần thiết đều có giá trị). Giá có thể bằng 0
+      // với nạp, rút và chuyển coin nên không được dùng để lọc
+      const validTransactions = (response.data.transactions || []).filter(transaction =>
+        transaction.transaction_type && transaction.coin && transaction.amount
+      );
+      setTransactionHistory((prevHistory) => (cursor ? [...prevHistory, ...validTransactions] : validTransactions));
+      setNextCursor(response.data.next_cursor || null);
+      setHasMore(Boolean(response.data.has_more && response.data.next_cursor));
+    } catch (error) {
+      // Xử lý lỗi nếu gọi API thất bại
+      console.error("Failed to fetch transactions:", error);
+      if (!cursor) {
+        setTransactionHistory([]); // Đặt danh sách giao dịch thành mảng rỗng nếu có lỗi ở trang đầu
       }
-    };
+    }
+  }, []);
 
-    fetchTransactions(); // Gọi hàm fetchTransactions khi component mount
-  }, []); // Mảng phụ thuộc rỗng để chỉ gọi khi component mount
+  // useEffect để lấy trang giao dịch đầu tiên khi component được render lần đầu
+  useEffect(() => {
+    fetchTransactions(null);
+  }, [fetchTransactions]); // fetchTransactions không đổi nên chỉ gọi khi component mount
+
+  // Hàm tải thêm trang giao dịch tiếp theo theo next_cursor
+  const handleLoadMore = async () => {
+    setLoadingMore(true);
+    await fetchTransactions(nextCursor);
+    setLoadingMore(false);
+  };
 
   // Hàm xử lý khi thay đổi từ khóa tìm kiếm
   const handleSearchChange = (e) => {
@@ -143,6 +161,17 @@ const History = () => {
           </tbody>
         </table>
       </div>
+      {hasMore && (
+        <div className="flex justify-center mt-4">
+          <button
+            onClick={handleLoadMore}
+            disabled={loadingMore}
+            className="px-4 py-2 bg-white border border-gray-300 text-gray-700 rounded-md hover:bg-gray-100 text-sm disabled:opacity-50"
+          >
+            {loadingMore ? "Loading..." : "Load more"}
+          </button>
+        </div>
+      )}
     </div>
   );
 };
@@ -16,7 +16,7 @@ const Portfolio = () => {
       try {
         // Gọi API để lấy dữ liệu danh mục đầu tư
         const response = await api.getPortfolio();
-        const data = response.data; // Lưu trữ dữ liệu danh mục đầu tư từ phản hồi của API
+        const data = response.data.holdings || []; // Lưu trữ danh sách coin đang nắm giữ từ phản hồi của API
         setPortfolioData(data); // Cập nhật state với dữ liệu danh mục đầu tư
       } catch (error) {
         // Xử lý lỗi nếu gọi API thất bại
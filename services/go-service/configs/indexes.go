@@ -0,0 +1,80 @@
+package configs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes liệt kê các index cần có trên từng collection
+var collectionIndexes = map[string][]mongo.IndexModel{
+	// Tên danh mục là duy nhất theo người dùng
+	"portfolios": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	// Tên tài khoản là duy nhất trong danh mục
+	"accounts": {
+		{Keys: bson.D{{Key: "portfolio_id", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	// Danh sách giao dịch luôn lọc theo người dùng và phân trang theo (trường sắp xếp, _id);
+	// index theo trạng thái và ngày phục vụ việc đọc sổ giao dịch khi replay
+	"transactions": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "amount", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "coin", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "transaction_type", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}, {Key: "date", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "portfolio_id", Value: 1}, {Key: "status", Value: 1}, {Key: "date", Value: 1}}},
+	},
+	// Mỗi danh mục có tối đa một snapshot giá trị cho mỗi ngày
+	"portfolio_snapshots": {
+		{Keys: bson.D{{Key: "portfolio_id", Value: 1}, {Key: "date", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	// Mỗi Idempotency-Key là duy nhất theo người dùng và tự xóa khi hết thời gian ghi nhớ
+	"idempotency_keys": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	// Tên template import là duy nhất theo người dùng
+	"import_templates": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+}
+
+// obsoleteIndexes liệt kê các index cũ cần xóa theo tên, ví dụ index unique user_id của
+// portfolios từ khi mỗi người dùng chỉ có một danh mục
+var obsoleteIndexes = map[string][]string{
+	"portfolios": {"user_id_1"},
+}
+
+// EnsureIndexes xóa các index cũ và tạo các index còn thiếu. Lỗi (ví dụ dữ liệu cũ bị trùng) chỉ được ghi log
+func EnsureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for name, indexes := range obsoleteIndexes {
+		for _, index := range indexes {
+			// Index không tồn tại (IndexNotFound) nghĩa là đã được xóa trước đó
+			if _, err := GetCollection(name).Indexes().DropOne(ctx, index); err != nil && !isIndexNotFound(err) {
+				log.Printf("Warning: could not drop index %s on %s: %v", index, name, err)
+			}
+		}
+	}
+	for name, indexes := range collectionIndexes {
+		if _, err := GetCollection(name).Indexes().CreateMany(ctx, indexes); err != nil {
+			log.Printf("Warning: could not create indexes on %s: %v", name, err)
+		}
+	}
+}
+
+// isIndexNotFound kiểm tra lỗi khi xóa index hoặc collection không tồn tại
+func isIndexNotFound(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && (commandErr.Code == 27 || commandErr.Code == 26)
+}
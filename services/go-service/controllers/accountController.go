@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"crypto-folio/models"
+	"crypto-folio/services"
+
+	"github.com/gorilla/mux"
+)
+
+// GetAccounts trả về các tài khoản (sàn, ví) của danh mục {id}; {id} là "all" để lấy tài khoản của mọi danh mục
+func GetAccounts(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	accounts, err := services.ListPortfolioAccounts(userID, mux.Vars(r)["id"])
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error fetching accounts", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// CreateAccount tạo tài khoản mới trong danh mục {id} với body {"name", "type", "address"}.
+// type là exchange, wallet, hardware_wallet hoặc other (mặc định)
+func CreateAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Name    string `json:"name"`
+		Type    string `json:"type"`
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	account := &models.Account{Name: body.Name, Type: body.Type, Address: body.Address}
+	err = services.CreateAccount(userID, mux.Vars(r)["id"], account)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error creating account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(account)
+}
+
+// UpdateAccount đổi tên, loại hoặc địa chỉ của tài khoản {id}. Body chỉ chứa các trường cần sửa
+func UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var patch models.AccountPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	account, err := services.UpdateAccount(userID, mux.Vars(r)["id"], &patch)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
+
+// DeleteAccount xóa tài khoản {id} không còn được giao dịch nào tham chiếu
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	err = services.DeleteAccount(userID, mux.Vars(r)["id"])
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
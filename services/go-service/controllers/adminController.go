@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"crypto-folio/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// requireAdmin kiểm tra người dùng trong session có quyền quản trị, ghi phản hồi lỗi và trả về false nếu không
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return false
+	}
+	user, err := services.GetUser(userID)
+	if err != nil || !user.IsAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// userIDFromPath lấy ID người dùng từ tham số {userId} của đường dẫn
+func userIDFromPath(r *http.Request) (primitive.ObjectID, error) {
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["userId"])
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("invalid user ID")
+	}
+	return userID, nil
+}
+
+// RebuildPortfolio dựng lại mọi danh mục của một người dùng từ sổ giao dịch (chỉ dành cho quản trị viên)
+func RebuildPortfolio(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	userID, err := userIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	portfolios, err := services.RebuildPortfolio(userID)
+	if customErr, ok := err.(*services.CustomError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error rebuilding portfolio", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(portfolios)
+}
+
+// CheckPortfolioConsistency so sánh từng danh mục đã lưu của một người dùng với danh mục replay (chỉ dành cho quản trị viên)
+func CheckPortfolioConsistency(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	userID, err := userIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reports, err := services.CheckPortfolioConsistency(userID)
+	if err != nil {
+		http.Error(w, "Error checking portfolio", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// CheckAllPortfolios trả về các danh mục bị lệch so với sổ giao dịch (chỉ dành cho quản trị viên)
+func CheckAllPortfolios(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	reports, err := services.CheckAllPortfolios()
+	if err != nil {
+		http.Error(w, "Error checking portfolios", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// GetPriceProvidersHealth trả về tình trạng circuit breaker của từng nguồn giá (chỉ dành cho quản trị viên)
+func GetPriceProvidersHealth(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(services.GetProvidersHealth())
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto-folio/configs"
 	"crypto-folio/models"
+	"crypto-folio/services"
 	"crypto-folio/utils"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/sessions"
@@ -81,6 +83,33 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Kiểm tra tiền tệ cơ sở và tiền tệ hiển thị nếu người dùng chọn khi đăng ký
+	if user.BaseCurrency != "" {
+		baseCurrency, err := services.NormalizeCurrency(user.BaseCurrency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.BaseCurrency = baseCurrency
+	}
+	for i, currency := range user.DisplayCurrencies {
+		displayCurrency, err := services.NormalizeCurrency(currency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.DisplayCurrencies[i] = displayCurrency
+	}
+
+	// Kiểm tra phương pháp tính giá vốn như khi người dùng đổi phương pháp sau khi đăng ký
+	if user.CostBasisMethod != "" {
+		user.CostBasisMethod = strings.ToLower(strings.TrimSpace(user.CostBasisMethod))
+		if !models.IsValidCostBasisMethod(user.CostBasisMethod) {
+			http.Error(w, fmt.Sprintf("Cost basis method %s is not supported.", user.CostBasisMethod), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Mã hóa mật khẩu người dùng và thiết lập thông tin người dùng mới
 	hashedPassword, _ := utils.HashPassword(user.Password)
 	user.Password = hashedPassword
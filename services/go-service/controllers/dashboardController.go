@@ -8,6 +8,7 @@ import (
 
 	"crypto-folio/configs"
 	"crypto-folio/models"
+	"crypto-folio/services"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -87,3 +88,65 @@ func UpdateWatchlist(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Watchlist updated successfully")
 }
+
+// GetCurrencySettings trả về tiền tệ cơ sở và các tiền tệ hiển thị của người dùng
+func GetCurrencySettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	baseCurrency, displayCurrencies, err := services.GetUserCurrencies(userID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"base_currency":      baseCurrency,
+		"display_currencies": displayCurrencies,
+	})
+}
+
+// UpdateCurrencySettings cập nhật tiền tệ cơ sở và các tiền tệ hiển thị (mã ISO-4217)
+func UpdateCurrencySettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var updateData struct {
+		BaseCurrency      string   `json:"base_currency"`
+		DisplayCurrencies []string `json:"display_currencies"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	baseCurrency, displayCurrencies, err := services.UpdateUserCurrencies(userID, updateData.BaseCurrency, updateData.DisplayCurrencies)
+	if customErr, ok := err.(*services.CustomError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(customErr)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"base_currency":      baseCurrency,
+		"display_currencies": displayCurrencies,
+	})
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"crypto-folio/services"
+)
+
+// responseRecorder ghi lại mã trạng thái và body phản hồi trong khi vẫn gửi chúng tới client
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// retryableStatus cho biết phản hồi không làm thay đổi dữ liệu và có thể thử lại với cùng key
+// (lỗi phía server, xung đột ghi đồng thời, quá thời gian hoặc bị giới hạn tần suất)
+func retryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return statusCode >= http.StatusInternalServerError
+}
+
+// WithIdempotencyKey bọc handler để các yêu cầu gửi lại với cùng header Idempotency-Key
+// trong thời gian ghi nhớ nhận lại phản hồi ban đầu thay vì xử lý thêm lần nữa.
+// Phản hồi có thể thử lại (5xx, 409...) không được lưu để người dùng có thể gửi lại với cùng key
+func WithIdempotencyKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		userID, err := getUserIDFromSession(r)
+		if err != nil {
+			http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+			return
+		}
+
+		// Đọc body (giới hạn như file import) để tính hash (cùng method, đường dẫn và query) rồi trả lại cho handler
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportFileSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+
+		record, lock, err := services.BeginIdempotentRequest(userID, key, hex.EncodeToString(hash[:]))
+		if customErr, ok := err.(*services.CustomError); ok {
+			writeCustomError(w, customErr)
+			return
+		} else if err != nil {
+			http.Error(w, "Error checking idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if record != nil {
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Response)
+			return
+		}
+
+		// Khóa được gia hạn trong khi handler chạy (import có thể mất vài phút)
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		func() {
+			defer services.KeepIdempotencyLock(userID, key, lock)()
+			next(recorder, r)
+		}()
+
+		if retryableStatus(recorder.statusCode) {
+			err = services.AbandonIdempotentRequest(userID, key, lock)
+		} else {
+			err = services.CompleteIdempotentRequest(userID, key, lock, recorder.statusCode, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
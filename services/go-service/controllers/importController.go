@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"crypto-folio/models"
+	"crypto-folio/services"
+
+	"github.com/gorilla/mux"
+)
+
+// maxImportFileSize giới hạn kích thước file import (10MB)
+const maxImportFileSize = 10 << 20
+
+// ImportTransactions nhập giao dịch từ file CSV export của sàn {exchange} (binance, coinbase, kraken, bitflyer)
+// vào danh mục portfolio_id (query hoặc trường form, mặc định là danh mục mặc định), gắn với tài khoản account_id nếu có.
+// File được gửi qua trường "file" của multipart/form-data hoặc trực tiếp trong body.
+// Query dry_run=true trả về bản xem trước từng dòng mà không ghi vào danh mục
+func ImportTransactions(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
+		return
+	}
+
+	file, err := importFile(w, r)
+	if err != nil {
+		http.Error(w, "Invalid import file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	portfolioID, err := portfolioIDParam(r)
+	if err != nil {
+		writeCustomError(w, err.(*services.CustomError))
+		return
+	}
+	accountID, err := accountIDParam(r)
+	if err != nil {
+		writeCustomError(w, err.(*services.CustomError))
+		return
+	}
+
+	exchange := strings.ToLower(mux.Vars(r)["exchange"])
+	result, err := services.ImportTransactions(userID, portfolioID, accountID, exchange, file, dryRun)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error importing transactions", http.StatusInternalServerError)
+		return
+	}
+
+	writeImportResult(w, result)
+}
+
+// ImportWithTemplate nhập giao dịch từ file CSV hoặc XLSX theo ánh xạ cột của người dùng.
+// Template đã lưu được chọn bằng template_id (query hoặc trường form); template dùng một lần
+// được gửi dưới dạng JSON trong trường form "template". Giao dịch được ghi vào danh mục portfolio_id
+// và tài khoản account_id (nếu có).
+// Query dry_run=true chỉ trả về bản xem trước
+func ImportWithTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+	dryRun, err := dryRunParam(r)
+	if err != nil {
+		http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
+		return
+	}
+
+	file, err := importFile(w, r)
+	if err != nil {
+		http.Error(w, "Invalid import file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Invalid import file", http.StatusBadRequest)
+		return
+	}
+	portfolioID, err := portfolioIDParam(r)
+	if err != nil {
+		writeCustomError(w, err.(*services.CustomError))
+		return
+	}
+	accountID, err := accountIDParam(r)
+	if err != nil {
+		writeCustomError(w, err.(*services.CustomError))
+		return
+	}
+
+	var template *models.ImportTemplate
+	if id := r.FormValue("template_id"); id != "" {
+		template, err = services.GetImportTemplate(userID, id)
+	} else if value := r.FormValue("template"); value != "" {
+		template = &models.ImportTemplate{Name: "custom"}
+		if err := json.Unmarshal([]byte(value), template); err != nil {
+			http.Error(w, "Invalid template", http.StatusBadRequest)
+			return
+		}
+	} else {
+		err = &services.CustomError{Code: "INVALID_IMPORT_TEMPLATE", Message: "Specify template_id or a column mapping template."}
+	}
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	}
+
+	result, err := services.ImportWithTemplate(userID, portfolioID, accountID, template, data, dryRun)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error importing transactions", http.StatusInternalServerError)
+		return
+	}
+	writeImportResult(w, result)
+}
+
+// GetImportTemplates trả về các template import đã lưu của người dùng
+func GetImportTemplates(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	templates, err := services.ListImportTemplates(userID)
+	if err != nil {
+		http.Error(w, "Error fetching import templates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// CreateImportTemplate lưu template import mới của người dùng
+func CreateImportTemplate(w http.ResponseWriter, r *http.Request) {
+	saveImportTemplate(w, r, "")
+}
+
+// UpdateImportTemplate thay thế template import {id} của người dùng
+func UpdateImportTemplate(w http.ResponseWriter, r *http.Request) {
+	saveImportTemplate(w, r, mux.Vars(r)["id"])
+}
+
+// saveImportTemplate tạo (id rỗng) hoặc cập nhật template import từ body của yêu cầu
+func saveImportTemplate(w http.ResponseWriter, r *http.Request, id string) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var template models.ImportTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	err = services.SaveImportTemplate(userID, id, &template)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error saving import template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if id == "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(template)
+}
+
+// DeleteImportTemplate xóa template import {id} của người dùng
+func DeleteImportTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	err = services.DeleteImportTemplate(userID, mux.Vars(r)["id"])
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error deleting import template", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// dryRunParam đọc query dry_run, mặc định là false
+func dryRunParam(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// writeImportResult trả về báo cáo import, 201 khi có giao dịch được ghi
+func writeImportResult(w http.ResponseWriter, result *services.ImportResult) {
+	w.Header().Set("Content-Type", "application/json")
+	if !result.DryRun && result.Imported > 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// importFile trả về file được tải lên, giới hạn kích thước theo maxImportFileSize
+func importFile(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportFileSize)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxImportFileSize); err != nil {
+			return nil, err
+		}
+		file, _, err := r.FormFile("file")
+		return file, err
+	}
+	return r.Body, nil
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"crypto-folio/services"
+)
+
+// GetIncome trả về thu nhập (staking, airdrop, mining, interest) theo coin, loại và kỳ.
+// Query: period=day|month|year, from và to theo định dạng YYYY-MM-DD (to không bao gồm)
+func GetIncome(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	var from, to time.Time
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	summary, err := services.GetIncomeSummary(userID, query.Get("period"), from, to)
+	if customErr, ok := err.(*services.CustomError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error fetching income", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
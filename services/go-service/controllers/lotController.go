@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"crypto-folio/services"
+)
+
+// GetLots trả về các lô đang mở của người dùng kèm thời gian nắm giữ, có thể lọc theo ?coin= và
+// ?portfolio_id= (trống hoặc "all" là mọi danh mục chưa lưu trữ)
+func GetLots(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	portfolio, _, err := services.GetPortfolioView(userID, r.URL.Query().Get("portfolio_id"))
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error fetching portfolio", http.StatusInternalServerError)
+		return
+	}
+
+	coin := strings.ToUpper(r.URL.Query().Get("coin"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(services.BuildLotViews(portfolio, coin, time.Now()))
+}
+
+// GetCostBasisMethod trả về phương pháp tính giá vốn hiện tại của người dùng
+func GetCostBasisMethod(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := services.GetUser(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"cost_basis_method": user.GetCostBasisMethod()})
+}
+
+// UpdateCostBasisMethod thay đổi phương pháp tính giá vốn (fifo, lifo, hifo, average, specific)
+func UpdateCostBasisMethod(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var updateData struct {
+		CostBasisMethod string `json:"cost_basis_method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	method := strings.ToLower(strings.TrimSpace(updateData.CostBasisMethod))
+	err = services.UpdateCostBasisMethod(userID, method)
+	if customErr, ok := err.(*services.CustomError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(customErr)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"cost_basis_method": method})
+}
@@ -1,20 +1,19 @@
 package controllers
 
 import (
-	"context"
-	"crypto-folio/configs"
 	"crypto-folio/models"
 	"crypto-folio/services"
 	"encoding/json"
-	"fmt"
-	"io"
+	"log"
 	"net/http"
-	"time"
+	"sort"
 
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// GetPortfolio lấy thông tin danh mục đầu tư của người dùng dựa trên ID từ session và tính toán lời/lỗ
+// GetPortfolio lấy thông tin danh mục đầu tư của người dùng dựa trên ID từ session và tính toán lời/lỗ,
+// kèm số lượng và giá trị của từng coin theo nơi lưu giữ (tài khoản sàn, ví).
+// Query portfolio_id chọn một danh mục; trống hoặc "all" trả về tổng hợp mọi danh mục chưa lưu trữ
 func GetPortfolio(w http.ResponseWriter, r *http.Request) {
 	// Lấy userID từ session để xác thực người dùng
 	userID, err := getUserIDFromSession(r)
@@ -23,67 +22,57 @@ func GetPortfolio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Thiết lập collection MongoDB và context có thời gian chờ để truy vấn
-	portfolioCollection := configs.GetCollection("portfolios")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Tìm danh mục đầu tư của người dùng trong cơ sở dữ liệu
-	var portfolio models.Portfolio
-	err = portfolioCollection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&portfolio)
+	// Lấy danh mục được chọn hoặc danh mục tổng hợp
+	portfolio, portfolioIDs, err := services.GetPortfolioView(userID, r.URL.Query().Get("portfolio_id"))
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error fetching portfolio", http.StatusInternalServerError)
+		return
+	}
+	// Các tài khoản (sàn, ví) của danh mục dùng để chia holding theo nơi lưu giữ
+	accounts, err := services.ListAccounts(userID, portfolioIDs)
 	if err != nil {
-		http.Error(w, "Portfolio not found", http.StatusNotFound)
+		http.Error(w, "Error fetching accounts", http.StatusInternalServerError)
 		return
 	}
-	// Lấy giá real-time cho mỗi loại coin từ Binance API và xử lý lỗi trong quá trình gọi API
-	prices := make(map[string]float64)
-	for symbol := range portfolio.CoinHoldings {
-		response, err := http.Get(fmt.Sprintf("https://api.binance.com/api/v3/ticker/price?symbol=%sUSDT", symbol))
-		if err != nil {
-			http.Error(w, "Failed to get price from Binance", http.StatusInternalServerError)
-			return
-		}
-		defer response.Body.Close()
-
-		// Đọc dữ liệu từ phản hồi API và kiểm tra lỗi
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			http.Error(w, "Failed to read response body", http.StatusInternalServerError)
-			return
-		}
-
-		// Giải mã JSON từ phản hồi để lấy giá
-		var priceData map[string]interface{}
-		if err := json.Unmarshal(body, &priceData); err != nil {
-			http.Error(w, "Failed to unmarshal response", http.StatusInternalServerError)
-			return
-		}
-
-		// Lấy giá dưới dạng chuỗi và chuyển đổi sang float64
-		price, ok := priceData["price"].(string)
-		if !ok {
-			http.Error(w, "Invalid price format from Binance", http.StatusInternalServerError)
-			return
-		}
-
-		var realTimePrice float64
-		if _, err := fmt.Sscanf(price, "%f", &realTimePrice); err != nil {
-			http.Error(w, "Failed to parse price", http.StatusInternalServerError)
-			return
-		}
-
-		// Lưu giá vào map để sử dụng cho các tính toán tiếp theo
-		prices[symbol] = realTimePrice
+	byAccount := services.HoldingsByAccount(portfolio)
+	// Lấy giá real-time cho tất cả coin trong danh mục thông qua cache giá và chuỗi nguồn giá.
+	// Coin không lấy được giá vẫn được trả về nhưng không có giá trị hiện tại
+	prices, err := services.GetPrices(holdingSymbols(portfolio.CoinHoldings))
+	if err != nil {
+		log.Printf("Warning: %v", err)
 	}
 
-	// Tạo dữ liệu chi tiết về danh mục đầu tư bao gồm số lượng, giá trung bình, giá trị hiện tại và lời/lỗ
+	// Tạo dữ liệu chi tiết về danh mục đầu tư bao gồm số lượng, giá trung bình, giá trị hiện tại,
+	// lời/lỗ chưa thực hiện (profitLoss), lời/lỗ đã thực hiện (realizedPL), tổng lời/lỗ (totalPL)
+	// và thu nhập đã nhận (income), tính theo USD
+	totals := map[string]float64{"currentValue": 0, "costBasis": 0, "unrealizedPL": 0, "realizedPL": 0, "totalPL": 0, "income": 0}
+	for _, amounts := range portfolio.Income {
+		totals["income"] += realizedIn(amounts, "USD", 1)
+	}
 	portfolioData := []map[string]interface{}{}
 	for symbol, holding := range portfolio.CoinHoldings {
-		currentPrice, ok := prices[symbol]
+		realizedPL := realizedIn(portfolio.RealizedPL[symbol], "USD", 1)
+		totals["realizedPL"] += realizedPL
+
+		item := map[string]interface{}{
+			"symbol":         symbol,
+			"quantity":       holding.Quantity,
+			"avgBuyPrice":    holding.AvgBuyPrice,
+			"realizedPL":     realizedPL,
+			"income":         realizedIn(portfolio.Income[symbol], "USD", 1),
+			"priceAvailable": false,
+		}
+
+		quote, ok := prices[symbol]
+		item["locations"] = holdingLocations(byAccount, accounts, symbol, quote, ok)
 		if !ok {
-			http.Error(w, "Price not found for symbol", http.StatusInternalServerError)
-			return
+			portfolioData = append(portfolioData, item)
+			continue
 		}
+		currentPrice := quote.Price
 
 		// Tính toán giá trị hiện tại và lời/lỗ dựa trên giá trung bình mua và giá hiện tại
 		currentValue := currentPrice * holding.Quantity
@@ -92,23 +81,50 @@ func GetPortfolio(w http.ResponseWriter, r *http.Request) {
 		if holding.AvgBuyPrice > 0 {
 			profitLossPercent = ((currentPrice - holding.AvgBuyPrice) / holding.AvgBuyPrice) * 100
 		}
+		totals["currentValue"] += currentValue
+		totals["costBasis"] += holding.AvgBuyPrice * holding.Quantity
+		totals["unrealizedPL"] += profitLoss
+
+		item["priceAvailable"] = true
+		item["currentPrice"] = currentPrice
+		item["priceSource"] = quote.Source
+		item["priceUpdatedAt"] = quote.FetchedAt
+		item["priceStale"] = quote.Stale
+		item["currentValue"] = currentValue
+		item["profitLoss"] = profitLoss
+		item["profitLossPercent"] = profitLossPercent
+		item["totalPL"] = profitLoss + realizedPL
+		item["isProfit"] = profitLoss >= 0
+		portfolioData = append(portfolioData, item)
+	}
 
-		portfolioData = append(portfolioData, map[string]interface{}{
-			"symbol":            symbol,
-			"quantity":          holding.Quantity,
-			"avgBuyPrice":       holding.AvgBuyPrice,
-			"currentValue":      currentValue,
-			"profitLoss":        profitLoss,
-			"profitLossPercent": profitLossPercent,
-			"isProfit":          profitLoss >= 0,
+	// Các coin đã bán hết chỉ còn lời/lỗ đã thực hiện
+	closedPositions := []map[string]interface{}{}
+	for symbol, amounts := range portfolio.RealizedPL {
+		if _, held := portfolio.CoinHoldings[symbol]; held {
+			continue
+		}
+		realizedPL := realizedIn(amounts, "USD", 1)
+		totals["realizedPL"] += realizedPL
+		closedPositions = append(closedPositions, map[string]interface{}{
+			"symbol":     symbol,
+			"realizedPL": realizedPL,
 		})
 	}
+	totals["totalPL"] = totals["unrealizedPL"] + totals["realizedPL"]
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(portfolioData)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"portfolio":       portfolioInfo(portfolio),
+		"holdings":        portfolioData,
+		"locations":       locationSummary(byAccount, accounts, prices),
+		"closedPositions": closedPositions,
+		"totals":          totals,
+	})
 }
 
-// GetPortfolioData trả về thông tin danh mục đầu tư của người dùng
+// GetPortfolioData trả về thông tin danh mục đầu tư của người dùng cho dashboard.
+// Query portfolio_id chọn một danh mục; trống hoặc "all" trả về tổng hợp mọi danh mục chưa lưu trữ
 func GetPortfolioData(w http.ResponseWriter, r *http.Request) {
 	userID, err := getUserIDFromSession(r)
 	if err != nil {
@@ -116,56 +132,301 @@ func GetPortfolioData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	portfolio, err := services.GetUserPortfolio(userID)
-	if err != nil {
+	portfolio, portfolioIDs, err := services.GetPortfolioView(userID, r.URL.Query().Get("portfolio_id"))
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
 		http.Error(w, "Error fetching portfolio", http.StatusInternalServerError)
 		return
 	}
 
-	// Lấy tỷ giá USD sang JPY từ API
-	conversionRateUSDToJPY, err := services.GetUSDToJPYRate()
+	// Lấy tiền tệ cơ sở và các tiền tệ hiển thị mà người dùng đã chọn
+	baseCurrency, displayCurrencies, err := services.GetUserCurrencies(userID)
 	if err != nil {
-		http.Error(w, "Error fetching USD to JPY conversion rate", http.StatusInternalServerError)
+		http.Error(w, "Error fetching user currencies", http.StatusInternalServerError)
 		return
 	}
 
-	var portfolioData []map[string]interface{}
-	for coinSymbol, holding := range portfolio.CoinHoldings {
-		currentPriceUSD, currentPriceJPY, err := services.GetCurrentPrice(coinSymbol)
-		if err != nil {
-			http.Error(w, "Error fetching coin prices", http.StatusInternalServerError)
-			return
+	// Lấy tỷ giá USD sang từng tiền tệ hiển thị và giá USD của tất cả coin thông qua cache giá
+	rates, err := services.GetFiatRatesFrom("USD", displayCurrencies)
+	if err != nil {
+		http.Error(w, "Error fetching conversion rates", http.StatusInternalServerError)
+		return
+	}
+	symbols := holdingSymbols(portfolio.CoinHoldings)
+	prices, err := services.GetPrices(symbols)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Lấy lịch sử giá mua (priceHistory) của tất cả coin trong một truy vấn
+	priceHistories, err := services.GetPriceHistories(userID, portfolioIDs, symbols)
+	if err != nil {
+		http.Error(w, "Error fetching price history", http.StatusInternalServerError)
+		return
+	}
+
+	// Tổng giá trị, giá vốn và lời/lỗ của cả danh mục theo từng tiền tệ hiển thị
+	totals := make(map[string]map[string]float64, len(displayCurrencies))
+	for _, currency := range displayCurrencies {
+		totals[currency] = map[string]float64{"currentValue": 0, "costBasis": 0, "unrealizedPL": 0, "realizedPL": 0, "totalPL": 0, "income": 0}
+		for _, amounts := range portfolio.Income {
+			totals[currency]["income"] += realizedIn(amounts, currency, rates[currency])
 		}
+	}
 
+	portfolioData := []map[string]interface{}{}
+	for coinSymbol, holding := range portfolio.CoinHoldings {
 		// Kiểm tra số lượng nắm giữ là dương trước khi tính toán
 		if holding.Quantity <= 0 {
 			continue
 		}
-		// Lấy lịch sử giá mua (priceHistory) cho coin từ một dịch vụ
-		priceHistory, err := services.GetPriceHistory(userID, coinSymbol)
-		if err != nil {
-			http.Error(w, "Error fetching price history", http.StatusInternalServerError)
-			return
+		data := map[string]interface{}{
+			"symbol":         coinSymbol,
+			"quantity":       holding.Quantity,
+			"avgBuyPrice":    holding.AvgBuyPrice,
+			"priceHistory":   priceHistories[coinSymbol],
+			"baseCurrency":   baseCurrency,
+			"priceAvailable": false,
 		}
-		currentValueUSD := holding.Quantity * currentPriceUSD
-		currentValueJPY := holding.Quantity * currentPriceJPY
-		profitLossUSD := currentValueUSD - (holding.Quantity * holding.AvgBuyPrice)
-		profitLossJPY := currentValueJPY - (holding.Quantity * holding.AvgBuyPrice * conversionRateUSDToJPY)
 
-		data := map[string]interface{}{
-			"symbol":          coinSymbol,
-			"quantity":        holding.Quantity,
-			"avgBuyPrice":     holding.AvgBuyPrice,
-			"currentValueUSD": currentValueUSD,
-			"currentValueJPY": currentValueJPY,
-			"profitLossUSD":   profitLossUSD,
-			"profitLossJPY":   profitLossJPY,
-			"isProfit":        profitLossUSD >= 0,
-			"priceHistory":    priceHistory,
+		// Lời/lỗ đã thực hiện và thu nhập không phụ thuộc giá hiện tại nên luôn được trả về
+		values := make(map[string]map[string]float64, len(displayCurrencies))
+		for _, currency := range displayCurrencies {
+			realizedPL := realizedIn(portfolio.RealizedPL[coinSymbol], currency, rates[currency])
+			values[currency] = map[string]float64{
+				"realizedPL": realizedPL,
+				"income":     realizedIn(portfolio.Income[coinSymbol], currency, rates[currency]),
+			}
+			totals[currency]["realizedPL"] += realizedPL
+		}
+		data["values"] = values
+
+		quote, ok := prices[coinSymbol]
+		if ok {
+			// Quy đổi giá trị hiện tại và lời/lỗ sang từng tiền tệ hiển thị.
+			// Các key phẳng currentValue<TIỀN TỆ> và profitLoss<TIỀN TỆ> được giữ để tương thích với giao diện cũ
+			for _, currency := range displayCurrencies {
+				rate := rates[currency]
+				currentValue := holding.Quantity * quote.Price * rate
+
+				// Ưu tiên giá vốn tính theo tỷ giá lúc mua, nếu chưa có thì quy đổi bằng tỷ giá hiện tại
+				costBasis, ok := holding.CostBasis[currency]
+				if !ok {
+					costBasis = holding.Quantity * holding.AvgBuyPrice * rate
+				}
+				profitLoss := currentValue - costBasis
+
+				value := values[currency]
+				value["currentPrice"] = quote.Price * rate
+				value["currentValue"] = currentValue
+				value["costBasis"] = costBasis
+				value["profitLoss"] = profitLoss
+				value["totalPL"] = profitLoss + value["realizedPL"]
+				data["currentValue"+currency] = currentValue
+				data["profitLoss"+currency] = profitLoss
+
+				totals[currency]["currentValue"] += currentValue
+				totals[currency]["costBasis"] += costBasis
+				totals[currency]["unrealizedPL"] += profitLoss
+			}
+
+			data["priceAvailable"] = true
+			data["priceSource"] = quote.Source
+			data["priceUpdatedAt"] = quote.FetchedAt
+			data["priceStale"] = quote.Stale
+			data["isProfit"] = values[baseCurrency]["profitLoss"] >= 0
 		}
 		portfolioData = append(portfolioData, data)
 	}
 
+	// Các coin đã bán hết chỉ còn lời/lỗ đã thực hiện
+	closedPositions := []map[string]interface{}{}
+	for coinSymbol, amounts := range portfolio.RealizedPL {
+		if holding, held := portfolio.CoinHoldings[coinSymbol]; held && holding.Quantity > 0 {
+			continue
+		}
+		realized := make(map[string]float64, len(displayCurrencies))
+		for _, currency := range displayCurrencies {
+			realized[currency] = realizedIn(amounts, currency, rates[currency])
+			totals[currency]["realizedPL"] += realized[currency]
+		}
+		closedPositions = append(closedPositions, map[string]interface{}{
+			"symbol":     coinSymbol,
+			"realizedPL": realized,
+		})
+	}
+	for _, currency := range displayCurrencies {
+		totals[currency]["totalPL"] = totals[currency]["unrealizedPL"] + totals[currency]["realizedPL"]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"portfolio":       portfolioInfo(portfolio),
+		"baseCurrency":    baseCurrency,
+		"holdings":        portfolioData,
+		"closedPositions": closedPositions,
+		"totals":          totals,
+	})
+}
+
+// GetPortfolioHistory trả về chuỗi giá trị cuối ngày của danh mục để vẽ biểu đồ. Query: portfolio_id (trống hoặc
+// "all" là tổng hợp), range=1W|1M|YTD|1Y|ALL (mặc định 1M), resolution=day|week|month và currency (mặc định tiền tệ cơ sở).
+// Khi pending là true, một số điểm đang được định giá nền và cần gọi lại sau
+func GetPortfolioHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	history, err := services.GetValueHistory(userID, query.Get("portfolio_id"), query.Get("range"), query.Get("resolution"), query.Get("currency"))
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error fetching portfolio history", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(portfolioData)
+	json.NewEncoder(w).Encode(history)
+}
+
+// portfolioInfo trả về ID và tên của danh mục được hiển thị; ID là "all" với danh mục tổng hợp
+func portfolioInfo(portfolio *models.Portfolio) map[string]interface{} {
+	id := services.AllPortfolios
+	if !portfolio.ID.IsZero() {
+		id = portfolio.ID.Hex()
+	}
+	return map[string]interface{}{"id": id, "name": portfolio.Name, "archived": portfolio.Archived}
+}
+
+// accountLocation trả về thông tin nơi lưu giữ của tài khoản account (ID hoặc "unassigned")
+func accountLocation(account string, accounts []models.Account) map[string]interface{} {
+	location := map[string]interface{}{"accountId": account, "name": "Unassigned", "type": models.AccountOther}
+	for _, item := range accounts {
+		if item.ID.Hex() == account {
+			location["name"] = item.Name
+			location["type"] = item.Type
+			location["address"] = item.Address
+			break
+		}
+	}
+	return location
+}
+
+// holdingLocations chia số lượng coin symbol theo từng tài khoản đang giữ nó, kèm giá trị USD khi có giá
+func holdingLocations(byAccount map[string]map[string]models.CoinHolding, accounts []models.Account, symbol string, quote services.PriceQuote, priced bool) []map[string]interface{} {
+	locations := []map[string]interface{}{}
+	for account, holdings := range byAccount {
+		holding, ok := holdings[symbol]
+		if !ok || holding.Quantity <= 0 {
+			continue
+		}
+		location := accountLocation(account, accounts)
+		location["quantity"] = holding.Quantity
+		if priced {
+			location["currentValue"] = holding.Quantity * quote.Price
+		}
+		locations = append(locations, location)
+	}
+	sortLocations(locations)
+	return locations
+}
+
+// locationSummary tổng hợp giá trị hiện tại và giá vốn USD của từng tài khoản trong danh mục.
+// Tài khoản chưa giữ coin nào vẫn được trả về; "Unassigned" chỉ xuất hiện khi còn holding chưa gắn tài khoản
+func locationSummary(byAccount map[string]map[string]models.CoinHolding, accounts []models.Account, prices map[string]services.PriceQuote) []map[string]interface{} {
+	keys := map[string]bool{}
+	for _, account := range accounts {
+		keys[account.ID.Hex()] = true
+	}
+	for account, holdings := range byAccount {
+		if len(holdings) > 0 {
+			keys[account] = true
+		}
+	}
+
+	locations := make([]map[string]interface{}, 0, len(keys))
+	for account := range keys {
+		currentValue, costBasis, coins := 0.0, 0.0, 0
+		for symbol, holding := range byAccount[account] {
+			if holding.Quantity <= 0 {
+				continue
+			}
+			coins++
+			costBasis += holding.AvgBuyPrice * holding.Quantity
+			if quote, ok := prices[symbol]; ok {
+				currentValue += quote.Price * holding.Quantity
+			}
+		}
+		location := accountLocation(account, accounts)
+		location["coins"] = coins
+		location["currentValue"] = currentValue
+		location["costBasis"] = costBasis
+		locations = append(locations, location)
+	}
+	sortLocations(locations)
+	return locations
+}
+
+// sortLocations sắp xếp nơi lưu giữ theo tên, "Unassigned" luôn ở cuối
+func sortLocations(locations []map[string]interface{}) {
+	sort.Slice(locations, func(a, b int) bool {
+		unassignedA := locations[a]["accountId"] == models.UnassignedAccount
+		unassignedB := locations[b]["accountId"] == models.UnassignedAccount
+		if unassignedA != unassignedB {
+			return unassignedB
+		}
+		return locations[a]["name"].(string) < locations[b]["name"].(string)
+	})
+}
+
+// portfolioIDParam đọc portfolio_id từ query hoặc form; trống nghĩa là danh mục mặc định.
+// Lỗi trả về luôn là CustomError
+func portfolioIDParam(r *http.Request) (primitive.ObjectID, error) {
+	value := r.FormValue("portfolio_id")
+	if value == "" {
+		return primitive.NilObjectID, nil
+	}
+	portfolioID, err := primitive.ObjectIDFromHex(value)
+	if err != nil {
+		return primitive.NilObjectID, &services.CustomError{Code: "PORTFOLIO_NOT_FOUND", Message: "Portfolio not found."}
+	}
+	return portfolioID, nil
+}
+
+// accountIDParam đọc account_id từ query hoặc form; trống nghĩa là không gắn tài khoản.
+// Lỗi trả về luôn là CustomError
+func accountIDParam(r *http.Request) (primitive.ObjectID, error) {
+	value := r.FormValue("account_id")
+	if value == "" {
+		return primitive.NilObjectID, nil
+	}
+	accountID, err := primitive.ObjectIDFromHex(value)
+	if err != nil {
+		return primitive.NilObjectID, &services.CustomError{Code: "ACCOUNT_NOT_FOUND", Message: "Account not found in this portfolio."}
+	}
+	return accountID, nil
+}
+
+// realizedIn trả về lời/lỗ đã thực hiện (hoặc thu nhập) theo currency. Nếu giao dịch không
+// ghi nhận tiền tệ đó, giá trị USD được quy đổi bằng tỷ giá hiện tại usdRate
+func realizedIn(amounts map[string]float64, currency string, usdRate float64) float64 {
+	if amount, ok := amounts[currency]; ok {
+		return amount
+	}
+	return amounts["USD"] * usdRate
+}
+
+// holdingSymbols trả về danh sách ký hiệu coin có trong danh mục
+func holdingSymbols(holdings map[string]models.CoinHolding) []string {
+	symbols := make([]string, 0, len(holdings))
+	for symbol := range holdings {
+		symbols = append(symbols, symbol)
+	}
+	return symbols
 }
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"crypto-folio/models"
+	"crypto-folio/services"
+
+	"github.com/gorilla/mux"
+)
+
+// GetPortfolios trả về mọi danh mục của người dùng (kể cả đã lưu trữ) theo thứ tự tạo
+func GetPortfolios(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	portfolios, err := services.ListPortfolios(userID)
+	if err != nil {
+		http.Error(w, "Error fetching portfolios", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(portfolios)
+}
+
+// CreatePortfolio tạo danh mục mới với tên trong body ({"name": "..."})
+func CreatePortfolio(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	portfolio, err := services.CreatePortfolio(userID, body.Name)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error creating portfolio", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(portfolio)
+}
+
+// UpdatePortfolio đổi tên, lưu trữ/bỏ lưu trữ hoặc chọn danh mục {id} làm mặc định.
+// Body chỉ chứa các trường cần sửa: name, archived, default
+func UpdatePortfolio(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var patch models.PortfolioPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	portfolio, err := services.UpdatePortfolio(userID, mux.Vars(r)["id"], &patch)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating portfolio", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(portfolio)
+}
+
+// DeletePortfolio xóa danh mục {id} không còn giao dịch của người dùng
+func DeletePortfolio(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	err = services.DeletePortfolio(userID, mux.Vars(r)["id"])
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error deleting portfolio", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,20 +1,19 @@
 package controllers
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"crypto-folio/configs"
 	"crypto-folio/models"
 	"crypto-folio/services"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // getUserIDFromSession lấy ID người dùng từ session nếu người dùng đã xác thực
@@ -43,7 +42,8 @@ func getUserIDFromSession(r *http.Request) (primitive.ObjectID, error) {
 	return userID, nil
 }
 
-// AddTransaction xử lý thêm giao dịch mới của người dùng và cập nhật danh mục đầu tư
+// AddTransaction xử lý thêm giao dịch mới của người dùng và cập nhật danh mục đầu tư.
+// portfolio_id trong body chọn danh mục nhận giao dịch, để trống thì dùng danh mục mặc định
 func AddTransaction(w http.ResponseWriter, r *http.Request) {
 	var transaction models.Transaction
 
@@ -61,33 +61,31 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Thiết lập các thông tin metadata cho giao dịch
-	transaction.UserID = userID              // Gắn ID người dùng vào giao dịch
-	transaction.ID = primitive.NewObjectID() // Tạo ObjectID mới cho giao dịch
-	transaction.Date = time.Now()            // Gán thời gian giao dịch hiện tại
-	transaction.CreatedAt = time.Now()       // Gán thời gian tạo
-	transaction.Status = "completed"         // Đặt trạng thái giao dịch là "completed"
-
-	// Cập nhật danh mục đầu tư của người dùng với giao dịch mới
-	err = services.UpdatePortfolio(userID, transaction)
+	// Kiểm tra giao dịch, gán metadata và ghi lại tỷ giá tại ngày giao dịch sang USD và các tiền tệ của người dùng
+	_, currencies, err := services.GetUserCurrencies(userID)
+	if err != nil {
+		http.Error(w, "Error fetching user currencies", http.StatusInternalServerError)
+		return
+	}
+	err = services.PrepareTransaction(userID, &transaction, currencies)
 	if customErr, ok := err.(*services.CustomError); ok {
-		// Gửi phản hồi lỗi nếu cập nhật danh mục thất bại
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(customErr)
 		return
 	} else if err != nil {
-		// Xử lý lỗi khác nếu cập nhật danh mục thất bại
-		http.Error(w, "Error updating portfolio", http.StatusInternalServerError)
+		http.Error(w, "Error fetching exchange rates", http.StatusBadGateway)
 		return
 	}
 
-	// Nếu danh mục đầu tư được cập nhật thành công, thêm giao dịch vào cơ sở dữ liệu
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	transactionCollection := configs.GetCollection("transactions")
-	_, err = transactionCollection.InsertOne(ctx, transaction)
-	if err != nil {
+	// Cập nhật danh mục đầu tư và lưu giao dịch trong cùng một lần ghi nguyên tử
+	err = services.RecordTransaction(userID, &transaction)
+	if customErr, ok := err.(*services.CustomError); ok {
+		// Gửi phản hồi lỗi nếu giao dịch không hợp lệ với danh mục hiện tại
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		// Xử lý lỗi khác nếu cập nhật danh mục hoặc lưu giao dịch thất bại
 		http.Error(w, "Error adding transaction", http.StatusInternalServerError)
 		return
 	}
@@ -98,7 +96,10 @@ func AddTransaction(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode("Transaction added and portfolio updated successfully")
 }
 
-// GetTransactions trả về danh sách giao dịch của người dùng theo thứ tự mới nhất đến cũ nhất
+// GetTransactions trả về một trang giao dịch của người dùng, mặc định mới nhất trước.
+// Query: limit (mặc định 50, tối đa 200), cursor (next_cursor của trang trước), sort=date|created_at|amount,
+// order=desc|asc, q (tìm theo coin, nguồn, ID phía sàn...) và các bộ lọc from, to, coin, type, status, portfolio_id, account_id.
+// Giao dịch đã xóa chỉ được trả về khi lọc status=deleted
 func GetTransactions(w http.ResponseWriter, r *http.Request) {
 	// Lấy ID người dùng từ session để xác thực
 	userID, err := getUserIDFromSession(r)
@@ -107,58 +108,235 @@ func GetTransactions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Tạo collection và context có thời gian chờ cho thao tác với cơ sở dữ liệu
-	collection := configs.GetCollection("transactions")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Thiết lập tùy chọn sắp xếp theo thứ tự giảm dần của ngày giao dịch ("date")
-	findOptions := options.Find().SetSort(bson.M{"date": -1})
-
-	// Tìm tất cả giao dịch của người dùng trong cơ sở dữ liệu
-	var transactions []models.Transaction
-	cursor, err := collection.Find(ctx, bson.M{"user_id": userID}, findOptions)
-	if err != nil {
+	filter, err := transactionFilterFromQuery(r, userID)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
 		http.Error(w, "Error retrieving transactions", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(ctx)
+	query := r.URL.Query()
+	page := services.TransactionPage{
+		Cursor: query.Get("cursor"),
+		Sort:   query.Get("sort"),
+		Order:  query.Get("order"),
+		Search: query.Get("q"),
+	}
+	if value := query.Get("limit"); value != "" {
+		if page.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Chuyển tất cả các giao dịch vào slice transactions
-	if err := cursor.All(ctx, &transactions); err != nil {
-		http.Error(w, "Error processing transactions", http.StatusInternalServerError)
+	list, err := services.ListTransactions(userID, filter, page)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error retrieving transactions", http.StatusInternalServerError)
 		return
 	}
 
 	// Trả về dữ liệu giao dịch dưới dạng JSON
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(transactions)
+	json.NewEncoder(w).Encode(list)
 }
 
-// UpdateTransaction sẽ cập nhật thông tin giao dịch dựa trên ID giao dịch
+// ExportTransactions stream lịch sử giao dịch của người dùng để tải về. Query: format=csv|ndjson|ofx|qif
+// (mặc định csv), currency cho các trường tính toán (mặc định tiền tệ cơ sở), from và to theo định dạng
+// YYYY-MM-DD (to không bao gồm), coin, type và status (nhiều giá trị phân cách bằng dấu phẩy), portfolio_id và account_id
+func ExportTransactions(w http.ResponseWriter, r *http.Request) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := transactionFilterFromQuery(r, userID)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error exporting transactions", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = services.ExportCSV
+	}
+
+	export, err := services.OpenTransactionExport(userID, format, query.Get("currency"), filter)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error exporting transactions", http.StatusInternalServerError)
+		return
+	}
+	defer export.Close()
+
+	filename := fmt.Sprintf("transactions-%s.%s", time.Now().Format("20060102"), export.Extension)
+	w.Header().Set("Content-Type", export.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// Header đã được gửi nên lỗi giữa chừng chỉ có thể ghi log, file tải về sẽ bị cắt ngang
+	if err := export.Stream(w); err != nil {
+		log.Printf("Error streaming transaction export: %v", err)
+	}
+}
+
+// transactionFilterFromQuery đọc bộ lọc giao dịch từ query: from và to (YYYY-MM-DD, to không bao gồm),
+// coin, type và status (nhiều giá trị phân cách bằng dấu phẩy), portfolio_id (trống hoặc "all" là mọi danh mục)
+// và account_id
+func transactionFilterFromQuery(r *http.Request, userID primitive.ObjectID) (services.TransactionFilter, error) {
+	query := r.URL.Query()
+	var filter services.TransactionFilter
+	var err error
+	if value := query.Get("from"); value != "" {
+		if filter.From, err = time.Parse("2006-01-02", value); err != nil {
+			return filter, &services.CustomError{Code: "INVALID_DATE", Message: "The from date must use the YYYY-MM-DD format."}
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if filter.To, err = time.Parse("2006-01-02", value); err != nil {
+			return filter, &services.CustomError{Code: "INVALID_DATE", Message: "The to date must use the YYYY-MM-DD format."}
+		}
+	}
+	filter.Coins = splitQueryList(query.Get("coin"))
+	filter.Types = splitQueryList(query.Get("type"))
+	filter.Statuses = splitQueryList(query.Get("status"))
+	if value := query.Get("portfolio_id"); value != "" && value != services.AllPortfolios {
+		portfolio, err := services.FindUserPortfolio(userID, value)
+		if err != nil {
+			return filter, err
+		}
+		filter.PortfolioID = portfolio.ID
+	}
+	if filter.AccountID, err = accountIDParam(r); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// splitQueryList tách giá trị query phân cách bằng dấu phẩy, bỏ các phần tử rỗng
+func splitQueryList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// UpdateTransaction cập nhật giao dịch {id} của người dùng (PUT, dùng bởi giao diện hiện tại).
+// Body có thể chứa toàn bộ giao dịch; chỉ các trường được phép sửa được áp dụng
 func UpdateTransaction(w http.ResponseWriter, r *http.Request) {
-	// Lấy ID giao dịch từ URL
-	vars := mux.Vars(r)
-	id := vars["id"]
+	updateTransaction(w, r, false)
+}
+
+// PatchTransaction cập nhật một phần giao dịch {id} của người dùng. Body chỉ được chứa các trường
+// được phép sửa (coin, transaction_type, amount, price, value, date, quote_currency, fee_amount,
+// fee_currency, lot_ids, acquired_at, to_coin, to_amount, account_id, to_account_id)
+func PatchTransaction(w http.ResponseWriter, r *http.Request) {
+	updateTransaction(w, r, true)
+}
 
-	// Giải mã dữ liệu từ body của yêu cầu
-	var updatedTransaction models.Transaction
-	err := json.NewDecoder(r.Body).Decode(&updatedTransaction)
+// updateTransaction kiểm tra quyền sở hữu, áp dụng các trường được sửa và dựng lại danh mục
+func updateTransaction(w http.ResponseWriter, r *http.Request, strict bool) {
+	userID, err := getUserIDFromSession(r)
 	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	// Giải mã dữ liệu từ body của yêu cầu, PATCH từ chối các trường không được phép sửa
+	var patch models.TransactionPatch
+	decoder := json.NewDecoder(r.Body)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&patch); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	// Gọi phương thức cập nhật giao dịch trong model
-	err = models.UpdateTransaction(id, &updatedTransaction)
-	if err != nil {
+	transaction, err := services.EditTransaction(userID, mux.Vars(r)["id"], &patch)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to update transaction", http.StatusInternalServerError)
 		return
 	}
-	// Trả về dữ liệu giao dịch dưới dạng JSON
-	// Trả về kết quả thành công
+
+	// Trả về giao dịch đã cập nhật dưới dạng JSON
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(updatedTransaction)
+	json.NewEncoder(w).Encode(transaction)
+}
+
+// DeleteTransaction xóa giao dịch của người dùng khỏi lịch sử và dựng lại danh mục.
+// Bản ghi gốc được giữ lại với trạng thái deleted để đối chiếu
+func DeleteTransaction(w http.ResponseWriter, r *http.Request) {
+	removeTransaction(w, r, models.StatusDeleted, "")
+}
+
+// VoidTransaction hủy giao dịch (trạng thái void) để loại khỏi danh mục nhưng vẫn hiển thị trong lịch sử
+func VoidTransaction(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	removeTransaction(w, r, models.StatusVoid, body.Reason)
+}
+
+// removeTransaction chuyển giao dịch {id} của người dùng sang trạng thái status và trả về kết quả
+func removeTransaction(w http.ResponseWriter, r *http.Request, status, reason string) {
+	userID, err := getUserIDFromSession(r)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	err = services.RemoveTransaction(userID, mux.Vars(r)["id"], status, reason)
+	if customErr, ok := err.(*services.CustomError); ok {
+		writeCustomError(w, customErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Error removing transaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"_id": mux.Vars(r)["id"], "status": status})
+}
+
+// writeCustomError ghi CustomError dưới dạng JSON: 404 khi không tìm thấy giao dịch hoặc template import,
+// 409 khi danh mục bị ghi đồng thời, Idempotency-Key đang được xử lý hoặc tên template đã tồn tại,
+// 422 khi key bị dùng lại cho yêu cầu khác và 400 cho các lỗi khác
+func writeCustomError(w http.ResponseWriter, customErr *services.CustomError) {
+	statusCode := http.StatusBadRequest
+	switch customErr.Code {
+	case "TRANSACTION_NOT_FOUND", "IMPORT_TEMPLATE_NOT_FOUND", "PORTFOLIO_NOT_FOUND", "ACCOUNT_NOT_FOUND":
+		statusCode = http.StatusNotFound
+	case "CONCURRENT_UPDATE", "IDEMPOTENCY_KEY_IN_PROGRESS", "IMPORT_TEMPLATE_EXISTS", "PORTFOLIO_EXISTS", "PORTFOLIO_NOT_EMPTY",
+		"ACCOUNT_EXISTS", "ACCOUNT_IN_USE":
+		statusCode = http.StatusConflict
+	case "IDEMPOTENCY_KEY_REUSED":
+		statusCode = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(customErr)
 }
@@ -9,6 +9,7 @@ import (
 
 	"crypto-folio/configs"
 	"crypto-folio/routes"
+	"crypto-folio/services"
 
 	"github.com/alexedwards/scs/mongodbstore"
 	"github.com/alexedwards/scs/v2"
@@ -39,6 +40,16 @@ func main() {
 
 	// Kết nối đến MongoDB thông qua hàm ConnectDB
 	configs.ConnectDB()
+	configs.EnsureIndexes()
+
+	// Khởi tạo chuỗi nguồn giá coin theo cấu hình PRICE_PROVIDERS
+	if err := services.InitPriceProviders(); err != nil {
+		log.Fatal("Failed to initialize price providers:", err)
+	}
+	// Làm mới giá ở nền cho các coin trong danh mục và watchlist
+	services.StartPriceRefresher()
+	// Ghi snapshot giá trị cuối ngày của các danh mục ở nền
+	services.StartSnapshotScheduler()
 
 	// Cấu hình tùy chọn client MongoDB với URI
 	env := os.Getenv("ENV")
@@ -66,13 +77,14 @@ func main() {
 	// Thiết lập router để quản lý các route của ứng dụng
 	router := mux.NewRouter()
 
-	// Định nghĩa các route cho xác thực, giao dịch, và danh mục đầu tư
+	// Định nghĩa các route cho xác thực, giao dịch, danh mục đầu tư và quản trị
 	// Thêm vào router với prefix /go
 	goRouter := router.PathPrefix("/go").Subrouter()
 	routes.AuthRoutes(goRouter)
 	routes.TransactionRoutes(goRouter)
 	routes.PortfolioRoutes(goRouter)
 	routes.DashboardRoutes(goRouter)
+	routes.AdminRoutes(goRouter)
 
 	// Cấu hình CORS dựa trên môi trường
 	var allowedOrigins []string
@@ -84,8 +96,8 @@ func main() {
 	// Cấu hình CORS để kiểm soát quyền truy cập từ frontend
 	corsOptions := cors.New(cors.Options{
 		AllowedOrigins:   allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Idempotency-Key"},
 		AllowCredentials: true,
 	})
 
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UnassignedAccount là key trong Portfolio.AccountHoldings của các coin từ giao dịch chưa gắn tài khoản
+const UnassignedAccount = "unassigned"
+
+// Các loại tài khoản (nơi giữ coin)
+const (
+	AccountExchange       = "exchange"        // Tài khoản trên sàn (Binance, Coinbase...)
+	AccountWallet         = "wallet"          // Ví nóng (MetaMask, Trust Wallet...)
+	AccountHardwareWallet = "hardware_wallet" // Ví lạnh (Ledger, Trezor...)
+	AccountOther          = "other"
+)
+
+// IsValidAccountType kiểm tra loại tài khoản có được hỗ trợ hay không
+func IsValidAccountType(accountType string) bool {
+	switch accountType {
+	case AccountExchange, AccountWallet, AccountHardwareWallet, AccountOther:
+		return true
+	}
+	return false
+}
+
+// Account là một nơi giữ coin (sàn, ví, địa chỉ...) thuộc về một danh mục của người dùng
+type Account struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"user_id"`
+	PortfolioID primitive.ObjectID `bson:"portfolio_id" json:"portfolio_id"`
+	Name        string             `bson:"name" json:"name"`
+	Type        string             `bson:"type" json:"type"`
+	Address     string             `bson:"address,omitempty" json:"address,omitempty"` // Địa chỉ ví hoặc ghi chú về vị trí
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// AccountPatch chứa các trường người dùng được phép sửa của một tài khoản; trường nil được giữ nguyên
+type AccountPatch struct {
+	Name    *string `json:"name"`
+	Type    *string `json:"type"`
+	Address *string `json:"address"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FXRate là tỷ giá lịch sử theo ngày giữa hai tiền tệ (fiat hoặc coin), lưu trong collection fx_rates
+type FXRate struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Base      string             `bson:"base" json:"base"`
+	Quote     string             `bson:"quote" json:"quote"`
+	Date      time.Time          `bson:"date" json:"date"` // Ngày áp dụng tỷ giá (00:00 UTC)
+	Rate      float64            `bson:"rate" json:"rate"` // Số đơn vị Quote cho 1 đơn vị Base
+	Source    string             `bson:"source" json:"source"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
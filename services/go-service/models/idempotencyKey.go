@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Trạng thái của một Idempotency-Key
+const (
+	IdempotencyProcessing = "processing" // Yêu cầu đầu tiên đang được xử lý
+	IdempotencyCompleted  = "completed"  // Đã có phản hồi, các lần gửi lại nhận đúng phản hồi này
+)
+
+// IdempotencyRecord lưu kết quả của yêu cầu gửi kèm header Idempotency-Key theo từng người dùng
+type IdempotencyRecord struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Key         string             `bson:"key" json:"key"`
+	RequestHash string             `bson:"request_hash" json:"request_hash"` // SHA-256 của method, đường dẫn và body để phát hiện key bị dùng lại cho yêu cầu khác
+	Status      string             `bson:"status" json:"status"`
+	LockToken   primitive.ObjectID `bson:"lock_token" json:"-"` // Định danh lần xử lý đang giữ key, chỉ lần đó được lưu hoặc xóa bản ghi
+	LockedAt    time.Time          `bson:"locked_at" json:"-"`  // Lần cuối lần xử lý đang giữ key báo còn chạy
+	StatusCode  int                `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	ContentType string             `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Response    []byte             `bson:"response,omitempty" json:"response,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt   time.Time          `bson:"expires_at" json:"expires_at"` // Bản ghi tự xóa sau thời điểm này (TTL index)
+}
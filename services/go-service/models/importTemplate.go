@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ColumnMapping ánh xạ trường của giao dịch sang tên cột trong file của người dùng.
+// Date, Coin và Amount là bắt buộc; Type có thể thay bằng ImportTemplate.DefaultType
+type ColumnMapping struct {
+	Date        string `bson:"date" json:"date"`
+	Type        string `bson:"type,omitempty" json:"type,omitempty"`
+	Coin        string `bson:"coin" json:"coin"`
+	Amount      string `bson:"amount" json:"amount"`
+	Price       string `bson:"price,omitempty" json:"price,omitempty"`
+	Total       string `bson:"total,omitempty" json:"total,omitempty"` // Tổng tiền, dùng để tính giá khi file không có cột giá
+	Currency    string `bson:"currency,omitempty" json:"currency,omitempty"`
+	Fee         string `bson:"fee,omitempty" json:"fee,omitempty"`
+	FeeCurrency string `bson:"fee_currency,omitempty" json:"fee_currency,omitempty"`
+	ExternalID  string `bson:"external_id,omitempty" json:"external_id,omitempty"`
+}
+
+// ImportTemplate là cấu hình import file CSV/XLSX tùy chỉnh được người dùng lưu lại để dùng nhiều lần
+type ImportTemplate struct {
+	ID                   primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID               primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Name                 string             `bson:"name" json:"name"`
+	Columns              ColumnMapping      `bson:"columns" json:"columns"`
+	DateFormat           string             `bson:"date_format,omitempty" json:"date_format,omitempty"`                       // Ví dụ "YYYY-MM-DD HH:mm:ss", "DD/MM/YYYY", "unix" hoặc "unix_ms"
+	Timezone             string             `bson:"timezone,omitempty" json:"timezone,omitempty"`                             // Múi giờ IANA của thời gian trong file, mặc định UTC
+	DecimalComma         bool               `bson:"decimal_comma,omitempty" json:"decimal_comma,omitempty"`                   // Số dùng dấu phẩy thập phân (1.234,56)
+	Delimiter            string             `bson:"delimiter,omitempty" json:"delimiter,omitempty"`                           // Ký tự phân cách của file CSV, mặc định dấu phẩy
+	Sheet                string             `bson:"sheet,omitempty" json:"sheet,omitempty"`                                   // Sheet của file XLSX, mặc định sheet đầu tiên
+	TypeMap              map[string]string  `bson:"type_map,omitempty" json:"type_map,omitempty"`                             // Giá trị trong cột loại giao dịch -> loại giao dịch (ví dụ "Bought" -> "buy")
+	DefaultType          string             `bson:"default_type,omitempty" json:"default_type,omitempty"`                     // Loại giao dịch khi không có cột loại hoặc ô trống
+	DefaultQuoteCurrency string             `bson:"default_quote_currency,omitempty" json:"default_quote_currency,omitempty"` // Đồng định giá khi không có cột tiền tệ
+	CreatedAt            time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt            time.Time          `bson:"updated_at" json:"updated_at"`
+}
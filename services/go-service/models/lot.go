@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Các phương pháp tính giá vốn khi bán
+const (
+	CostBasisFIFO     = "fifo"     // Lô mua trước bán trước
+	CostBasisLIFO     = "lifo"     // Lô mua sau bán trước
+	CostBasisHIFO     = "hifo"     // Lô có giá vốn cao nhất bán trước
+	CostBasisAverage  = "average"  // Giá vốn bình quân, trừ đều trên mọi lô
+	CostBasisSpecific = "specific" // Người dùng chỉ định lô cần bán qua lot_ids
+)
+
+// DefaultCostBasisMethod là phương pháp tính giá vốn khi người dùng chưa chọn
+const DefaultCostBasisMethod = CostBasisFIFO
+
+// LongTermHoldingDays là số ngày nắm giữ tối thiểu để một lô được xem là dài hạn
+const LongTermHoldingDays = 365
+
+// Lot là một lô coin được ghi nhận mỗi lần mua, giữ số lượng và giá vốn còn lại
+type Lot struct {
+	ID               string             `bson:"id" json:"id"` // Trùng với ID (hex) của giao dịch tạo ra lô
+	TransactionID    primitive.ObjectID `bson:"transaction_id,omitempty" json:"transaction_id,omitempty"`
+	Quantity         float64            `bson:"quantity" json:"quantity"` // Số lượng còn lại
+	OriginalQuantity float64            `bson:"original_quantity" json:"original_quantity"`
+	AcquiredAt       time.Time          `bson:"acquired_at" json:"acquired_at"`
+	CostBasis        map[string]float64 `bson:"cost_basis" json:"cost_basis"` // Giá vốn của số lượng còn lại theo từng tiền tệ
+}
+
+// LotConsumption ghi lại phần lô đã bị trừ bởi một giao dịch bán
+type LotConsumption struct {
+	LotID       string             `bson:"lot_id" json:"lot_id"`
+	Quantity    float64            `bson:"quantity" json:"quantity"`
+	AcquiredAt  time.Time          `bson:"acquired_at" json:"acquired_at"`
+	CostBasis   map[string]float64 `bson:"cost_basis" json:"cost_basis"`
+	HoldingDays int                `bson:"holding_days" json:"holding_days"`
+	LongTerm    bool               `bson:"long_term" json:"long_term"`
+}
+
+// IsValidCostBasisMethod kiểm tra phương pháp tính giá vốn có được hỗ trợ hay không
+func IsValidCostBasisMethod(method string) bool {
+	switch method {
+	case CostBasisFIFO, CostBasisLIFO, CostBasisHIFO, CostBasisAverage, CostBasisSpecific:
+		return true
+	}
+	return false
+}
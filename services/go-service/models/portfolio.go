@@ -1,16 +1,47 @@
 package models
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// DefaultPortfolioName là tên danh mục mặc định được tạo cho người dùng (và nhận các giao dịch cũ chưa gắn danh mục)
+const DefaultPortfolioName = "Main"
+
+// Portfolio là một danh mục (sổ) của người dùng. Mỗi người dùng có thể có nhiều danh mục;
+// mỗi giao dịch thuộc về đúng một danh mục qua Transaction.PortfolioID
 type Portfolio struct {
 	ID           primitive.ObjectID     `bson:"_id,omitempty" json:"_id,omitempty"`
 	UserID       primitive.ObjectID     `bson:"user_id" json:"user_id"`
-	CoinHoldings map[string]CoinHolding `bson:"coin_holdings" json:"coin_holdings"` // Chứa các thông tin về coin đang giữ
+	Name         string                 `bson:"name" json:"name"`
+	Archived     bool                   `bson:"archived,omitempty" json:"archived"` // Danh mục đã lưu trữ: không nhận giao dịch mới và không nằm trong chế độ xem tổng hợp
+	ArchivedAt   time.Time              `bson:"archived_at,omitempty" json:"archived_at,omitempty"`
+	CreatedAt    time.Time              `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	IsDefault    bool                   `bson:"-" json:"is_default"`                // Danh mục mặc định của người dùng (User.PortfolioID), chỉ dùng khi trả về
+	CoinHoldings map[string]CoinHolding `bson:"coin_holdings" json:"coin_holdings"` // Chứa các thông tin về coin đang giữ, tổng hợp từ mọi tài khoản
+	// AccountHoldings là holding theo từng tài khoản (key là ID hex của tài khoản hoặc UnassignedAccount).
+	// Các lô được trừ trong tài khoản của giao dịch; CoinHoldings được tính lại từ đây
+	AccountHoldings map[string]map[string]CoinHolding `bson:"account_holdings,omitempty" json:"account_holdings,omitempty"`
+	// RealizedPL là lời/lỗ đã thực hiện cộng dồn theo coin, mỗi coin là map theo tiền tệ.
+	// Được giữ lại cả khi coin đã bán hết khỏi CoinHoldings
+	RealizedPL map[string]map[string]float64 `bson:"realized_pl,omitempty" json:"realized_pl,omitempty"`
+	// Income là thu nhập (staking, airdrop, mining, interest) cộng dồn theo coin và tiền tệ
+	Income map[string]map[string]float64 `bson:"income,omitempty" json:"income,omitempty"`
+	// Version tăng sau mỗi lần ghi, dùng để phát hiện hai yêu cầu cùng sửa danh mục
+	Version int64 `bson:"version" json:"version"`
+}
+
+// PortfolioPatch chứa các trường người dùng được phép sửa của một danh mục; trường nil được giữ nguyên
+type PortfolioPatch struct {
+	Name     *string `json:"name"`
+	Archived *bool   `json:"archived"`
+	Default  *bool   `json:"default"` // true để chọn danh mục làm mặc định cho giao dịch không chỉ định danh mục
 }
 
 type CoinHolding struct {
-	Quantity    float64 `bson:"quantity" json:"quantity"`
-	AvgBuyPrice float64 `bson:"avg_buy_price" json:"avg_buy_price"`
+	Quantity    float64            `bson:"quantity" json:"quantity"`
+	AvgBuyPrice float64            `bson:"avg_buy_price" json:"avg_buy_price"`               // Giá mua trung bình theo USD
+	CostBasis   map[string]float64 `bson:"cost_basis,omitempty" json:"cost_basis,omitempty"` // Tổng giá vốn của số lượng đang giữ theo từng tiền tệ, tính bằng tỷ giá lúc mua
+	Lots        []Lot              `bson:"lots,omitempty" json:"lots,omitempty"`             // Các lô mua còn số lượng
 }
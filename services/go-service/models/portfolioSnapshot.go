@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PortfolioSnapshot là giá trị của một danh mục vào cuối một ngày theo giá đóng cửa, lưu trong collection
+// portfolio_snapshots để biểu đồ giá trị không phải lấy lại giá lịch sử của từng coin mỗi lần vẽ
+type PortfolioSnapshot struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"user_id"`
+	PortfolioID   primitive.ObjectID `bson:"portfolio_id" json:"portfolio_id"`
+	Date          time.Time          `bson:"date" json:"date"`                                         // Ngày của snapshot (00:00 UTC)
+	Holdings      map[string]float64 `bson:"holdings" json:"holdings"`                                 // Số lượng từng coin cuối ngày
+	Prices        map[string]float64 `bson:"prices" json:"prices"`                                     // Giá đóng cửa USD của từng coin
+	ValueUSD      float64            `bson:"value_usd" json:"value_usd"`                               // Tổng giá trị theo giá đóng cửa
+	CostBasisUSD  float64            `bson:"cost_basis_usd" json:"cost_basis_usd"`                     // Tổng giá vốn của các coin còn giữ
+	MissingPrices []string           `bson:"missing_prices,omitempty" json:"missing_prices,omitempty"` // Coin không có giá, không được tính vào ValueUSD
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	Pending       bool               `bson:"-" json:"-"` // Chưa được định giá trong request hiện tại, không được lưu
+}
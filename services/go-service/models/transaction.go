@@ -1,18 +1,18 @@
 package models
 
 import (
-	"context"
-	"crypto-folio/configs"
-	"errors"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type Transaction struct {
 	ID              primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
 	UserID          primitive.ObjectID `bson:"user_id" json:"user_id"`
+	PortfolioID     primitive.ObjectID `bson:"portfolio_id,omitempty" json:"portfolio_id,omitempty"`   // Danh mục chứa giao dịch; để trống khi tạo thì dùng danh mục mặc định
+	AccountID       primitive.ObjectID `bson:"account_id,omitempty" json:"account_id,omitempty"`       // Tài khoản (sàn, ví) nơi giao dịch diễn ra; để trống là chưa gắn tài khoản
+	ToAccountID     primitive.ObjectID `bson:"to_account_id,omitempty" json:"to_account_id,omitempty"` // Tài khoản nhận coin khi chuyển nội bộ (transfer)
 	Coin            string             `bson:"coin" json:"coin"`
 	TransactionType string             `bson:"transaction_type" json:"transaction_type"`
 	Amount          float64            `bson:"amount" json:"amount"`
@@ -21,43 +21,245 @@ type Transaction struct {
 	Date            time.Time          `bson:"date" json:"date"`
 	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
 	Status          string             `bson:"status" json:"status"`
+	QuoteCurrency   string             `bson:"quote_currency,omitempty" json:"quote_currency,omitempty"` // Đồng tiền định giá của Price (USDT, USD, JPY, BTC...)
+	FXRates         map[string]float64 `bson:"fx_rates,omitempty" json:"fx_rates,omitempty"`             // Giá trị của 1 đơn vị QuoteCurrency theo từng tiền tệ tại thời điểm giao dịch
+	LotIDs          []string           `bson:"lot_ids,omitempty" json:"lot_ids,omitempty"`               // Lô được chỉ định khi bán theo phương pháp specific
+	CostBasisMethod string             `bson:"cost_basis_method,omitempty" json:"cost_basis_method,omitempty"`
+	ConsumedLots    []LotConsumption   `bson:"consumed_lots,omitempty" json:"consumed_lots,omitempty"` // Các lô đã bị trừ khi bán
+	Proceeds        map[string]float64 `bson:"proceeds,omitempty" json:"proceeds,omitempty"`           // Tiền thu về khi bán theo từng tiền tệ
+	RealizedPL      map[string]float64 `bson:"realized_pl,omitempty" json:"realized_pl,omitempty"`     // Lời/lỗ đã thực hiện = tiền thu về - giá vốn các lô đã trừ
+	FeeAmount       float64            `bson:"fee_amount,omitempty" json:"fee_amount,omitempty"`       // Số lượng phí giao dịch theo FeeCurrency
+	FeeCurrency     string             `bson:"fee_currency,omitempty" json:"fee_currency,omitempty"`   // Đồng tiền trả phí: đồng định giá, chính coin giao dịch hoặc tài sản khác (BNB...)
+	FeeRates        map[string]float64 `bson:"fee_rates,omitempty" json:"fee_rates,omitempty"`         // Giá trị của 1 đơn vị FeeCurrency theo từng tiền tệ khi phí trả bằng tài sản khác
+	FeeValue        map[string]float64 `bson:"fee_value,omitempty" json:"fee_value,omitempty"`         // Giá trị phí theo từng tiền tệ tại thời điểm giao dịch
+	FeeLots         []LotConsumption   `bson:"fee_lots,omitempty" json:"fee_lots,omitempty"`           // Các lô của coin trả phí đã bị trừ
+	AcquiredAt      time.Time          `bson:"acquired_at,omitempty" json:"acquired_at,omitempty"`     // Ngày mua ban đầu của coin nạp vào, giữ thời gian nắm giữ khi deposit
+	ToCoin          string             `bson:"to_coin,omitempty" json:"to_coin,omitempty"`             // Coin nhận về khi swap
+	ToAmount        float64            `bson:"to_amount,omitempty" json:"to_amount,omitempty"`         // Số lượng coin nhận về khi swap
+	Income          map[string]float64 `bson:"income,omitempty" json:"income,omitempty"`               // Thu nhập theo giá thị trường lúc nhận (staking, airdrop, mining, interest)
+	VoidedAt        time.Time          `bson:"voided_at,omitempty" json:"voided_at,omitempty"`         // Thời điểm giao dịch bị hủy (void) hoặc xóa
+	VoidReason      string             `bson:"void_reason,omitempty" json:"void_reason,omitempty"`
+	Source          string             `bson:"source,omitempty" json:"source,omitempty"`           // Nguồn của giao dịch được import (binance, coinbase, kraken, bitflyer)
+	ExternalID      string             `bson:"external_id,omitempty" json:"external_id,omitempty"` // ID giao dịch phía sàn, dùng để phát hiện import trùng
 }
 
-// UpdateTransaction cập nhật thông tin giao dịch theo ID
-func UpdateTransaction(id string, updatedTransaction *Transaction) error {
-	// Chuyển đổi ID từ chuỗi thành ObjectID
-	objectID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		return errors.New("invalid transaction ID")
+// Các trạng thái của giao dịch. Chỉ giao dịch completed được tính vào danh mục,
+// giao dịch void và deleted vẫn được giữ lại để đối chiếu
+const (
+	StatusCompleted = "completed"
+	StatusVoid      = "void"    // Bị hủy nhưng vẫn hiển thị trong lịch sử giao dịch
+	StatusDeleted   = "deleted" // Bị xóa khỏi lịch sử giao dịch, bản ghi chỉ còn để đối chiếu
+)
+
+// Các loại giao dịch được hỗ trợ
+const (
+	TransactionBuy        = "buy"
+	TransactionSell       = "sell"
+	TransactionDeposit    = "deposit"    // Nạp coin từ bên ngoài, Price là giá vốn ban đầu trên một đơn vị
+	TransactionWithdrawal = "withdrawal" // Rút coin ra bên ngoài, không phát sinh lời/lỗ
+	TransactionTransfer   = "transfer"   // Chuyển nội bộ giữa các ví/sàn của người dùng, giữ nguyên giá vốn
+	TransactionSwap       = "swap"       // Đổi Amount của Coin lấy ToAmount của ToCoin trong một giao dịch
+	TransactionStaking    = "staking"    // Phần thưởng staking
+	TransactionAirdrop    = "airdrop"    // Coin nhận được từ airdrop
+	TransactionMining     = "mining"     // Coin nhận được từ đào coin
+	TransactionInterest   = "interest"   // Lãi từ các sản phẩm Earn/cho vay
+)
+
+// IncomeTransactionTypes là các loại giao dịch thu nhập, Price là giá thị trường lúc nhận
+var IncomeTransactionTypes = []string{TransactionStaking, TransactionAirdrop, TransactionMining, TransactionInterest}
+
+// IsIncomeType kiểm tra loại giao dịch có phải là thu nhập hay không
+func IsIncomeType(transactionType string) bool {
+	switch transactionType {
+	case TransactionStaking, TransactionAirdrop, TransactionMining, TransactionInterest:
+		return true
+	}
+	return false
+}
+
+// IsValidTransactionType kiểm tra loại giao dịch có được hỗ trợ hay không
+func IsValidTransactionType(transactionType string) bool {
+	switch transactionType {
+	case TransactionBuy, TransactionSell, TransactionDeposit, TransactionWithdrawal, TransactionTransfer, TransactionSwap:
+		return true
+	}
+	return IsIncomeType(transactionType)
+}
+
+// DefaultQuoteCurrency là đồng tiền định giá của các giao dịch không ghi rõ (giá lấy theo cặp USDT)
+const DefaultQuoteCurrency = "USDT"
+
+// GetQuoteCurrency trả về đồng tiền định giá của giao dịch, mặc định là USDT
+func (t *Transaction) GetQuoteCurrency() string {
+	if t.QuoteCurrency == "" {
+		return DefaultQuoteCurrency
+	}
+	return t.QuoteCurrency
+}
+
+// RateTo trả về giá trị của 1 đơn vị đồng tiền định giá theo currency tại thời điểm giao dịch.
+// Giao dịch cũ không có fx_rates được coi là định giá bằng USDT tương đương USD
+func (t *Transaction) RateTo(currency string) (float64, bool) {
+	if rate, ok := t.FXRates[currency]; ok {
+		return rate, true
+	}
+	if currency == t.GetQuoteCurrency() {
+		return 1, true
+	}
+	if currency == "USD" && len(t.FXRates) == 0 {
+		return 1, true
+	}
+	return 0, false
+}
+
+// PriceIn trả về giá giao dịch quy đổi sang currency theo tỷ giá tại thời điểm giao dịch
+func (t *Transaction) PriceIn(currency string) (float64, bool) {
+	rate, ok := t.RateTo(currency)
+	return t.Price * rate, ok
+}
+
+// CostIn trả về tổng giá trị giao dịch (Amount * Price) theo từng tiền tệ có tỷ giá
+func (t *Transaction) CostIn() map[string]float64 {
+	costs := map[string]float64{}
+	if usdPrice, ok := t.PriceIn("USD"); ok {
+		costs["USD"] = t.Amount * usdPrice
+	}
+	for currency, rate := range t.FXRates {
+		costs[currency] = t.Amount * t.Price * rate
+	}
+	return costs
+}
+
+// GetFeeCurrency trả về đồng tiền trả phí, mặc định là đồng tiền định giá
+func (t *Transaction) GetFeeCurrency() string {
+	if t.FeeCurrency == "" {
+		return t.GetQuoteCurrency()
 	}
+	return t.FeeCurrency
+}
+
+// FeeInCoin cho biết phí được trả bằng chính coin giao dịch
+func (t *Transaction) FeeInCoin() bool {
+	return t.FeeAmount > 0 && strings.EqualFold(t.GetFeeCurrency(), t.Coin)
+}
 
-	// Thiết lập context với thời gian chờ
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// FeeInToCoin cho biết phí swap được trả bằng coin nhận về
+func (t *Transaction) FeeInToCoin() bool {
+	return t.FeeAmount > 0 && t.TransactionType == TransactionSwap && strings.EqualFold(t.GetFeeCurrency(), t.ToCoin)
+}
 
-	// Truy cập vào collection
-	collection := configs.DB.Database("crypto-app").Collection("transactions")
+// TransactionPatch chứa các trường người dùng được phép sửa của một giao dịch.
+// Trường nil được giữ nguyên; user_id, portfolio_id, created_at, status và các trường suy ra không thể sửa
+type TransactionPatch struct {
+	Coin            *string             `json:"coin"`
+	TransactionType *string             `json:"transaction_type"`
+	Amount          *float64            `json:"amount"`
+	Price           *float64            `json:"price"`
+	Value           *float64            `json:"value"`
+	Date            *time.Time          `json:"date"`
+	QuoteCurrency   *string             `json:"quote_currency"`
+	FeeAmount       *float64            `json:"fee_amount"`
+	FeeCurrency     *string             `json:"fee_currency"`
+	LotIDs          *[]string           `json:"lot_ids"`
+	AcquiredAt      *time.Time          `json:"acquired_at"`
+	ToCoin          *string             `json:"to_coin"`
+	ToAmount        *float64            `json:"to_amount"`
+	AccountID       *primitive.ObjectID `json:"account_id"` // Chuỗi rỗng để bỏ gắn tài khoản
+	ToAccountID     *primitive.ObjectID `json:"to_account_id"`
+}
+
+// Apply ghi các trường có giá trị của patch vào transaction và cho biết có cần lấy lại tỷ giá
+// hay không (khi loại giao dịch, ngày giao dịch, đồng tiền định giá, coin hoặc đồng tiền trả phí thay đổi).
+// Swap được đổi sang loại khác sẽ bỏ coin nhận về và đồng tiền định giá suy ra từ coin đó
+func (p *TransactionPatch) Apply(t *Transaction) bool {
+	refreshRates := false
+	if p.Coin != nil && *p.Coin != t.Coin {
+		t.Coin, refreshRates = *p.Coin, true
+	}
+	if p.TransactionType != nil && *p.TransactionType != t.TransactionType {
+		if t.TransactionType == TransactionSwap {
+			t.ToCoin, t.ToAmount, t.QuoteCurrency = "", 0, ""
+		}
+		t.TransactionType, refreshRates = *p.TransactionType, true
+	}
+	if p.Amount != nil {
+		t.Amount = *p.Amount
+	}
+	if p.Price != nil {
+		t.Price = *p.Price
+	}
+	if p.Value != nil {
+		t.Value = *p.Value
+	}
+	if p.Date != nil && !p.Date.Equal(t.Date) {
+		t.Date, refreshRates = *p.Date, true
+	}
+	if p.QuoteCurrency != nil && *p.QuoteCurrency != t.QuoteCurrency {
+		t.QuoteCurrency, refreshRates = *p.QuoteCurrency, true
+	}
+	if p.FeeAmount != nil {
+		t.FeeAmount = *p.FeeAmount
+	}
+	if p.FeeCurrency != nil && *p.FeeCurrency != t.FeeCurrency {
+		t.FeeCurrency, refreshRates = *p.FeeCurrency, true
+	}
+	if p.LotIDs != nil {
+		t.LotIDs = *p.LotIDs
+	}
+	if p.AcquiredAt != nil {
+		t.AcquiredAt = *p.AcquiredAt
+	}
+	if p.ToCoin != nil && *p.ToCoin != t.ToCoin {
+		t.ToCoin, refreshRates = *p.ToCoin, true
+	}
+	if p.ToAmount != nil {
+		t.ToAmount = *p.ToAmount
+	}
+	if p.AccountID != nil {
+		t.AccountID = *p.AccountID
+	}
+	if p.ToAccountID != nil {
+		t.ToAccountID = *p.ToAccountID
+	}
+	return refreshRates
+}
 
-	// Tạo filter và cập nhật cho MongoDB
-	filter := bson.M{"_id": objectID}
-	update := bson.M{
-		"$set": bson.M{
-			"user_id":          updatedTransaction.UserID,
-			"coin":             updatedTransaction.Coin,
-			"transaction_type": updatedTransaction.TransactionType,
-			"amount":           updatedTransaction.Amount,
-			"price":            updatedTransaction.Price,
-			"value":            updatedTransaction.Value,
-			"date":             updatedTransaction.Date,
-			"status":           updatedTransaction.Status,
-			"created_at":       updatedTransaction.CreatedAt,
-		},
+// ChangesValue cho biết patch làm thay đổi giá trị JPY (Value) của giao dịch mà không tự đặt Value,
+// khi đó Value cần được tính lại sau khi có tỷ giá mới
+func (p *TransactionPatch) ChangesValue() bool {
+	if p.Value != nil {
+		return false
 	}
+	return p.Amount != nil || p.Price != nil || p.QuoteCurrency != nil || p.Date != nil ||
+		p.TransactionType != nil || p.ToCoin != nil || p.ToAmount != nil
+}
 
-	// Thực hiện cập nhật trong MongoDB
-	_, err = collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		return errors.New("could not update transaction")
+// FeeInQuote cho biết phí được trả bằng đồng tiền định giá
+func (t *Transaction) FeeInQuote() bool {
+	return t.GetFeeCurrency() == t.GetQuoteCurrency()
+}
+
+// FeeIn trả về giá trị phí theo từng tiền tệ có tỷ giá tại thời điểm giao dịch
+func (t *Transaction) FeeIn() map[string]float64 {
+	fees := map[string]float64{}
+	if t.FeeAmount <= 0 {
+		return fees
+	}
+	switch {
+	case t.FeeInQuote():
+		for currency := range t.CostIn() {
+			rate, _ := t.RateTo(currency)
+			fees[currency] = t.FeeAmount * rate
+		}
+	case t.FeeInCoin():
+		for currency := range t.CostIn() {
+			price, _ := t.PriceIn(currency)
+			fees[currency] = t.FeeAmount * price
+		}
+	default:
+		for currency, rate := range t.FeeRates {
+			fees[currency] = t.FeeAmount * rate
+		}
 	}
-	return nil
+	return fees
 }
@@ -6,12 +6,61 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// DefaultBaseCurrency là tiền tệ cơ sở khi người dùng chưa chọn
+const DefaultBaseCurrency = "USD"
+
+// DefaultDisplayCurrencies là các tiền tệ hiển thị mặc định trên dashboard
+var DefaultDisplayCurrencies = []string{"USD", "JPY"}
+
 type User struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	Email       string             `bson:"email" json:"email"`
-	Password    string             `bson:"password" json:"password"`
-	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
-	PortfolioID primitive.ObjectID `bson:"portfolio_id,omitempty" json:"portfolio_id,omitempty"`
-	Watchlist   []string           `bson:"watchlist,omitempty" json:"watchlist,omitempty"`
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Email             string             `bson:"email" json:"email"`
+	Password          string             `bson:"password" json:"password"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+	PortfolioID       primitive.ObjectID `bson:"portfolio_id,omitempty" json:"portfolio_id,omitempty"`
+	Watchlist         []string           `bson:"watchlist,omitempty" json:"watchlist,omitempty"`
+	BaseCurrency      string             `bson:"base_currency,omitempty" json:"base_currency,omitempty"`           // Tiền tệ cơ sở dùng để tính lời/lỗ chính
+	DisplayCurrencies []string           `bson:"display_currencies,omitempty" json:"display_currencies,omitempty"` // Các tiền tệ hiển thị thêm trên dashboard
+	CostBasisMethod   string             `bson:"cost_basis_method,omitempty" json:"cost_basis_method,omitempty"`   // fifo, lifo, hifo, average hoặc specific
+	IsAdmin           bool               `bson:"is_admin,omitempty" json:"-"`                                      // Quyền quản trị, chỉ được gán trực tiếp trong cơ sở dữ liệu
+}
+
+// GetCostBasisMethod trả về phương pháp tính giá vốn của người dùng, mặc định là FIFO
+func (u *User) GetCostBasisMethod() string {
+	if u.CostBasisMethod == "" {
+		return DefaultCostBasisMethod
+	}
+	return u.CostBasisMethod
+}
+
+// GetBaseCurrency trả về tiền tệ cơ sở của người dùng, mặc định là USD
+func (u *User) GetBaseCurrency() string {
+	if u.BaseCurrency == "" {
+		return DefaultBaseCurrency
+	}
+	return u.BaseCurrency
+}
+
+// GetDisplayCurrencies trả về danh sách tiền tệ hiển thị, luôn bắt đầu bằng tiền tệ cơ sở
+func (u *User) GetDisplayCurrencies() []string {
+	display := u.DisplayCurrencies
+	if len(display) == 0 {
+		display = DefaultDisplayCurrencies
+	}
+
+	currencies := []string{u.GetBaseCurrency()}
+	for _, currency := range display {
+		duplicate := false
+		for _, existing := range currencies {
+			if existing == currency {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			currencies = append(currencies, currency)
+		}
+	}
+	return currencies
 }
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"crypto-folio/controllers"
+
+	"github.com/gorilla/mux"
+)
+
+func AdminRoutes(router *mux.Router) {
+	router.HandleFunc("/admin/portfolios/consistency", controllers.CheckAllPortfolios).Methods("GET")
+	router.HandleFunc("/admin/portfolios/{userId}/consistency", controllers.CheckPortfolioConsistency).Methods("GET")
+	router.HandleFunc("/admin/portfolios/{userId}/rebuild", controllers.RebuildPortfolio).Methods("POST")
+	router.HandleFunc("/admin/price-providers/health", controllers.GetPriceProvidersHealth).Methods("GET")
+}
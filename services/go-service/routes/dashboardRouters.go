@@ -9,5 +9,7 @@ import (
 func DashboardRoutes(router *mux.Router) {
 	router.HandleFunc("/watchlist", controllers.GetWatchlist).Methods("GET")
 	router.HandleFunc("/watchlist", controllers.UpdateWatchlist).Methods("POST")
+	router.HandleFunc("/currency-settings", controllers.GetCurrencySettings).Methods("GET")
+	router.HandleFunc("/currency-settings", controllers.UpdateCurrencySettings).Methods("PUT")
 
 }
@@ -9,4 +9,17 @@ import (
 func PortfolioRoutes(router *mux.Router) {
 	router.HandleFunc("/portfolio", controllers.GetPortfolio).Methods("GET")
 	router.HandleFunc("/dashboard", controllers.GetPortfolioData).Methods("GET")
+	router.HandleFunc("/portfolio/history", controllers.GetPortfolioHistory).Methods("GET")
+	router.HandleFunc("/portfolios", controllers.GetPortfolios).Methods("GET")
+	router.HandleFunc("/portfolios", controllers.CreatePortfolio).Methods("POST")
+	router.HandleFunc("/portfolios/{id}", controllers.UpdatePortfolio).Methods("PATCH")
+	router.HandleFunc("/portfolios/{id}", controllers.DeletePortfolio).Methods("DELETE")
+	router.HandleFunc("/portfolios/{id}/accounts", controllers.GetAccounts).Methods("GET")
+	router.HandleFunc("/portfolios/{id}/accounts", controllers.CreateAccount).Methods("POST")
+	router.HandleFunc("/accounts/{id}", controllers.UpdateAccount).Methods("PATCH")
+	router.HandleFunc("/accounts/{id}", controllers.DeleteAccount).Methods("DELETE")
+	router.HandleFunc("/lots", controllers.GetLots).Methods("GET")
+	router.HandleFunc("/income", controllers.GetIncome).Methods("GET")
+	router.HandleFunc("/cost-basis-method", controllers.GetCostBasisMethod).Methods("GET")
+	router.HandleFunc("/cost-basis-method", controllers.UpdateCostBasisMethod).Methods("PUT")
 }
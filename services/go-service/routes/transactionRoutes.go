@@ -8,6 +8,17 @@ import (
 
 func TransactionRoutes(router *mux.Router) {
 	router.HandleFunc("/transactions", controllers.GetTransactions).Methods("GET")
-	router.HandleFunc("/add-transaction", controllers.AddTransaction).Methods("POST")
+	router.HandleFunc("/transactions/export", controllers.ExportTransactions).Methods("GET")
+	router.HandleFunc("/add-transaction", controllers.WithIdempotencyKey(controllers.AddTransaction)).Methods("POST")
 	router.HandleFunc("/update-transaction/{id}", controllers.UpdateTransaction).Methods("PUT")
+	router.HandleFunc("/transactions/{id}", controllers.PatchTransaction).Methods("PATCH")
+	router.HandleFunc("/transactions/{id}", controllers.DeleteTransaction).Methods("DELETE")
+	router.HandleFunc("/transactions/{id}/void", controllers.VoidTransaction).Methods("POST")
+	// /import/custom được đăng ký trước để không bị khớp với /import/{exchange}
+	router.HandleFunc("/import/custom", controllers.WithIdempotencyKey(controllers.ImportWithTemplate)).Methods("POST")
+	router.HandleFunc("/import/{exchange}", controllers.WithIdempotencyKey(controllers.ImportTransactions)).Methods("POST")
+	router.HandleFunc("/import-templates", controllers.GetImportTemplates).Methods("GET")
+	router.HandleFunc("/import-templates", controllers.CreateImportTemplate).Methods("POST")
+	router.HandleFunc("/import-templates/{id}", controllers.UpdateImportTemplate).Methods("PUT")
+	router.HandleFunc("/import-templates/{id}", controllers.DeleteImportTemplate).Methods("DELETE")
 }
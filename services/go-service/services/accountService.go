@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Giới hạn độ dài (ký tự) của tên và địa chỉ tài khoản
+const (
+	maxAccountNameLength    = 50
+	maxAccountAddressLength = 200
+)
+
+// accountNotFound trả về lỗi khi tài khoản không tồn tại, không thuộc về người dùng hoặc khác danh mục
+func accountNotFound() error {
+	return &CustomError{Code: "ACCOUNT_NOT_FOUND", Message: "Account not found in this portfolio."}
+}
+
+// validateAccount chuẩn hóa và kiểm tra tên, loại và địa chỉ của tài khoản
+func validateAccount(account *models.Account) error {
+	account.Name = strings.TrimSpace(account.Name)
+	if account.Name == "" || utf8.RuneCountInString(account.Name) > maxAccountNameLength {
+		return &CustomError{Code: "INVALID_ACCOUNT", Message: fmt.Sprintf("The account name must be 1 to %d characters.", maxAccountNameLength)}
+	}
+	account.Type = strings.ToLower(strings.TrimSpace(account.Type))
+	if account.Type == "" {
+		account.Type = models.AccountOther
+	}
+	if !models.IsValidAccountType(account.Type) {
+		return &CustomError{Code: "INVALID_ACCOUNT", Message: fmt.Sprintf("Account type %q is not supported.", account.Type)}
+	}
+	account.Address = strings.TrimSpace(account.Address)
+	if utf8.RuneCountInString(account.Address) > maxAccountAddressLength {
+		return &CustomError{Code: "INVALID_ACCOUNT", Message: fmt.Sprintf("The account address must be at most %d characters.", maxAccountAddressLength)}
+	}
+	return nil
+}
+
+// accountWriteError chuyển lỗi trùng tên (index unique portfolio_id + name) thành CustomError
+func accountWriteError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return &CustomError{Code: "ACCOUNT_EXISTS", Message: "An account with this name already exists in the portfolio."}
+	}
+	return fmt.Errorf("error saving account: %v", err)
+}
+
+// findUserAccount lấy tài khoản accountID của người dùng
+func findUserAccount(ctx context.Context, userID, accountID primitive.ObjectID) (*models.Account, error) {
+	var account models.Account
+	err := configs.GetCollection("accounts").FindOne(ctx, bson.M{"_id": accountID, "user_id": userID}).Decode(&account)
+	if err == mongo.ErrNoDocuments {
+		return nil, accountNotFound()
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching account: %v", err)
+	}
+	return &account, nil
+}
+
+// checkTransactionAccounts kiểm tra tài khoản nguồn và tài khoản nhận của giao dịch thuộc cùng danh mục với giao dịch
+func checkTransactionAccounts(ctx context.Context, userID primitive.ObjectID, transaction *models.Transaction) error {
+	for _, accountID := range []primitive.ObjectID{transaction.AccountID, transaction.ToAccountID} {
+		if accountID.IsZero() {
+			continue
+		}
+		account, err := findUserAccount(ctx, userID, accountID)
+		if err != nil {
+			return err
+		}
+		if account.PortfolioID != transaction.PortfolioID {
+			return accountNotFound()
+		}
+	}
+	return nil
+}
+
+// checkAccounts kiểm tra tài khoản của giao dịch với context riêng, dùng trước khi ghi danh mục
+func checkAccounts(userID primitive.ObjectID, transaction *models.Transaction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return checkTransactionAccounts(ctx, userID, transaction)
+}
+
+// ListAccounts trả về các tài khoản thuộc các danh mục portfolioIDs của người dùng, sắp xếp theo tên
+func ListAccounts(userID primitive.ObjectID, portfolioIDs []primitive.ObjectID) ([]models.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "portfolio_id": bson.M{"$in": portfolioIDs}}
+	cursor, err := configs.GetCollection("accounts").Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching accounts: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	accounts := []models.Account{}
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, fmt.Errorf("error decoding accounts: %v", err)
+	}
+	return accounts, nil
+}
+
+// ListPortfolioAccounts trả về các tài khoản của danh mục {id}, hoặc của mọi danh mục khi id là "all"
+func ListPortfolioAccounts(userID primitive.ObjectID, id string) ([]models.Account, error) {
+	if id != AllPortfolios {
+		portfolio, err := FindUserPortfolio(userID, id)
+		if err != nil {
+			return nil, err
+		}
+		return ListAccounts(userID, []primitive.ObjectID{portfolio.ID})
+	}
+	portfolios, err := ListPortfolios(userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(portfolios))
+	for _, portfolio := range portfolios {
+		ids = append(ids, portfolio.ID)
+	}
+	return ListAccounts(userID, ids)
+}
+
+// CreateAccount tạo tài khoản mới trong danh mục portfolioID của người dùng
+func CreateAccount(userID primitive.ObjectID, portfolioID string, account *models.Account) error {
+	portfolio, err := FindUserPortfolio(userID, portfolioID)
+	if err != nil {
+		return err
+	}
+	if err := validateAccount(account); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	account.ID = primitive.NewObjectID()
+	account.UserID = userID
+	account.PortfolioID = portfolio.ID
+	account.CreatedAt = time.Now()
+	if _, err := configs.GetCollection("accounts").InsertOne(ctx, account); err != nil {
+		return accountWriteError(err)
+	}
+	return nil
+}
+
+// UpdateAccount đổi tên, loại hoặc địa chỉ của tài khoản {id}
+func UpdateAccount(userID primitive.ObjectID, id string, patch *models.AccountPatch) (*models.Account, error) {
+	accountID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, accountNotFound()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	account, err := findUserAccount(ctx, userID, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Name != nil {
+		account.Name = *patch.Name
+	}
+	if patch.Type != nil {
+		account.Type = *patch.Type
+	}
+	if patch.Address != nil {
+		account.Address = *patch.Address
+	}
+	if err := validateAccount(account); err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$set": bson.M{"name": account.Name, "type": account.Type, "address": account.Address}}
+	if _, err := configs.GetCollection("accounts").UpdateOne(ctx, bson.M{"_id": account.ID, "user_id": userID}, update); err != nil {
+		return nil, accountWriteError(err)
+	}
+	return account, nil
+}
+
+// DeleteAccount xóa tài khoản {id} khi không còn giao dịch nào (trừ giao dịch đã xóa) tham chiếu tới nó
+func DeleteAccount(userID primitive.ObjectID, id string) error {
+	accountID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return accountNotFound()
+	}
+
+	// Đếm và xóa trong cùng một transaction để không xóa mất tài khoản vừa được gắn vào giao dịch mới
+	return runInTransaction(func(ctx context.Context) error {
+		account, err := findUserAccount(ctx, userID, accountID)
+		if err != nil {
+			return err
+		}
+		filter := bson.M{
+			"user_id": userID,
+			"status":  bson.M{"$ne": models.StatusDeleted},
+			"$or":     bson.A{bson.M{"account_id": account.ID}, bson.M{"to_account_id": account.ID}},
+		}
+		count, err := configs.GetCollection("transactions").CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			return fmt.Errorf("error checking transactions: %v", err)
+		}
+		if count > 0 {
+			return &CustomError{Code: "ACCOUNT_IN_USE", Message: "The account is still used by transactions. Move or remove them first."}
+		}
+		if _, err := configs.GetCollection("accounts").DeleteOne(ctx, bson.M{"_id": account.ID, "user_id": userID}); err != nil {
+			return fmt.Errorf("error deleting account: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxLedgerWriteAttempts là số lần thử ghi danh mục và sổ giao dịch khi gặp xung đột ghi đồng thời
+const maxLedgerWriteAttempts = 3
+
+// ledgerRetryDelay là thời gian chờ cơ bản giữa hai lần thử, tăng dần theo số lần thử
+const ledgerRetryDelay = 50 * time.Millisecond
+
+// errPortfolioConflict báo danh mục đã bị một yêu cầu khác ghi sau khi được đọc
+var errPortfolioConflict = errors.New("portfolio was modified concurrently")
+
+// transactionsUnsupported được bật khi MongoDB không hỗ trợ multi-document transaction
+// (server standalone không phải replica set)
+var transactionsUnsupported atomic.Bool
+
+// ledgerUndoKey là khóa context chứa nhật ký hoàn tác của một lần ghi sổ giao dịch
+type ledgerUndoKey struct{}
+
+// ledgerUndo là danh sách thao tác hoàn tác các lần ghi sổ giao dịch khi không có transaction MongoDB
+type ledgerUndo struct {
+	steps []func(ctx context.Context) error
+}
+
+// updateLedger đọc danh mục portfolioID của người dùng, gọi change để áp dụng thay đổi và ghi giao dịch,
+// rồi lưu danh mục với kiểm tra version. Mọi thao tác chạy trong một transaction MongoDB khi
+// server hỗ trợ; nếu không, danh mục được lưu sau cùng và mọi thao tác ghi sổ giao dịch đã đăng ký
+// bằng registerLedgerUndo được hoàn tác khi lần thử thất bại, để lần thử lại (hoặc lỗi CONCURRENT_UPDATE
+// trả về cho người dùng) không để lại thay đổi nào. Xung đột version được thử lại với danh mục mới nhất
+func updateLedger(userID, portfolioID primitive.ObjectID, change func(ctx context.Context, portfolio *models.Portfolio) error) error {
+	var err error
+	for attempt := 1; attempt <= maxLedgerWriteAttempts; attempt++ {
+		var undo *ledgerUndo
+		err = runInTransaction(func(ctx context.Context) error {
+			undo = &ledgerUndo{}
+			ctx = context.WithValue(ctx, ledgerUndoKey{}, undo)
+			portfolio, err := loadPortfolio(ctx, userID, portfolioID)
+			if err != nil {
+				return err
+			}
+			if err := change(ctx, portfolio); err != nil {
+				return err
+			}
+			return savePortfolio(ctx, portfolio)
+		})
+		if err != nil && undo != nil {
+			undo.rollback()
+		}
+		if !errors.Is(err, errPortfolioConflict) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * ledgerRetryDelay)
+	}
+	return &CustomError{Code: "CONCURRENT_UPDATE", Message: "Your portfolio was updated by another request. Please try again."}
+}
+
+// registerLedgerUndo đăng ký thao tác hoàn tác một lần ghi sổ giao dịch vừa thực hiện. Chỉ có tác dụng
+// khi server không hỗ trợ transaction; trong transaction MongoDB mọi thay đổi tự hủy khi có lỗi
+func registerLedgerUndo(ctx context.Context, step func(ctx context.Context) error) {
+	if !transactionsUnsupported.Load() {
+		return
+	}
+	if undo, ok := ctx.Value(ledgerUndoKey{}).(*ledgerUndo); ok {
+		undo.steps = append(undo.steps, step)
+	}
+}
+
+// ledgerUndoActive cho biết các lần ghi sổ giao dịch trong ctx cần đăng ký thao tác hoàn tác
+func ledgerUndoActive(ctx context.Context) bool {
+	_, ok := ctx.Value(ledgerUndoKey{}).(*ledgerUndo)
+	return ok && transactionsUnsupported.Load()
+}
+
+// rollback chạy các thao tác hoàn tác theo thứ tự ngược. Lỗi chỉ được ghi log vì sổ giao dịch
+// vẫn có thể được sửa bằng RebuildPortfolio
+func (u *ledgerUndo) rollback() {
+	if len(u.steps) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := len(u.steps) - 1; i >= 0; i-- {
+		if err := u.steps[i](ctx); err != nil {
+			log.Printf("Warning: could not undo ledger write: %v", err)
+		}
+	}
+	u.steps = nil
+}
+
+// runInTransaction chạy fn trong một transaction MongoDB (driver tự thử lại lỗi tạm thời).
+// Khi server không hỗ trợ transaction, fn được chạy trực tiếp
+func runInTransaction(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+	defer cancel()
+
+	if transactionsUnsupported.Load() {
+		return fn(ctx)
+	}
+
+	session, err := configs.DB.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionCtx)
+	})
+	if err != nil && isTransactionUnsupported(err) {
+		log.Println("Warning: MongoDB does not support transactions, falling back to versioned writes")
+		transactionsUnsupported.Store(true)
+		return fn(ctx)
+	}
+	return err
+}
+
+// isTransactionUnsupported kiểm tra lỗi trả về khi dùng transaction trên MongoDB standalone
+func isTransactionUnsupported(err error) bool {
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == 20 {
+		return true
+	}
+	return strings.Contains(err.Error(), "Transaction numbers are only allowed")
+}
@@ -1 +1,42 @@
 package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetUser lấy thông tin người dùng theo ID
+func GetUser(userID primitive.ObjectID) (*models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := configs.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UpdateCostBasisMethod lưu phương pháp tính giá vốn mà người dùng chọn cho các lần bán sau
+func UpdateCostBasisMethod(userID primitive.ObjectID, method string) error {
+	if !models.IsValidCostBasisMethod(method) {
+		return &CustomError{Code: "INVALID_COST_BASIS_METHOD", Message: fmt.Sprintf("Cost basis method %s is not supported.", method)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"cost_basis_method": method, "updated_at": time.Now()}}
+	if _, err := configs.GetCollection("users").UpdateOne(ctx, bson.M{"_id": userID}, update); err != nil {
+		return fmt.Errorf("error updating cost basis method: %v", err)
+	}
+	return nil
+}
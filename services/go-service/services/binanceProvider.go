@@ -0,0 +1,143 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBinanceURL = "https://api.binance.com"
+	// binanceBatchSize là số cặp tối đa trong một request ticker nhiều symbol
+	binanceBatchSize = 100
+)
+
+// BinancePrice là cấu trúc để parse kết quả từ Binance API
+type BinancePrice struct {
+	Symbol string `json:"symbol"`
+	Price  string `json:"price"`
+}
+
+// BinanceProvider lấy giá coin từ cặp <coin>USDT trên Binance
+type BinanceProvider struct {
+	baseURL string
+	fiatURL string
+}
+
+// NewBinanceProvider tạo BinanceProvider, dùng URL mặc định nếu baseURL rỗng
+func NewBinanceProvider(baseURL, fiatURL string) *BinanceProvider {
+	if baseURL == "" {
+		baseURL = defaultBinanceURL
+	}
+	return &BinanceProvider{baseURL: strings.TrimRight(baseURL, "/"), fiatURL: fiatURL}
+}
+
+func (p *BinanceProvider) Name() string {
+	return "binance"
+}
+
+// GetPrice lấy giá của cặp <symbol>USDT từ Binance
+func (p *BinanceProvider) GetPrice(symbol string) (float64, error) {
+	var price BinancePrice
+	requestURL := fmt.Sprintf("%s/api/v3/ticker/price?symbol=%sUSDT", p.baseURL, normalizeSymbol(symbol))
+	if err := getJSON(requestURL, &price); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(price.Price, 64)
+}
+
+// GetPrices lấy giá của nhiều coin bằng endpoint ticker nhiều symbol của Binance,
+// chia thành từng lô để URL không quá dài. Nếu một lô bị từ chối (thường do có
+// cặp không tồn tại), các coin trong lô đó được lấy song song từng coin một
+func (p *BinanceProvider) GetPrices(symbols []string) (map[string]float64, error) {
+	symbols = uniqueSymbols(symbols)
+	prices := make(map[string]float64, len(symbols))
+
+	var firstErr error
+	for start := 0; start < len(symbols); start += binanceBatchSize {
+		end := start + binanceBatchSize
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		batch := symbols[start:end]
+
+		batchPrices, err := p.getBatchPrices(batch)
+		if err != nil {
+			batchPrices, err = fetchPricesConcurrently(batch, p.GetPrice)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		for symbol, price := range batchPrices {
+			prices[symbol] = price
+		}
+	}
+	return prices, firstErr
+}
+
+// getBatchPrices gọi /api/v3/ticker/price?symbols=[...] cho một lô coin
+func (p *BinanceProvider) getBatchPrices(symbols []string) (map[string]float64, error) {
+	pairs := make([]string, len(symbols))
+	for i, symbol := range symbols {
+		pairs[i] = symbol + "USDT"
+	}
+	encoded, err := json.Marshal(pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	var tickers []BinancePrice
+	requestURL := fmt.Sprintf("%s/api/v3/ticker/price?symbols=%s", p.baseURL, url.QueryEscape(string(encoded)))
+	if err := getJSON(requestURL, &tickers); err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string]float64, len(tickers))
+	for _, ticker := range tickers {
+		price, err := strconv.ParseFloat(ticker.Price, 64)
+		if err != nil {
+			return nil, err
+		}
+		prices[strings.TrimSuffix(ticker.Symbol, "USDT")] = price
+	}
+	for _, symbol := range symbols {
+		if _, ok := prices[symbol]; !ok {
+			return nil, fmt.Errorf("price not found for %s on binance", symbol)
+		}
+	}
+	return prices, nil
+}
+
+// GetFiatRate lấy tỷ giá tiền pháp định từ exchangerate-api vì Binance không cung cấp
+func (p *BinanceProvider) GetFiatRate(base, quote string) (float64, error) {
+	return fetchFiatRate(p.fiatURL, base, quote)
+}
+
+// GetHistoricalPrice lấy giá đóng cửa theo ngày (nến 1d) của cặp <symbol>USDT tại ngày date
+func (p *BinanceProvider) GetHistoricalPrice(symbol string, date time.Time) (float64, error) {
+	day := date.UTC().Truncate(24 * time.Hour)
+	requestURL := fmt.Sprintf("%s/api/v3/klines?symbol=%sUSDT&interval=1d&startTime=%d&limit=1",
+		p.baseURL, normalizeSymbol(symbol), day.UnixMilli())
+
+	// Mỗi nến là một mảng [openTime, open, high, low, close, ...]
+	var klines [][]interface{}
+	if err := getJSON(requestURL, &klines); err != nil {
+		return 0, err
+	}
+	// startTime trả về nến đầu tiên từ ngày day trở đi, nên ngày trước khi coin niêm yết sẽ nhận giá của một
+	// ngày sau đó; chỉ chấp nhận nến mở đúng vào ngày day
+	if len(klines) == 0 || len(klines[0]) < 5 {
+		return 0, fmt.Errorf("%w for %s on %s", errNoHistoricalPrice, symbol, day.Format("2006-01-02"))
+	}
+	if openTime, ok := klines[0][0].(float64); !ok || int64(openTime) != day.UnixMilli() {
+		return 0, fmt.Errorf("%w for %s on %s", errNoHistoricalPrice, symbol, day.Format("2006-01-02"))
+	}
+	closePrice, ok := klines[0][4].(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid kline format from binance")
+	}
+	return strconv.ParseFloat(closePrice, 64)
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Các trạng thái của circuit breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen được trả về khi nguồn giá đang bị ngắt tạm thời do lỗi liên tiếp
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker ngắt tạm thời một nguồn giá sau nhiều lần lỗi liên tiếp và
+// cho phép thử lại một request sau thời gian cooldown
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+
+	// Thông tin sức khỏe phục vụ cho việc theo dõi
+	totalRequests int
+	totalFailures int
+	lastSuccess   time.Time
+	lastFailure   time.Time
+	lastError     string
+}
+
+// ProviderHealth là ảnh chụp tình trạng của một nguồn giá
+type ProviderHealth struct {
+	Provider            string     `json:"provider"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	TotalRequests       int        `json:"totalRequests"`
+	TotalFailures       int        `json:"totalFailures"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+}
+
+// NewCircuitBreaker tạo breaker mở sau threshold lần lỗi liên tiếp, thử lại sau cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// Allow cho biết có được gửi request tới nguồn giá hay không. Khi hết cooldown,
+// breaker chuyển sang half-open và chỉ cho phép một request thử
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trialInFlight = true
+		return true
+	case BreakerHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// RecordSuccess ghi nhận request thành công và đóng breaker
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.totalRequests++
+	b.lastSuccess = time.Now()
+	b.consecutiveFailures = 0
+	b.trialInFlight = false
+	b.state = BreakerClosed
+}
+
+// RecordFailure ghi nhận request lỗi, mở breaker khi vượt ngưỡng hoặc khi request thử thất bại
+func (b *CircuitBreaker) RecordFailure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.totalRequests++
+	b.totalFailures++
+	b.consecutiveFailures++
+	b.lastFailure = time.Now()
+	if err != nil {
+		b.lastError = err.Error()
+	}
+
+	if b.state == BreakerHalfOpen || b.consecutiveFailures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+	b.trialInFlight = false
+}
+
+// Health trả về tình trạng hiện tại của breaker cho nguồn giá có tên provider
+func (b *CircuitBreaker) Health(provider string) ProviderHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := ProviderHealth{
+		Provider:            provider,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		TotalRequests:       b.totalRequests,
+		TotalFailures:       b.totalFailures,
+		LastError:           b.lastError,
+	}
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		health.State = BreakerHalfOpen
+	}
+	if !b.lastSuccess.IsZero() {
+		lastSuccess := b.lastSuccess
+		health.LastSuccess = &lastSuccess
+	}
+	if !b.lastFailure.IsZero() {
+		lastFailure := b.lastFailure
+		health.LastFailure = &lastFailure
+	}
+	return health
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCoinbaseURL = "https://api.coinbase.com"
+
+// CoinbaseProvider lấy giá spot và tỷ giá tiền pháp định từ Coinbase API v2
+type CoinbaseProvider struct {
+	baseURL string
+}
+
+// NewCoinbaseProvider tạo CoinbaseProvider, dùng URL mặc định nếu baseURL rỗng
+func NewCoinbaseProvider(baseURL string) *CoinbaseProvider {
+	if baseURL == "" {
+		baseURL = defaultCoinbaseURL
+	}
+	return &CoinbaseProvider{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (p *CoinbaseProvider) Name() string {
+	return "coinbase"
+}
+
+// GetPrice lấy giá spot của cặp <symbol>-USD từ Coinbase
+func (p *CoinbaseProvider) GetPrice(symbol string) (float64, error) {
+	var data struct {
+		Data struct {
+			Amount string `json:"amount"`
+		} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/v2/prices/%s-USD/spot", p.baseURL, normalizeSymbol(symbol))
+	if err := getJSON(url, &data); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(data.Data.Amount, 64)
+}
+
+// GetPrices lấy giá của nhiều coin song song vì Coinbase không có endpoint lấy theo lô
+func (p *CoinbaseProvider) GetPrices(symbols []string) (map[string]float64, error) {
+	return fetchPricesConcurrently(symbols, p.GetPrice)
+}
+
+// GetFiatRate lấy tỷ giá từ endpoint exchange-rates của Coinbase
+func (p *CoinbaseProvider) GetFiatRate(base, quote string) (float64, error) {
+	base, quote = normalizeSymbol(base), normalizeSymbol(quote)
+	if base == quote {
+		return 1, nil
+	}
+
+	var data struct {
+		Data struct {
+			Rates map[string]string `json:"rates"`
+		} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/v2/exchange-rates?currency=%s", p.baseURL, base)
+	if err := getJSON(url, &data); err != nil {
+		return 0, err
+	}
+
+	rate, ok := data.Data.Rates[quote]
+	if !ok {
+		return 0, errors.New(quote + " rate not found")
+	}
+	return strconv.ParseFloat(rate, 64)
+}
+
+// GetHistoricalPrice lấy giá spot của cặp <symbol>-USD tại ngày date từ Coinbase
+func (p *CoinbaseProvider) GetHistoricalPrice(symbol string, date time.Time) (float64, error) {
+	var data struct {
+		Data struct {
+			Amount string `json:"amount"`
+		} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/v2/prices/%s-USD/spot?date=%s", p.baseURL, normalizeSymbol(symbol), date.UTC().Format("2006-01-02"))
+	if err := getJSON(url, &data); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(data.Data.Amount, 64)
+}
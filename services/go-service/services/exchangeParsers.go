@@ -0,0 +1,525 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto-folio/models"
+)
+
+// errSkipRow đánh dấu dòng không cần import (giao dịch tiền pháp định, dòng tổng hợp...)
+var errSkipRow = errors.New("row skipped")
+
+// importRecord là một dòng của file export với tên cột đã được chuẩn hóa về chữ thường
+type importRecord map[string]string
+
+// get trả về giá trị của cột đầu tiên có trong dòng trong số các tên cột names
+func (r importRecord) get(names ...string) string {
+	for _, name := range names {
+		if value, ok := r[name]; ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// importFormat mô tả một định dạng file export: các cột bắt buộc để nhận diện header,
+// tên cột thay thế (ví dụ header tiếng Anh của bitFlyer) và hàm chuyển một dòng thành giao dịch
+type importFormat struct {
+	name     string
+	required []string
+	aliases  map[string]string
+	parse    func(record importRecord) (*models.Transaction, error)
+}
+
+// exchangeFormats là các định dạng file export được hỗ trợ theo từng sàn
+var exchangeFormats = map[string][]importFormat{
+	"binance": {
+		{name: "trade_history", required: []string{"date(utc)", "pair", "side", "executed", "amount", "fee"}, parse: parseBinanceTrade},
+		{name: "transaction_history", required: []string{"utc_time", "operation", "coin", "change"}, parse: parseBinanceStatement},
+	},
+	"coinbase": {
+		{
+			name:     "transaction_history",
+			required: []string{"timestamp", "transaction type", "asset", "quantity transacted"},
+			aliases: map[string]string{
+				"price currency":       "spot price currency",
+				"price at transaction": "spot price at transaction",
+			},
+			parse: parseCoinbase,
+		},
+	},
+	"kraken": {
+		{name: "trades", required: []string{"txid", "pair", "time", "type", "price", "fee", "vol"}, parse: parseKrakenTrade},
+		{name: "ledgers", required: []string{"txid", "time", "type", "asset", "amount", "fee"}, parse: parseKrakenLedger},
+	},
+	"bitflyer": {
+		{
+			name:     "trade_history",
+			required: []string{"取引日時", "取引種別", "通貨1", "通貨1数量"},
+			aliases: map[string]string{
+				"trade date":          "取引日時",
+				"product":             "通貨",
+				"trade type":          "取引種別",
+				"traded price":        "取引価格",
+				"currency 1":          "通貨1",
+				"amount (currency 1)": "通貨1数量",
+				"fee":                 "手数料",
+				"currency 2":          "通貨2",
+				"order id":            "注文 id",
+			},
+			parse: parseBitFlyer,
+		},
+	},
+}
+
+// IsSupportedExchange kiểm tra sàn có parser import hay không
+func IsSupportedExchange(exchange string) bool {
+	_, ok := exchangeFormats[exchange]
+	return ok
+}
+
+// detectImportFormat tìm dòng header và định dạng tương ứng trong các dòng đầu của file.
+// Một số file (Coinbase) có phần mô tả trước dòng header
+func detectImportFormat(exchange string, rows [][]string) (*importFormat, int, []string, error) {
+	formats, ok := exchangeFormats[exchange]
+	if !ok {
+		return nil, 0, nil, &CustomError{Code: "UNSUPPORTED_EXCHANGE", Message: fmt.Sprintf("Import from %q is not supported.", exchange)}
+	}
+	for index, row := range rows {
+		if index >= maxHeaderSearchRows {
+			break
+		}
+		for i := range formats {
+			header := normalizeHeader(row, formats[i].aliases)
+			if hasColumns(header, formats[i].required) {
+				return &formats[i], index, header, nil
+			}
+		}
+	}
+	return nil, 0, nil, &CustomError{Code: "INVALID_IMPORT_FILE", Message: fmt.Sprintf("The file is not a supported %s export.", exchange)}
+}
+
+// maxHeaderSearchRows là số dòng đầu tiên được dùng để tìm header
+const maxHeaderSearchRows = 20
+
+// normalizeHeader chuẩn hóa tên cột về chữ thường (bỏ BOM, khoảng trắng) và áp dụng tên cột thay thế
+func normalizeHeader(row []string, aliases map[string]string) []string {
+	header := make([]string, len(row))
+	for i, column := range row {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if alias, ok := aliases[column]; ok {
+			column = alias
+		}
+		header[i] = column
+	}
+	return header
+}
+
+// hasColumns kiểm tra header có đủ các cột bắt buộc
+func hasColumns(header, required []string) bool {
+	present := make(map[string]bool, len(header))
+	for _, column := range header {
+		present[column] = true
+	}
+	for _, column := range required {
+		if !present[column] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseImportNumber đọc số từ file export, bỏ dấu phân cách hàng nghìn và ký hiệu tiền tệ.
+// Ô trống được xem là 0
+func parseImportNumber(value string) (float64, error) {
+	cleaned := strings.NewReplacer(",", "", " ", "", "$", "", "€", "", "£", "", "¥", "", "￥", "").Replace(strings.TrimSpace(value))
+	if cleaned == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseFloat(cleaned, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return number, nil
+}
+
+// amountWithAssetPattern tách chuỗi dạng "0.5BTC" hoặc "1,000 USDT" thành số lượng và tài sản
+var amountWithAssetPattern = regexp.MustCompile(`^\s*(-?[0-9][0-9,]*(?:\.[0-9]+)?(?:[eE]-?[0-9]+)?)\s*([A-Za-z0-9]+)\s*$`)
+
+// parseAmountWithAsset đọc số lượng kèm ký hiệu tài sản của Binance
+func parseAmountWithAsset(value string) (float64, string, error) {
+	match := amountWithAssetPattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, "", fmt.Errorf("invalid amount %q", value)
+	}
+	amount, err := parseImportNumber(match[1])
+	if err != nil {
+		return 0, "", err
+	}
+	return amount, normalizeSymbol(match[2]), nil
+}
+
+// parseImportTime đọc thời gian theo các layout cho trước trong múi giờ location
+func parseImportTime(value string, location *time.Location, layouts ...string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range layouts {
+		if date, err := time.ParseInLocation(layout, value, location); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// parseBinanceTrade đọc một dòng lịch sử khớp lệnh (Trade History) của Binance
+func parseBinanceTrade(record importRecord) (*models.Transaction, error) {
+	date, err := parseImportTime(record.get("date(utc)"), time.UTC, "2006-01-02 15:04:05", "06-01-02 15:04:05")
+	if err != nil {
+		return nil, err
+	}
+	transactionType := strings.ToLower(record.get("side"))
+	if transactionType != models.TransactionBuy && transactionType != models.TransactionSell {
+		return nil, fmt.Errorf("unknown side %q", record.get("side"))
+	}
+	amount, coin, err := parseAmountWithAsset(record.get("executed"))
+	if err != nil {
+		return nil, err
+	}
+	total, quote, err := parseAmountWithAsset(record.get("amount"))
+	if err != nil {
+		return nil, err
+	}
+	transaction := &models.Transaction{
+		Coin:            coin,
+		TransactionType: transactionType,
+		Amount:          amount,
+		QuoteCurrency:   quote,
+		Date:            date,
+	}
+	if amount > 0 {
+		transaction.Price = total / amount
+	}
+	if fee := record.get("fee"); fee != "" {
+		if transaction.FeeAmount, transaction.FeeCurrency, err = parseAmountWithAsset(fee); err != nil {
+			return nil, err
+		}
+	}
+	return transaction, nil
+}
+
+// binanceIncomeOperations là các operation của sao kê Binance ghi nhận phần thưởng thực nhận. Các operation
+// chuyển coin giữa ví Spot và Earn/Staking (Subscription, Redemption, Purchase...) không phải thu nhập
+var binanceIncomeOperations = map[string]string{
+	"staking rewards":               models.TransactionStaking,
+	"eth 2.0 staking rewards":       models.TransactionStaking,
+	"simple earn flexible interest": models.TransactionInterest,
+	"simple earn locked rewards":    models.TransactionInterest,
+	"savings interest":              models.TransactionInterest,
+	"pos savings interest":          models.TransactionInterest,
+	"launchpool interest":           models.TransactionInterest,
+	"simple earn flexible airdrop":  models.TransactionAirdrop,
+	"airdrop assets":                models.TransactionAirdrop,
+	"distribution":                  models.TransactionAirdrop,
+}
+
+// parseBinanceStatement đọc một dòng sao kê (Transaction History) của Binance. Chỉ nạp, rút và phần thưởng
+// trong binanceIncomeOperations được import; mua bán được lấy từ Trade History nên các dòng đó bị bỏ qua để không ghi trùng
+func parseBinanceStatement(record importRecord) (*models.Transaction, error) {
+	operation := strings.ToLower(strings.TrimSpace(record.get("operation")))
+	transactionType, income := binanceIncomeOperations[operation]
+	switch {
+	case income:
+	case operation == "deposit":
+		transactionType = models.TransactionDeposit
+	case operation == "withdraw":
+		transactionType = models.TransactionWithdrawal
+	default:
+		return nil, errSkipRow
+	}
+
+	date, err := parseImportTime(record.get("utc_time"), time.UTC, "2006-01-02 15:04:05", "06-01-02 15:04:05")
+	if err != nil {
+		return nil, err
+	}
+	change, err := parseImportNumber(record.get("change"))
+	if err != nil {
+		return nil, err
+	}
+	coin := normalizeSymbol(record.get("coin"))
+	if IsSupportedCurrency(coin) {
+		return nil, errSkipRow
+	}
+	// Dòng thu nhập âm hoặc bằng 0 (ví dụ bị thu hồi) không tạo ra lô mới
+	if income && change <= 0 {
+		return nil, errSkipRow
+	}
+	return &models.Transaction{
+		Coin:            coin,
+		TransactionType: transactionType,
+		Amount:          math.Abs(change),
+		Date:            date,
+	}, nil
+}
+
+// coinbaseConvertPattern đọc ghi chú của giao dịch Convert, ví dụ "Converted 0.5 ETH to 812.3 USDC"
+var coinbaseConvertPattern = regexp.MustCompile(`(?i)converted\s+([0-9][0-9,]*(?:\.[0-9]+)?)\s+([A-Za-z0-9]+)\s+to\s+([0-9][0-9,]*(?:\.[0-9]+)?)\s+([A-Za-z0-9]+)`)
+
+// parseCoinbase đọc một dòng Transaction History của Coinbase
+func parseCoinbase(record importRecord) (*models.Transaction, error) {
+	date, err := parseImportTime(record.get("timestamp"), time.UTC, time.RFC3339, "2006-01-02 15:04:05 UTC", "2006-01-02 15:04:05")
+	if err != nil {
+		return nil, err
+	}
+	quantity, err := parseImportNumber(record.get("quantity transacted"))
+	if err != nil {
+		return nil, err
+	}
+	price, err := parseImportNumber(record.get("spot price at transaction"))
+	if err != nil {
+		return nil, err
+	}
+	fee, err := parseImportNumber(record.get("fees and/or spread", "fees"))
+	if err != nil {
+		return nil, err
+	}
+	transaction := &models.Transaction{
+		Coin:          normalizeSymbol(record.get("asset")),
+		Amount:        math.Abs(quantity),
+		QuoteCurrency: normalizeSymbol(record.get("spot price currency")),
+		Date:          date,
+		ExternalID:    record.get("id"),
+	}
+
+	switch transactionType := strings.ToLower(record.get("transaction type")); transactionType {
+	case "buy", "advanced trade buy", "advance trade buy":
+		transaction.TransactionType = models.TransactionBuy
+	case "sell", "advanced trade sell", "advance trade sell":
+		transaction.TransactionType = models.TransactionSell
+	case "send":
+		transaction.TransactionType = models.TransactionWithdrawal
+	case "receive":
+		transaction.TransactionType = models.TransactionDeposit
+	case "rewards income", "staking income", "inflation reward":
+		transaction.TransactionType = models.TransactionStaking
+	case "learning reward", "coinbase earn":
+		transaction.TransactionType = models.TransactionAirdrop
+	case "convert":
+		match := coinbaseConvertPattern.FindStringSubmatch(record.get("notes"))
+		if match == nil {
+			return nil, fmt.Errorf("cannot read conversion from notes %q", record.get("notes"))
+		}
+		toAmount, err := parseImportNumber(match[3])
+		if err != nil {
+			return nil, err
+		}
+		transaction.TransactionType = models.TransactionSwap
+		transaction.ToCoin = normalizeSymbol(match[4])
+		transaction.ToAmount = toAmount
+		// Phí của giao dịch swap được tính theo coin nhận về, Coinbase ghi phí theo tiền pháp định
+		if fee > 0 {
+			transaction.FeeAmount, transaction.FeeCurrency = fee, transaction.QuoteCurrency
+		}
+		transaction.QuoteCurrency = ""
+		return transaction, nil
+	default:
+		// Nạp/rút tiền pháp định và các loại giao dịch khác không thay đổi danh mục coin
+		return nil, errSkipRow
+	}
+
+	switch transaction.TransactionType {
+	case models.TransactionBuy, models.TransactionSell:
+		transaction.Price = price
+		transaction.FeeAmount = fee
+	case models.TransactionStaking, models.TransactionAirdrop:
+		transaction.Price = price
+	}
+	return transaction, nil
+}
+
+// krakenQuoteSuffixes là các đồng định giá dùng để tách cặp giao dịch của Kraken (XXBTZUSD, DOTEUR...).
+// Hậu tố dài hơn được thử trước
+var krakenQuoteSuffixes = []string{"ZUSD", "ZEUR", "ZJPY", "ZGBP", "ZCAD", "ZAUD", "ZCHF", "USDT", "USDC", "XXBT", "XETH", "USD", "EUR", "JPY", "GBP", "CAD", "AUD", "CHF", "XBT", "ETH", "DAI"}
+
+// krakenAsset chuyển mã tài sản của Kraken về ký hiệu thông thường (XXBT -> BTC, ZUSD -> USD, DOT.S -> DOT)
+func krakenAsset(asset string) string {
+	asset = normalizeSymbol(asset)
+	if index := strings.Index(asset, "."); index > 0 {
+		asset = asset[:index]
+	}
+	if len(asset) == 4 && (asset[0] == 'X' || asset[0] == 'Z') {
+		asset = asset[1:]
+	}
+	switch asset {
+	case "XBT":
+		return "BTC"
+	case "XDG":
+		return "DOGE"
+	}
+	return asset
+}
+
+// splitKrakenPair tách cặp giao dịch của Kraken thành coin và đồng định giá
+func splitKrakenPair(pair string) (string, string, error) {
+	pair = normalizeSymbol(strings.ReplaceAll(pair, "/", ""))
+	for _, suffix := range krakenQuoteSuffixes {
+		if len(pair) > len(suffix) && strings.HasSuffix(pair, suffix) {
+			return krakenAsset(strings.TrimSuffix(pair, suffix)), krakenAsset(suffix), nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown pair %q", pair)
+}
+
+// parseKrakenTrade đọc một dòng trades.csv của Kraken, phí được tính theo đồng định giá
+func parseKrakenTrade(record importRecord) (*models.Transaction, error) {
+	date, err := parseImportTime(record.get("time"), time.UTC, "2006-01-02 15:04:05.9999", "2006-01-02 15:04:05")
+	if err != nil {
+		return nil, err
+	}
+	transactionType := strings.ToLower(record.get("type"))
+	if transactionType != models.TransactionBuy && transactionType != models.TransactionSell {
+		return nil, fmt.Errorf("unknown type %q", record.get("type"))
+	}
+	coin, quote, err := splitKrakenPair(record.get("pair"))
+	if err != nil {
+		return nil, err
+	}
+	price, err := parseImportNumber(record.get("price"))
+	if err != nil {
+		return nil, err
+	}
+	volume, err := parseImportNumber(record.get("vol"))
+	if err != nil {
+		return nil, err
+	}
+	fee, err := parseImportNumber(record.get("fee"))
+	if err != nil {
+		return nil, err
+	}
+	return &models.Transaction{
+		Coin:            coin,
+		TransactionType: transactionType,
+		Amount:          volume,
+		Price:           price,
+		QuoteCurrency:   quote,
+		FeeAmount:       fee,
+		Date:            date,
+		ExternalID:      record.get("txid"),
+	}, nil
+}
+
+// parseKrakenLedger đọc một dòng ledgers.csv của Kraken. Chỉ nạp, rút và phần thưởng staking được
+// import; các dòng trade được lấy từ trades.csv nên bị bỏ qua
+func parseKrakenLedger(record importRecord) (*models.Transaction, error) {
+	var transactionType string
+	switch ledgerType := strings.ToLower(record.get("type")); ledgerType {
+	case "deposit":
+		transactionType = models.TransactionDeposit
+	case "withdrawal":
+		transactionType = models.TransactionWithdrawal
+	case "staking":
+		transactionType = models.TransactionStaking
+	case "earn":
+		if !strings.EqualFold(record.get("subtype"), "reward") {
+			return nil, errSkipRow
+		}
+		transactionType = models.TransactionStaking
+	default:
+		return nil, errSkipRow
+	}
+	// Dòng chưa có txid là giao dịch đang chờ xử lý
+	if record.get("txid") == "" {
+		return nil, errSkipRow
+	}
+
+	coin := krakenAsset(record.get("asset"))
+	if IsSupportedCurrency(coin) {
+		return nil, errSkipRow
+	}
+	date, err := parseImportTime(record.get("time"), time.UTC, "2006-01-02 15:04:05.9999", "2006-01-02 15:04:05")
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseImportNumber(record.get("amount"))
+	if err != nil {
+		return nil, err
+	}
+	fee, err := parseImportNumber(record.get("fee"))
+	if err != nil {
+		return nil, err
+	}
+	transaction := &models.Transaction{
+		Coin:            coin,
+		TransactionType: transactionType,
+		Amount:          math.Abs(amount),
+		Date:            date,
+		ExternalID:      record.get("txid"),
+	}
+	if fee > 0 {
+		transaction.FeeAmount, transaction.FeeCurrency = fee, coin
+	}
+	return transaction, nil
+}
+
+// bitFlyerLocation là múi giờ của thời gian trong file export bitFlyer (JST)
+var bitFlyerLocation = time.FixedZone("JST", 9*60*60)
+
+// parseBitFlyer đọc một dòng lịch sử giao dịch (取引履歴) của bitFlyer, header tiếng Nhật hoặc tiếng Anh.
+// Phí được trừ theo coin giao dịch (通貨1)
+func parseBitFlyer(record importRecord) (*models.Transaction, error) {
+	var transactionType string
+	switch tradeType := strings.ToLower(record.get("取引種別")); tradeType {
+	case "買い", "buy":
+		transactionType = models.TransactionBuy
+	case "売り", "sell":
+		transactionType = models.TransactionSell
+	case "預入", "受取", "deposit", "receive":
+		transactionType = models.TransactionDeposit
+	case "外部送付", "送付", "withdrawal", "send":
+		transactionType = models.TransactionWithdrawal
+	default:
+		// 入金/出金 là nạp/rút JPY, không thay đổi danh mục coin
+		return nil, errSkipRow
+	}
+
+	coin := normalizeSymbol(record.get("通貨1"))
+	if IsSupportedCurrency(coin) {
+		return nil, errSkipRow
+	}
+	date, err := parseImportTime(record.get("取引日時"), bitFlyerLocation, "2006/01/02 15:04:05", "2006/01/02 15:04", "2006-01-02 15:04:05")
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseImportNumber(record.get("通貨1数量"))
+	if err != nil {
+		return nil, err
+	}
+	fee, err := parseImportNumber(record.get("手数料"))
+	if err != nil {
+		return nil, err
+	}
+	transaction := &models.Transaction{
+		Coin:            coin,
+		TransactionType: transactionType,
+		Amount:          math.Abs(amount),
+		Date:            date,
+		ExternalID:      record.get("注文 id"),
+	}
+	if fee != 0 {
+		transaction.FeeAmount, transaction.FeeCurrency = math.Abs(fee), coin
+	}
+	if transactionType == models.TransactionBuy || transactionType == models.TransactionSell {
+		if transaction.Price, err = parseImportNumber(record.get("取引価格")); err != nil {
+			return nil, err
+		}
+		transaction.QuoteCurrency = normalizeSymbol(record.get("通貨2"))
+		if transaction.QuoteCurrency == "" {
+			transaction.QuoteCurrency = "JPY"
+		}
+	}
+	return transaction, nil
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"crypto-folio/models"
+)
+
+func TestExchangeParsers(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+
+	tests := []struct {
+		name    string
+		parse   func(importRecord) (*models.Transaction, error)
+		record  importRecord
+		want    *models.Transaction
+		skip    bool
+		wantErr bool
+	}{
+		{
+			name:  "binance trade with fee in BNB",
+			parse: parseBinanceTrade,
+			record: importRecord{"date(utc)": "2025-03-01 10:00:00", "pair": "BTCUSDT", "side": "BUY",
+				"executed": "0.5BTC", "amount": "30,000USDT", "fee": "0.01BNB"},
+			want: &models.Transaction{Coin: "BTC", TransactionType: models.TransactionBuy, Amount: 0.5, Price: 60000,
+				QuoteCurrency: "USDT", FeeAmount: 0.01, FeeCurrency: "BNB", Date: time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:    "binance trade with unknown side",
+			parse:   parseBinanceTrade,
+			record:  importRecord{"date(utc)": "2025-03-01 10:00:00", "side": "HOLD", "executed": "1BTC", "amount": "1USDT"},
+			wantErr: true,
+		},
+		{
+			name:   "binance staking reward",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Staking Rewards", "coin": "ETH", "change": "0.01"},
+			want:   &models.Transaction{Coin: "ETH", TransactionType: models.TransactionStaking, Amount: 0.01, Date: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "binance earn interest",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Simple Earn Flexible Interest", "coin": "USDT", "change": "1.5"},
+			want:   &models.Transaction{Coin: "USDT", TransactionType: models.TransactionInterest, Amount: 1.5, Date: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "binance withdraw",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Withdraw", "coin": "BTC", "change": "-0.2"},
+			want:   &models.Transaction{Coin: "BTC", TransactionType: models.TransactionWithdrawal, Amount: 0.2, Date: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "binance earn subscription is not income",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Simple Earn Flexible Subscription", "coin": "BTC", "change": "-1"},
+			skip:   true,
+		},
+		{
+			name:   "binance staking purchase is not income",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Staking Purchase", "coin": "ETH", "change": "-1"},
+			skip:   true,
+		},
+		{
+			name:   "binance negative reward row",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Staking Rewards", "coin": "ETH", "change": "-0.01"},
+			skip:   true,
+		},
+		{
+			name:   "binance fiat deposit",
+			parse:  parseBinanceStatement,
+			record: importRecord{"utc_time": "2025-03-01 00:00:00", "operation": "Deposit", "coin": "EUR", "change": "100"},
+			skip:   true,
+		},
+		{
+			name:  "coinbase buy",
+			parse: parseCoinbase,
+			record: importRecord{"id": "cb-1", "timestamp": "2025-03-01T10:00:00Z", "transaction type": "Buy", "asset": "eth",
+				"quantity transacted": "2", "spot price currency": "USD", "spot price at transaction": "$1,500.00", "fees and/or spread": "3"},
+			want: &models.Transaction{Coin: "ETH", TransactionType: models.TransactionBuy, Amount: 2, Price: 1500, QuoteCurrency: "USD",
+				FeeAmount: 3, Date: time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC), ExternalID: "cb-1"},
+		},
+		{
+			name:  "coinbase convert",
+			parse: parseCoinbase,
+			record: importRecord{"id": "cb-2", "timestamp": "2025-03-01T10:00:00Z", "transaction type": "Convert", "asset": "ETH",
+				"quantity transacted": "-0.5", "spot price currency": "USD", "fees and/or spread": "1.2", "notes": "Converted 0.5 ETH to 812.3 USDC"},
+			want: &models.Transaction{Coin: "ETH", TransactionType: models.TransactionSwap, Amount: 0.5, ToCoin: "USDC", ToAmount: 812.3,
+				FeeAmount: 1.2, FeeCurrency: "USD", Date: time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC), ExternalID: "cb-2"},
+		},
+		{
+			name:   "coinbase fiat deposit",
+			parse:  parseCoinbase,
+			record: importRecord{"timestamp": "2025-03-01T10:00:00Z", "transaction type": "Deposit", "asset": "USD", "quantity transacted": "100"},
+			skip:   true,
+		},
+		{
+			name:  "kraken trade",
+			parse: parseKrakenTrade,
+			record: importRecord{"txid": "T1", "pair": "XXBTZUSD", "time": "2025-03-01 10:00:00.1234", "type": "sell",
+				"price": "60000", "vol": "0.1", "fee": "9.6"},
+			want: &models.Transaction{Coin: "BTC", TransactionType: models.TransactionSell, Amount: 0.1, Price: 60000, QuoteCurrency: "USD",
+				FeeAmount: 9.6, Date: time.Date(2025, 3, 1, 10, 0, 0, 123400000, time.UTC), ExternalID: "T1"},
+		},
+		{
+			name:    "kraken trade with unknown pair",
+			parse:   parseKrakenTrade,
+			record:  importRecord{"txid": "T2", "pair": "FOO", "time": "2025-03-01 10:00:00", "type": "buy", "price": "1", "vol": "1", "fee": "0"},
+			wantErr: true,
+		},
+		{
+			name:  "kraken staking reward with fee",
+			parse: parseKrakenLedger,
+			record: importRecord{"txid": "L1", "time": "2025-03-01 10:00:00", "type": "staking", "asset": "DOT.S",
+				"amount": "1.5", "fee": "0.01"},
+			want: &models.Transaction{Coin: "DOT", TransactionType: models.TransactionStaking, Amount: 1.5, FeeAmount: 0.01, FeeCurrency: "DOT",
+				Date: time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC), ExternalID: "L1"},
+		},
+		{
+			name:   "kraken pending ledger row",
+			parse:  parseKrakenLedger,
+			record: importRecord{"txid": "", "time": "2025-03-01 10:00:00", "type": "deposit", "asset": "XXBT", "amount": "1", "fee": "0"},
+			skip:   true,
+		},
+		{
+			name:  "bitflyer buy in japanese",
+			parse: parseBitFlyer,
+			record: importRecord{"取引日時": "2025/03/01 19:00:00", "取引種別": "買い", "通貨1": "BTC", "通貨1数量": "0.01",
+				"手数料": "-0.00001", "取引価格": "9,000,000", "注文 id": "BF1"},
+			want: &models.Transaction{Coin: "BTC", TransactionType: models.TransactionBuy, Amount: 0.01, Price: 9000000, QuoteCurrency: "JPY",
+				FeeAmount: 0.00001, FeeCurrency: "BTC", Date: time.Date(2025, 3, 1, 19, 0, 0, 0, jst), ExternalID: "BF1"},
+		},
+		{
+			name:   "bitflyer jpy deposit",
+			parse:  parseBitFlyer,
+			record: importRecord{"取引日時": "2025/03/01 19:00:00", "取引種別": "入金", "通貨1": "JPY", "通貨1数量": "10000"},
+			skip:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(tt.record)
+			switch {
+			case tt.skip:
+				if !errors.Is(err, errSkipRow) {
+					t.Fatalf("error = %v, want errSkipRow", err)
+				}
+			case tt.wantErr:
+				if err == nil || errors.Is(err, errSkipRow) {
+					t.Fatalf("error = %v, want a parse error", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !got.Date.Equal(tt.want.Date) {
+					t.Errorf("date = %v, want %v", got.Date, tt.want.Date)
+				}
+				got.Date, tt.want.Date = time.Time{}, time.Time{}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("transaction = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseImportNumber(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "1,234.5", want: 1234.5},
+		{value: " $12 ", want: 12},
+		{value: "¥1,000", want: 1000},
+		{value: "-0.25", want: -0.25},
+		{value: "1e-3", want: 0.001},
+		{value: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseImportNumber(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImportNumber(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseImportNumber(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSplitKrakenPair(t *testing.T) {
+	tests := []struct {
+		pair, coin, quote string
+	}{
+		{pair: "XXBTZUSD", coin: "BTC", quote: "USD"},
+		{pair: "XETHZEUR", coin: "ETH", quote: "EUR"},
+		{pair: "DOTUSDT", coin: "DOT", quote: "USDT"},
+		{pair: "XDGUSD", coin: "DOGE", quote: "USD"},
+		{pair: "SOL/EUR", coin: "SOL", quote: "EUR"},
+	}
+	for _, tt := range tests {
+		coin, quote, err := splitKrakenPair(tt.pair)
+		if err != nil || coin != tt.coin || quote != tt.quote {
+			t.Errorf("splitKrakenPair(%q) = %s, %s, %v, want %s, %s", tt.pair, coin, quote, err, tt.coin, tt.quote)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportTimeout là thời gian tối đa để stream toàn bộ giao dịch của một lần export
+const exportTimeout = 5 * time.Minute
+
+// exportBatchSize là số giao dịch được đọc từ MongoDB mỗi lần và số dòng CSV giữa hai lần flush
+const exportBatchSize = 200
+
+// Các định dạng export được hỗ trợ
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	ExportOFX    = "ofx"
+	ExportQIF    = "qif"
+)
+
+// exportContentTypes là Content-Type của từng định dạng export
+var exportContentTypes = map[string]string{
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportNDJSON: "application/x-ndjson",
+	ExportOFX:    "application/x-ofx",
+	ExportQIF:    "application/qif",
+}
+
+// ExportedTransaction là giao dịch kèm các trường tính toán theo tiền tệ export
+type ExportedTransaction struct {
+	models.Transaction
+	Currency     string   `json:"currency"`
+	ValueIn      *float64 `json:"value_in_currency,omitempty"`
+	CostBasisIn  *float64 `json:"cost_basis_in_currency,omitempty"` // Giá vốn của các lô đã trừ khi bán/rút
+	ProceedsIn   *float64 `json:"proceeds_in_currency,omitempty"`
+	FeeIn        *float64 `json:"fee_in_currency,omitempty"`
+	RealizedPLIn *float64 `json:"realized_pl_in_currency,omitempty"`
+	IncomeIn     *float64 `json:"income_in_currency,omitempty"`
+}
+
+// TransactionExport stream giao dịch của người dùng theo một định dạng mà không đọc toàn bộ cursor vào bộ nhớ
+type TransactionExport struct {
+	ContentType string
+	Extension   string
+	userID      primitive.ObjectID
+	format      string
+	currency    string
+	filter      TransactionFilter
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cursor      *mongo.Cursor
+}
+
+// OpenTransactionExport kiểm tra yêu cầu export và mở cursor trên các giao dịch khớp bộ lọc theo thứ tự
+// thời gian. currency rỗng dùng tiền tệ cơ sở của người dùng. Gọi Close khi đã stream xong
+func OpenTransactionExport(userID primitive.ObjectID, format, currency string, filter TransactionFilter) (*TransactionExport, error) {
+	format = strings.ToLower(format)
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		return nil, &CustomError{Code: "UNSUPPORTED_EXPORT_FORMAT", Message: fmt.Sprintf("Export format %q is not supported.", format)}
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if currency == "" {
+		baseCurrency, _, err := GetUserCurrencies(userID)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching user currencies: %v", err)
+		}
+		currency = baseCurrency
+	}
+	currency, err := NormalizeCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "date", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetBatchSize(exportBatchSize)
+	cursor, err := configs.GetCollection("transactions").Find(ctx, filter.query(userID), opts)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error fetching transactions: %v", err)
+	}
+	return &TransactionExport{
+		ContentType: contentType,
+		Extension:   format,
+		userID:      userID,
+		format:      format,
+		currency:    currency,
+		filter:      filter,
+		ctx:         ctx,
+		cancel:      cancel,
+		cursor:      cursor,
+	}, nil
+}
+
+// Close đóng cursor của lần export
+func (e *TransactionExport) Close() {
+	e.cursor.Close(e.ctx)
+	e.cancel()
+}
+
+// Stream ghi lần lượt từng giao dịch vào w theo định dạng đã chọn
+func (e *TransactionExport) Stream(w io.Writer) error {
+	var writer transactionWriter
+	switch e.format {
+	case ExportCSV:
+		writer = &csvTransactionWriter{writer: csv.NewWriter(w), currency: e.currency}
+	case ExportNDJSON:
+		writer = &ndjsonTransactionWriter{encoder: json.NewEncoder(w)}
+	case ExportOFX:
+		writer = &ofxTransactionWriter{w: w, currency: e.currency, accountID: e.userID.Hex(), filter: e.filter}
+	case ExportQIF:
+		writer = &qifTransactionWriter{w: w}
+	}
+
+	if err := writer.begin(); err != nil {
+		return err
+	}
+	for e.cursor.Next(e.ctx) {
+		var transaction models.Transaction
+		if err := e.cursor.Decode(&transaction); err != nil {
+			return fmt.Errorf("error decoding transaction: %v", err)
+		}
+		// OFX và QIF được nhập như bút toán vào phần mềm kế toán nên chỉ gồm giao dịch đã hoàn thành. Chuyển coin
+		// giữa hai tài khoản của người dùng không làm thay đổi số coin nắm giữ, ghi ra sẽ bị tính là nhận thêm coin
+		if (e.format == ExportOFX || e.format == ExportQIF) &&
+			(transaction.Status != models.StatusCompleted || transaction.TransactionType == models.TransactionTransfer) {
+			continue
+		}
+		if err := writer.write(exportTransaction(transaction, e.currency)); err != nil {
+			return err
+		}
+	}
+	if err := e.cursor.Err(); err != nil {
+		return fmt.Errorf("error reading transactions: %v", err)
+	}
+	return writer.end()
+}
+
+// exportTransaction tính các trường giá trị, giá vốn, tiền thu về, phí, lời/lỗ và thu nhập theo currency
+func exportTransaction(transaction models.Transaction, currency string) ExportedTransaction {
+	exported := ExportedTransaction{Transaction: transaction, Currency: currency}
+	amountIn := func(amounts map[string]float64) *float64 {
+		if amount, ok := amounts[currency]; ok {
+			return &amount
+		}
+		return nil
+	}
+	exported.ValueIn = amountIn(transaction.CostIn())
+	if len(transaction.ConsumedLots) > 0 {
+		exported.CostBasisIn = amountIn(consumedCost(transaction.ConsumedLots))
+	}
+	exported.ProceedsIn = amountIn(transaction.Proceeds)
+	exported.FeeIn = amountIn(transaction.FeeValue)
+	exported.RealizedPLIn = amountIn(transaction.RealizedPL)
+	exported.IncomeIn = amountIn(transaction.Income)
+	return exported
+}
+
+// transactionWriter ghi giao dịch theo một định dạng export
+type transactionWriter interface {
+	begin() error
+	write(transaction ExportedTransaction) error
+	end() error
+}
+
+// formatExportNumber định dạng số không dùng ký hiệu mũ để bảng tính đọc được
+func formatExportNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// formatOptionalNumber định dạng số có thể không có, trả về chuỗi rỗng nếu không có
+func formatOptionalNumber(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return formatExportNumber(*value)
+}
+
+// csvTransactionWriter ghi giao dịch dạng CSV, các cột tính toán có hậu tố là tiền tệ export
+type csvTransactionWriter struct {
+	writer   *csv.Writer
+	currency string
+	rows     int
+}
+
+func (c *csvTransactionWriter) begin() error {
+	suffix := "_" + strings.ToLower(c.currency)
+	return c.writer.Write([]string{
+		"id", "date", "transaction_type", "status", "coin", "amount", "price", "quote_currency",
+		"to_coin", "to_amount", "fee_amount", "fee_currency",
+		"value" + suffix, "cost_basis" + suffix, "proceeds" + suffix, "fee" + suffix, "realized_pl" + suffix, "income" + suffix,
+		"source", "external_id", "void_reason",
+	})
+}
+
+func (c *csvTransactionWriter) write(transaction ExportedTransaction) error {
+	toAmount := ""
+	if transaction.ToAmount != 0 {
+		toAmount = formatExportNumber(transaction.ToAmount)
+	}
+	feeAmount := ""
+	if transaction.FeeAmount != 0 {
+		feeAmount = formatExportNumber(transaction.FeeAmount)
+	}
+	err := c.writer.Write([]string{
+		transaction.ID.Hex(),
+		transaction.Date.UTC().Format(time.RFC3339),
+		transaction.TransactionType,
+		transaction.Status,
+		transaction.Coin,
+		formatExportNumber(transaction.Amount),
+		formatExportNumber(transaction.Price),
+		transaction.GetQuoteCurrency(),
+		transaction.ToCoin,
+		toAmount,
+		feeAmount,
+		transaction.FeeCurrency,
+		formatOptionalNumber(transaction.ValueIn),
+		formatOptionalNumber(transaction.CostBasisIn),
+		formatOptionalNumber(transaction.ProceedsIn),
+		formatOptionalNumber(transaction.FeeIn),
+		formatOptionalNumber(transaction.RealizedPLIn),
+		formatOptionalNumber(transaction.IncomeIn),
+		transaction.Source,
+		transaction.ExternalID,
+		transaction.VoidReason,
+	})
+	if err != nil {
+		return err
+	}
+	// Flush định kỳ để client nhận dữ liệu dần thay vì chờ đến cuối
+	c.rows++
+	if c.rows%exportBatchSize == 0 {
+		c.writer.Flush()
+		return c.writer.Error()
+	}
+	return nil
+}
+
+func (c *csvTransactionWriter) end() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// ndjsonTransactionWriter ghi mỗi giao dịch thành một dòng JSON
+type ndjsonTransactionWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonTransactionWriter) begin() error { return nil }
+
+func (n *ndjsonTransactionWriter) write(transaction ExportedTransaction) error {
+	return n.encoder.Encode(transaction)
+}
+
+func (n *ndjsonTransactionWriter) end() error { return nil }
+
+// ofxDate định dạng thời gian theo OFX (YYYYMMDDHHMMSS, UTC)
+func ofxDate(t time.Time) string {
+	return t.UTC().Format("20060102150405")
+}
+
+// ofxEscape thoát các ký tự đặc biệt của SGML trong giá trị OFX
+var ofxEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// ofxTransactionWriter ghi giao dịch thành sao kê đầu tư OFX 1.0.2 (SGML). Coin được ghi là chứng khoán
+// "khác" theo mã ticker; mua/bán/swap là BUYOTHER/SELLOTHER, thu nhập là INCOME, nạp/rút là TRANSFER.
+// Danh sách chứng khoán (SECLIST) mô tả mọi SECID đã dùng được ghi sau sao kê
+type ofxTransactionWriter struct {
+	w          io.Writer
+	currency   string
+	accountID  string
+	filter     TransactionFilter
+	securities []string
+	seen       map[string]bool
+}
+
+func (o *ofxTransactionWriter) begin() error {
+	now := time.Now()
+	start, end := o.filter.From, o.filter.To
+	if start.IsZero() {
+		start = time.Unix(0, 0)
+	}
+	if end.IsZero() {
+		end = now
+	}
+	_, err := fmt.Fprintf(o.w, "OFXHEADER:100\r\nDATA:OFXSGML\r\nVERSION:102\r\nSECURITY:NONE\r\nENCODING:USASCII\r\nCHARSET:1252\r\nCOMPRESSION:NONE\r\nOLDFILEUID:NONE\r\nNEWFILEUID:NONE\r\n\r\n"+
+		"<OFX>\r\n<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>%s<LANGUAGE>ENG</SONRS></SIGNONMSGSRSV1>\r\n"+
+		"<INVSTMTMSGSRSV1><INVSTMTTRNRS><TRNUID>0<STATUS><CODE>0<SEVERITY>INFO</STATUS>\r\n"+
+		"<INVSTMTRS><DTASOF>%s<CURDEF>%s<INVACCTFROM><BROKERID>crypto-folio<ACCTID>%s</INVACCTFROM>\r\n"+
+		"<INVTRANLIST><DTSTART>%s<DTEND>%s\r\n",
+		ofxDate(now), ofxDate(now), o.currency, o.accountID, ofxDate(start), ofxDate(end))
+	return err
+}
+
+// invTran trả về khối INVTRAN của giao dịch, suffix phân biệt hai vế của giao dịch swap
+func (o *ofxTransactionWriter) invTran(transaction ExportedTransaction, suffix string) string {
+	return fmt.Sprintf("<INVTRAN><FITID>%s%s<DTTRADE>%s<MEMO>%s</INVTRAN>",
+		transaction.ID.Hex(), suffix, ofxDate(transaction.Date), ofxEscape.Replace(transaction.TransactionType))
+}
+
+// secID trả về khối SECID của coin theo mã ticker
+func secID(coin string) string {
+	return fmt.Sprintf("<SECID><UNIQUEID>%s<UNIQUEIDTYPE>TICKER</SECID>", ofxEscape.Replace(coin))
+}
+
+// security ghi nhận coin để mô tả trong SECLIST và trả về khối SECID của nó
+func (o *ofxTransactionWriter) security(coin string) string {
+	if o.seen == nil {
+		o.seen = make(map[string]bool)
+	}
+	if !o.seen[coin] {
+		o.seen[coin] = true
+		o.securities = append(o.securities, coin)
+	}
+	return secID(coin)
+}
+
+func (o *ofxTransactionWriter) write(transaction ExportedTransaction) error {
+	value := 0.0
+	if transaction.ValueIn != nil {
+		value = *transaction.ValueIn
+	}
+	fee := 0.0
+	if transaction.FeeIn != nil {
+		fee = *transaction.FeeIn
+	}
+	unitPrice := 0.0
+	if transaction.Amount > 0 {
+		unitPrice = value / transaction.Amount
+	}
+
+	var entry string
+	switch {
+	case transaction.TransactionType == models.TransactionBuy:
+		entry = o.buy(transaction, "", transaction.Coin, transaction.Amount, unitPrice, fee, -(value + fee))
+	case transaction.TransactionType == models.TransactionSell:
+		entry = o.sell(transaction, "", transaction.Coin, transaction.Amount, unitPrice, fee, value-fee)
+	case transaction.TransactionType == models.TransactionSwap:
+		// Swap được ghi thành bán coin gửi đi và mua coin nhận về với cùng giá trị
+		toPrice := 0.0
+		if transaction.ToAmount > 0 {
+			toPrice = value / transaction.ToAmount
+		}
+		entry = o.sell(transaction, "-OUT", transaction.Coin, transaction.Amount, unitPrice, fee, value-fee) + "\r\n" +
+			o.buy(transaction, "-IN", transaction.ToCoin, transaction.ToAmount, toPrice, 0, -value)
+	case models.IsIncomeType(transaction.TransactionType):
+		entry = fmt.Sprintf("<INCOME>%s%s<INCOMETYPE>MISC<TOTAL>%s<SUBACCTSEC>CASH<SUBACCTFUND>CASH</INCOME>",
+			o.invTran(transaction, ""), o.security(transaction.Coin), formatExportNumber(value))
+	default:
+		units, action := transaction.Amount, "IN"
+		if transaction.TransactionType == models.TransactionWithdrawal {
+			units, action = -transaction.Amount, "OUT"
+		}
+		entry = fmt.Sprintf("<TRANSFER>%s%s<SUBACCTSEC>CASH<UNITS>%s<TFERACTION>%s<POSTYPE>LONG</TRANSFER>",
+			o.invTran(transaction, ""), o.security(transaction.Coin), formatExportNumber(units), action)
+	}
+	_, err := io.WriteString(o.w, entry+"\r\n")
+	return err
+}
+
+// buy trả về khối BUYOTHER, total là số tiền chi ra (âm)
+func (o *ofxTransactionWriter) buy(transaction ExportedTransaction, suffix, coin string, units, unitPrice, fee, total float64) string {
+	return fmt.Sprintf("<BUYOTHER><INVBUY>%s%s<UNITS>%s<UNITPRICE>%s<FEES>%s<TOTAL>%s<SUBACCTSEC>CASH<SUBACCTFUND>CASH</INVBUY></BUYOTHER>",
+		o.invTran(transaction, suffix), o.security(coin), formatExportNumber(units), formatExportNumber(unitPrice), formatExportNumber(fee), formatExportNumber(total))
+}
+
+// sell trả về khối SELLOTHER, total là số tiền thu về sau phí
+func (o *ofxTransactionWriter) sell(transaction ExportedTransaction, suffix, coin string, units, unitPrice, fee, total float64) string {
+	return fmt.Sprintf("<SELLOTHER><INVSELL>%s%s<UNITS>%s<UNITPRICE>%s<FEES>%s<TOTAL>%s<SUBACCTSEC>CASH<SUBACCTFUND>CASH</INVSELL></SELLOTHER>",
+		o.invTran(transaction, suffix), o.security(coin), formatExportNumber(-units), formatExportNumber(unitPrice), formatExportNumber(fee), formatExportNumber(total))
+}
+
+func (o *ofxTransactionWriter) end() error {
+	var list strings.Builder
+	if len(o.securities) > 0 {
+		list.WriteString("<SECLISTMSGSRSV1><SECLIST>\r\n")
+		for _, coin := range o.securities {
+			fmt.Fprintf(&list, "<OTHERINFO><SECINFO>%s<SECNAME>%s<TICKER>%s</SECINFO></OTHERINFO>\r\n",
+				secID(coin), ofxEscape.Replace(coin), ofxEscape.Replace(coin))
+		}
+		list.WriteString("</SECLIST></SECLISTMSGSRSV1>\r\n")
+	}
+	_, err := io.WriteString(o.w, "</INVTRANLIST>\r\n</INVSTMTRS></INVSTMTTRNRS></INVSTMTMSGSRSV1>\r\n"+list.String()+"</OFX>\r\n")
+	return err
+}
+
+// qifTransactionWriter ghi giao dịch theo định dạng QIF tài khoản đầu tư (!Type:Invst)
+type qifTransactionWriter struct {
+	w io.Writer
+}
+
+func (q *qifTransactionWriter) begin() error {
+	_, err := io.WriteString(q.w, "!Type:Invst\n")
+	return err
+}
+
+// qifEntry ghi một bản ghi QIF với hành động, coin, số lượng, giá trị trước phí, tổng tiền và phí
+func (q *qifTransactionWriter) qifEntry(transaction ExportedTransaction, action, coin string, quantity, value, total, fee float64) string {
+	var entry strings.Builder
+	fmt.Fprintf(&entry, "D%s\nN%s\nY%s\nQ%s\n", transaction.Date.UTC().Format("01/02/2006"), action, coin, formatExportNumber(quantity))
+	if quantity > 0 && value != 0 {
+		fmt.Fprintf(&entry, "I%s\n", formatExportNumber(value/quantity))
+	}
+	if total != 0 {
+		fmt.Fprintf(&entry, "T%s\n", formatExportNumber(math.Abs(total)))
+	}
+	if fee != 0 {
+		fmt.Fprintf(&entry, "O%s\n", formatExportNumber(fee))
+	}
+	fmt.Fprintf(&entry, "M%s\n^\n", transaction.TransactionType)
+	return entry.String()
+}
+
+func (q *qifTransactionWriter) write(transaction ExportedTransaction) error {
+	value := 0.0
+	if transaction.ValueIn != nil {
+		value = *transaction.ValueIn
+	}
+	fee := 0.0
+	if transaction.FeeIn != nil {
+		fee = *transaction.FeeIn
+	}
+
+	var entry string
+	switch {
+	case transaction.TransactionType == models.TransactionBuy:
+		entry = q.qifEntry(transaction, "Buy", transaction.Coin, transaction.Amount, value, value+fee, fee)
+	case transaction.TransactionType == models.TransactionSell:
+		entry = q.qifEntry(transaction, "Sell", transaction.Coin, transaction.Amount, value, value-fee, fee)
+	case transaction.TransactionType == models.TransactionSwap:
+		entry = q.qifEntry(transaction, "Sell", transaction.Coin, transaction.Amount, value, value-fee, fee) +
+			q.qifEntry(transaction, "Buy", transaction.ToCoin, transaction.ToAmount, value, value, 0)
+	case models.IsIncomeType(transaction.TransactionType):
+		// Thu nhập nhận bằng coin được ghi là nhận thêm coin với giá trị thị trường lúc nhận
+		entry = q.qifEntry(transaction, "ShrsIn", transaction.Coin, transaction.Amount, value, value, 0)
+	case transaction.TransactionType == models.TransactionWithdrawal:
+		entry = q.qifEntry(transaction, "ShrsOut", transaction.Coin, transaction.Amount, 0, 0, fee)
+	default:
+		entry = q.qifEntry(transaction, "ShrsIn", transaction.Coin, transaction.Amount, 0, 0, fee)
+	}
+	_, err := io.WriteString(q.w, entry)
+	return err
+}
+
+func (q *qifTransactionWriter) end() error { return nil }
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// iso4217Currencies là danh sách mã tiền tệ ISO-4217 đang lưu hành
+var iso4217Currencies = toCurrencySet(`
+AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL
+BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP
+ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL HTG HUF IDR ILS INR
+IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL
+LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR
+NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD
+SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX
+USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL
+`)
+
+func toCurrencySet(codes string) map[string]bool {
+	set := make(map[string]bool)
+	for _, code := range strings.Fields(codes) {
+		set[code] = true
+	}
+	return set
+}
+
+// IsSupportedCurrency kiểm tra mã tiền tệ có phải là mã ISO-4217 hợp lệ hay không
+func IsSupportedCurrency(code string) bool {
+	return iso4217Currencies[normalizeSymbol(code)]
+}
+
+// NormalizeCurrency chuẩn hóa mã tiền tệ và trả về CustomError nếu mã không hợp lệ
+func NormalizeCurrency(code string) (string, error) {
+	code = normalizeSymbol(code)
+	if !IsSupportedCurrency(code) {
+		return "", &CustomError{Code: "UNSUPPORTED_CURRENCY", Message: fmt.Sprintf("Currency %s is not a supported ISO-4217 code.", code)}
+	}
+	return code, nil
+}
+
+// ConvertFiat quy đổi một số tiền giữa hai loại tiền pháp định theo tỷ giá hiện tại
+func ConvertFiat(amount float64, from, to string) (float64, error) {
+	rate, err := GetFiatRate(from, to)
+	if err != nil {
+		return 0, err
+	}
+	return amount * rate, nil
+}
+
+// GetFiatRatesFrom trả về tỷ giá từ base sang từng loại tiền trong quotes
+func GetFiatRatesFrom(base string, quotes []string) (map[string]float64, error) {
+	rates := make(map[string]float64, len(quotes))
+	for _, quote := range quotes {
+		rate, err := GetFiatRate(base, quote)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s to %s rate: %v", base, quote, err)
+		}
+		rates[normalizeSymbol(quote)] = rate
+	}
+	return rates, nil
+}
+
+// GetUserCurrencies trả về tiền tệ cơ sở và danh sách tiền tệ hiển thị của người dùng
+func GetUserCurrencies(userID primitive.ObjectID) (string, []string, error) {
+	user, err := GetUser(userID)
+	if err != nil {
+		return "", nil, err
+	}
+	return user.GetBaseCurrency(), user.GetDisplayCurrencies(), nil
+}
+
+// UpdateUserCurrencies kiểm tra và lưu tiền tệ cơ sở và tiền tệ hiển thị của người dùng
+func UpdateUserCurrencies(userID primitive.ObjectID, baseCurrency string, displayCurrencies []string) (string, []string, error) {
+	base, err := NormalizeCurrency(baseCurrency)
+	if err != nil {
+		return "", nil, err
+	}
+
+	display := make([]string, 0, len(displayCurrencies))
+	for _, code := range displayCurrencies {
+		normalized, err := NormalizeCurrency(code)
+		if err != nil {
+			return "", nil, err
+		}
+		display = append(display, normalized)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"base_currency":      base,
+		"display_currencies": display,
+		"updated_at":         time.Now(),
+	}}
+	if _, err := configs.GetCollection("users").UpdateOne(ctx, bson.M{"_id": userID}, update); err != nil {
+		return "", nil, fmt.Errorf("error updating currencies: %v", err)
+	}
+
+	user := models.User{BaseCurrency: base, DisplayCurrencies: display}
+	return user.GetBaseCurrency(), user.GetDisplayCurrencies(), nil
+}
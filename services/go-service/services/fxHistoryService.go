@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultHistoricalFXURL = "https://api.frankfurter.app"
+
+// stablecoinPegs ánh xạ stablecoin sang tiền pháp định mà nó neo giá
+var stablecoinPegs = map[string]string{
+	"USDT":  "USD",
+	"USDC":  "USD",
+	"BUSD":  "USD",
+	"DAI":   "USD",
+	"TUSD":  "USD",
+	"FDUSD": "USD",
+}
+
+// errNoHistoricalRate cho biết không tìm được tỷ giá fiat của ngày cần tính. Tỷ giá hiện tại không được
+// dùng thay vì sẽ bị lưu vào giao dịch như tỷ giá tại ngày giao dịch và làm sai giá vốn
+var errNoHistoricalRate = errors.New("no historical rate")
+
+// currencySymbolPattern giới hạn ký hiệu hợp lệ cho đồng tiền định giá (fiat hoặc coin)
+var currencySymbolPattern = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// resolvePeg trả về tiền pháp định tương đương nếu code là stablecoin
+func resolvePeg(code string) string {
+	if fiat, ok := stablecoinPegs[code]; ok {
+		return fiat
+	}
+	return code
+}
+
+// startOfDay trả về 00:00 UTC của ngày chứa t
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// GetHistoricalRate trả về số đơn vị to nhận được cho 1 đơn vị from tại ngày date.
+// from và to có thể là tiền pháp định, stablecoin hoặc coin; coin được quy đổi qua USD
+func GetHistoricalRate(from, to string, date time.Time) (float64, error) {
+	from, to = resolvePeg(normalizeSymbol(from)), resolvePeg(normalizeSymbol(to))
+	if from == to {
+		return 1, nil
+	}
+	day := startOfDay(date)
+
+	fromFiat, toFiat := IsSupportedCurrency(from), IsSupportedCurrency(to)
+	switch {
+	case fromFiat && toFiat:
+		return historicalFiatRate(from, to, day)
+	case !fromFiat:
+		priceUSD, err := historicalCryptoPrice(from, day)
+		if err != nil {
+			return 0, err
+		}
+		usdRate, err := GetHistoricalRate("USD", to, day)
+		if err != nil {
+			return 0, err
+		}
+		return priceUSD * usdRate, nil
+	default:
+		inverse, err := GetHistoricalRate(to, from, day)
+		if err != nil {
+			return 0, err
+		}
+		if inverse == 0 {
+			return 0, fmt.Errorf("invalid %s/%s rate", to, from)
+		}
+		return 1 / inverse, nil
+	}
+}
+
+// findStoredRate tìm tỷ giá đã lưu trong bảng fx_rates
+func findStoredRate(base, quote string, day time.Time) (float64, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var stored models.FXRate
+	filter := bson.M{"base": base, "quote": quote, "date": day}
+	if err := configs.GetCollection("fx_rates").FindOne(ctx, filter).Decode(&stored); err != nil {
+		return 0, false
+	}
+	return stored.Rate, true
+}
+
+// storeRate lưu tỷ giá của một ngày đã kết thúc vào bảng fx_rates
+func storeRate(base, quote string, day time.Time, rate float64, source string) {
+	// Không lưu tỷ giá của ngày hôm nay vì giá trị còn thay đổi
+	if !day.Before(startOfDay(time.Now())) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"base": base, "quote": quote, "date": day}
+	update := bson.M{
+		"$set":         bson.M{"rate": rate, "source": source},
+		"$setOnInsert": bson.M{"created_at": time.Now()},
+	}
+	_, err := configs.GetCollection("fx_rates").UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("Warning: could not store %s/%s rate: %v", base, quote, err)
+	}
+}
+
+// historicalFiatRate lấy tỷ giá fiat theo ngày từ bảng fx_rates hoặc API tỷ giá lịch sử (Frankfurter).
+// Khi API lỗi hoặc không hỗ trợ cặp tiền, lỗi trả về bọc errNoHistoricalRate
+func historicalFiatRate(base, quote string, day time.Time) (float64, error) {
+	if rate, ok := findStoredRate(base, quote, day); ok {
+		return rate, nil
+	}
+	if !day.Before(startOfDay(time.Now())) {
+		return GetFiatRate(base, quote)
+	}
+
+	baseURL := os.Getenv("HISTORICAL_FX_URL")
+	if baseURL == "" {
+		baseURL = defaultHistoricalFXURL
+	}
+	var data struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	url := fmt.Sprintf("%s/%s?from=%s&to=%s", strings.TrimRight(baseURL, "/"), day.Format("2006-01-02"), base, quote)
+	if err := getJSON(url, &data); err == nil {
+		if rate, ok := data.Rates[quote]; ok {
+			storeRate(base, quote, day, rate, "frankfurter")
+			return rate, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w for %s/%s on %s", errNoHistoricalRate, base, quote, day.Format("2006-01-02"))
+}
+
+// historicalCryptoPrice lấy giá đóng cửa theo USD của coin tại ngày day
+func historicalCryptoPrice(symbol string, day time.Time) (float64, error) {
+	if rate, ok := findStoredRate(symbol, "USD", day); ok {
+		return rate, nil
+	}
+	if !day.Before(startOfDay(time.Now())) {
+		quotes, err := GetPrices([]string{symbol})
+		if err != nil {
+			return 0, err
+		}
+		return quotes[symbol].Price, nil
+	}
+
+	quote, err := fetchHistoricalPriceFromChain(symbol, day)
+	if err != nil {
+		return 0, err
+	}
+	storeRate(symbol, "USD", day, quote.Price, quote.Source)
+	return quote.Price, nil
+}
+
+// PopulateTransactionFX chuẩn hóa đồng tiền định giá của giao dịch và ghi lại tỷ giá
+// tại ngày giao dịch sang USD, các tiền tệ trong currencies và chính đồng tiền định giá.
+// Tỷ giá do người dùng gửi kèm trong fx_rates được giữ nguyên. Tiền tệ hiển thị không có tỷ giá
+// lịch sử được bỏ qua (giá trị được quy đổi từ USD khi hiển thị); thiếu tỷ giá USD là lỗi
+func PopulateTransactionFX(transaction *models.Transaction, currencies []string) error {
+	quote := normalizeSymbol(transaction.GetQuoteCurrency())
+	if !currencySymbolPattern.MatchString(quote) {
+		return &CustomError{Code: "INVALID_QUOTE_CURRENCY", Message: fmt.Sprintf("Quote currency %s is not valid.", quote)}
+	}
+	transaction.QuoteCurrency = quote
+
+	// Thu nhập không có giá được định giá theo giá thị trường của coin tại ngày nhận
+	if models.IsIncomeType(transaction.TransactionType) && transaction.Price == 0 {
+		price, err := GetHistoricalRate(transaction.Coin, quote, transaction.Date)
+		if err != nil {
+			return fmt.Errorf("error fetching %s price: %v", transaction.Coin, err)
+		}
+		transaction.Price = price
+	}
+
+	rates, err := clientRates(transaction.FXRates, "fx_rates")
+	if err != nil {
+		return err
+	}
+
+	targets := append([]string{"USD", quote}, currencies...)
+	if err := fillHistoricalRates(rates, quote, targets, transaction.Date); err != nil {
+		return err
+	}
+	transaction.FXRates = rates
+	return populateFeeRates(transaction, targets)
+}
+
+// populateFeeRates chuẩn hóa đồng tiền trả phí và ghi lại tỷ giá của nó tại ngày giao dịch
+// khi phí được trả bằng tài sản khác với đồng định giá và coin giao dịch
+func populateFeeRates(transaction *models.Transaction, targets []string) error {
+	if transaction.FeeAmount < 0 {
+		return &CustomError{Code: "INVALID_FEE_AMOUNT", Message: "The fee amount cannot be negative."}
+	}
+	if transaction.FeeAmount == 0 {
+		transaction.FeeCurrency, transaction.FeeRates = "", nil
+		return nil
+	}
+	feeCurrency := normalizeSymbol(transaction.GetFeeCurrency())
+	if !currencySymbolPattern.MatchString(feeCurrency) {
+		return &CustomError{Code: "INVALID_FEE_CURRENCY", Message: fmt.Sprintf("Fee currency %s is not valid.", feeCurrency)}
+	}
+	transaction.FeeCurrency = feeCurrency
+	if transaction.FeeInQuote() || transaction.FeeInCoin() {
+		transaction.FeeRates = nil
+		return nil
+	}
+
+	rates, err := clientRates(transaction.FeeRates, "fee_rates")
+	if err != nil {
+		return err
+	}
+	if err := fillHistoricalRates(rates, feeCurrency, targets, transaction.Date); err != nil {
+		return err
+	}
+	transaction.FeeRates = rates
+	return nil
+}
+
+// clientRates chuẩn hóa tỷ giá do người dùng gửi kèm (field là tên trường để báo lỗi) và từ chối
+// tỷ giá không dương, NaN hoặc vô cực
+func clientRates(supplied map[string]float64, field string) (map[string]float64, error) {
+	rates := make(map[string]float64, len(supplied)+4)
+	for currency, rate := range supplied {
+		if rate <= 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+			return nil, &CustomError{Code: "INVALID_FX_RATE", Message: fmt.Sprintf("The %s rate for %s must be a positive number.", field, currency)}
+		}
+		rates[normalizeSymbol(currency)] = rate
+	}
+	return rates, nil
+}
+
+// fillHistoricalRates thêm vào rates tỷ giá từ from sang từng tiền tệ trong targets tại ngày date.
+// Thiếu tỷ giá lịch sử của USD là lỗi vì giá vốn luôn được tính theo USD; tiền tệ khác thì được bỏ qua
+func fillHistoricalRates(rates map[string]float64, from string, targets []string, date time.Time) error {
+	for _, currency := range targets {
+		currency = normalizeSymbol(currency)
+		if _, ok := rates[currency]; ok {
+			continue
+		}
+		rate, err := GetHistoricalRate(from, currency, date)
+		if errors.Is(err, errNoHistoricalRate) {
+			if currency == "USD" {
+				return &CustomError{Code: "MISSING_FX_RATE", Message: fmt.Sprintf("No historical %s/USD rate is available for this date. Provide it in fx_rates.", from)}
+			}
+			log.Printf("Warning: %v, %s values will be converted from USD", err, currency)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error fetching %s/%s rate: %v", from, currency, err)
+		}
+		rates[currency] = rate
+	}
+	return nil
+}
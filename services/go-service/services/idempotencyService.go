@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultIdempotencyWindow là thời gian một Idempotency-Key được ghi nhớ (IDEMPOTENCY_KEY_TTL)
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyLockTimeout là thời gian tối đa một yêu cầu được giữ trạng thái processing mà không gia hạn.
+// Yêu cầu đang chạy (ví dụ import nhiều dòng) gia hạn khóa mỗi idempotencyLockRefresh qua KeepIdempotencyLock,
+// nên key chỉ được dùng lại khi lần xử lý đã dừng (ví dụ server bị dừng giữa chừng)
+const (
+	idempotencyLockTimeout = time.Minute
+	idempotencyLockRefresh = idempotencyLockTimeout / 4
+)
+
+// maxIdempotencyKeyLength giới hạn độ dài của header Idempotency-Key
+const maxIdempotencyKeyLength = 255
+
+// BeginIdempotentRequest đánh dấu key đang được xử lý cho người dùng. Trả về bản ghi đã hoàn thành
+// nếu key đã được dùng với cùng yêu cầu (để trả lại phản hồi cũ), hoặc nil kèm lock token nếu yêu cầu
+// cần được xử lý; token được truyền lại cho CompleteIdempotentRequest hoặc AbandonIdempotentRequest.
+// Trả về CustomError nếu key đang được xử lý hay đã dùng cho một yêu cầu khác
+func BeginIdempotentRequest(userID primitive.ObjectID, key, requestHash string) (*models.IdempotencyRecord, primitive.ObjectID, error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, primitive.NilObjectID, &CustomError{Code: "INVALID_IDEMPOTENCY_KEY", Message: fmt.Sprintf("Idempotency-Key must be at most %d characters.", maxIdempotencyKeyLength)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collection := configs.GetCollection("idempotency_keys")
+
+	now := time.Now()
+	record := models.IdempotencyRecord{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: requestHash,
+		Status:      models.IdempotencyProcessing,
+		LockToken:   primitive.NewObjectID(),
+		LockedAt:    now,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(durationFromEnv("IDEMPOTENCY_KEY_TTL", defaultIdempotencyWindow)),
+	}
+	_, err := collection.InsertOne(ctx, record)
+	if err == nil {
+		return nil, record.LockToken, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, primitive.NilObjectID, fmt.Errorf("error saving idempotency key: %v", err)
+	}
+
+	var existing models.IdempotencyRecord
+	if err := collection.FindOne(ctx, bson.M{"user_id": userID, "key": key}).Decode(&existing); err != nil {
+		return nil, primitive.NilObjectID, fmt.Errorf("error fetching idempotency key: %v", err)
+	}
+
+	// Bản ghi hết hạn nhưng chưa bị TTL index xóa, hoặc bị kẹt ở trạng thái processing: thay bằng yêu cầu mới
+	stale := existing.Status == models.IdempotencyProcessing && now.Sub(existing.LockedAt) > idempotencyLockTimeout
+	if now.After(existing.ExpiresAt) || stale {
+		filter := bson.M{"_id": existing.ID, "status": existing.Status, "lock_token": existing.LockToken, "locked_at": existing.LockedAt}
+		result, err := collection.ReplaceOne(ctx, filter, record)
+		if err != nil {
+			return nil, primitive.NilObjectID, fmt.Errorf("error saving idempotency key: %v", err)
+		}
+		if result.ModifiedCount == 1 {
+			return nil, record.LockToken, nil
+		}
+		return nil, primitive.NilObjectID, &CustomError{Code: "IDEMPOTENCY_KEY_IN_PROGRESS", Message: "A request with this Idempotency-Key is still being processed."}
+	}
+
+	if existing.RequestHash != requestHash {
+		return nil, primitive.NilObjectID, &CustomError{Code: "IDEMPOTENCY_KEY_REUSED", Message: "This Idempotency-Key was already used for a different request."}
+	}
+	if existing.Status != models.IdempotencyCompleted {
+		return nil, primitive.NilObjectID, &CustomError{Code: "IDEMPOTENCY_KEY_IN_PROGRESS", Message: "A request with this Idempotency-Key is still being processed."}
+	}
+	return &existing, primitive.NilObjectID, nil
+}
+
+// KeepIdempotencyLock gia hạn khóa của key theo chu kỳ trong khi yêu cầu đang được xử lý, để yêu cầu chạy lâu
+// không bị một lần gửi lại cùng key chiếm khóa và xử lý song song. Gọi hàm stop trả về khi xử lý xong
+func KeepIdempotencyLock(userID primitive.ObjectID, key string, lock primitive.ObjectID) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(idempotencyLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := refreshIdempotencyLock(userID, key, lock); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// refreshIdempotencyLock cập nhật locked_at của key khi lần xử lý có lock token lock vẫn đang giữ key
+func refreshIdempotencyLock(userID primitive.ObjectID, key string, lock primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "key": key, "lock_token": lock, "status": models.IdempotencyProcessing}
+	if _, err := configs.GetCollection("idempotency_keys").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"locked_at": time.Now()}}); err != nil {
+		return fmt.Errorf("error refreshing idempotency key: %v", err)
+	}
+	return nil
+}
+
+// CompleteIdempotentRequest lưu phản hồi của yêu cầu để các lần gửi lại cùng key nhận đúng phản hồi này.
+// Bản ghi chỉ được cập nhật khi vẫn do lần xử lý có lock token lock giữ (chưa bị yêu cầu khác thay thế)
+func CompleteIdempotentRequest(userID primitive.ObjectID, key string, lock primitive.ObjectID, statusCode int, contentType string, response []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"status":       models.IdempotencyCompleted,
+		"status_code":  statusCode,
+		"content_type": contentType,
+		"response":     response,
+	}}
+	filter := bson.M{"user_id": userID, "key": key, "lock_token": lock, "status": models.IdempotencyProcessing}
+	result, err := configs.GetCollection("idempotency_keys").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error saving idempotent response: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("idempotency key %q was taken over by another request before the response was saved", key)
+	}
+	return nil
+}
+
+// AbandonIdempotentRequest xóa key khi yêu cầu không được áp dụng (lỗi phía server, xung đột...) để người dùng
+// có thể thử lại với cùng key. Chỉ bản ghi còn do lần xử lý có lock token lock giữ mới bị xóa
+func AbandonIdempotentRequest(userID primitive.ObjectID, key string, lock primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "key": key, "lock_token": lock, "status": models.IdempotencyProcessing}
+	if _, err := configs.GetCollection("idempotency_keys").DeleteOne(ctx, filter); err != nil {
+		return fmt.Errorf("error releasing idempotency key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxImportRows giới hạn số dòng dữ liệu của một file import
+const maxImportRows = 5000
+
+// Trạng thái của từng dòng trong kết quả import
+const (
+	ImportRowReady     = "ready"     // Hợp lệ, sẽ được import (dry-run)
+	ImportRowImported  = "imported"  // Đã được ghi vào sổ giao dịch
+	ImportRowDuplicate = "duplicate" // Trùng với giao dịch đã có hoặc dòng trước đó trong file
+	ImportRowSkipped   = "skipped"   // Không thay đổi danh mục coin (nạp/rút tiền pháp định...)
+	ImportRowError     = "error"
+)
+
+// ImportRow là kết quả xử lý một dòng của file import. Row là số dòng trong file (bắt đầu từ 1)
+type ImportRow struct {
+	Row         int                 `json:"row"`
+	Status      string              `json:"status"`
+	Code        string              `json:"code,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	Transaction *models.Transaction `json:"transaction,omitempty"`
+}
+
+// ImportResult là báo cáo của một lần import: số dòng theo trạng thái và chi tiết từng dòng
+type ImportResult struct {
+	Source      string             `json:"source"`
+	Format      string             `json:"format"`
+	PortfolioID primitive.ObjectID `json:"portfolio_id"`         // Danh mục nhận các giao dịch được import
+	AccountID   primitive.ObjectID `json:"account_id,omitempty"` // Tài khoản (sàn, ví) được gắn vào mọi giao dịch được import
+	DryRun      bool               `json:"dry_run"`
+	Total       int                `json:"total"`
+	Ready       int                `json:"ready"`
+	Imported    int                `json:"imported"`
+	Duplicates  int                `json:"duplicates"`
+	Skipped     int                `json:"skipped"`
+	Failed      int                `json:"failed"`
+	Rows        []ImportRow        `json:"rows"`
+}
+
+// ImportTransactions đọc file CSV export của sàn exchange và ghi các giao dịch vào danh mục portfolioID
+// của người dùng (danh mục mặc định nếu trống), gắn với tài khoản accountID nếu có. Với dryRun, file chỉ
+// được kiểm tra và trả về bản xem trước mà không ghi gì vào cơ sở dữ liệu
+func ImportTransactions(userID, portfolioID, accountID primitive.ObjectID, exchange string, file io.Reader, dryRun bool) (*ImportResult, error) {
+	if !IsSupportedExchange(exchange) {
+		return nil, &CustomError{Code: "UNSUPPORTED_EXCHANGE", Message: fmt.Sprintf("Import from %q is not supported.", exchange)}
+	}
+	records, err := readImportCSV(file, ',')
+	if err != nil {
+		return nil, err
+	}
+	format, headerIndex, header, err := detectImportFormat(exchange, records)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{Source: exchange, Format: format.name, PortfolioID: portfolioID, AccountID: accountID, DryRun: dryRun}
+	if err := parseImportRows(result, format, records, headerIndex, header); err != nil {
+		return nil, err
+	}
+	if err := processImport(userID, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseImportRows chuyển các dòng dữ liệu sau dòng header thành các dòng kết quả import
+func parseImportRows(result *ImportResult, format *importFormat, records [][]string, headerIndex int, header []string) error {
+	for index := headerIndex + 1; index < len(records); index++ {
+		if isBlankRecord(records[index]) {
+			continue
+		}
+		row := ImportRow{Row: index + 1}
+		record := make(importRecord, len(header))
+		for column, name := range header {
+			if column < len(records[index]) {
+				record[name] = records[index][column]
+			}
+		}
+		transaction, err := format.parse(record)
+		switch {
+		case errors.Is(err, errSkipRow):
+			row.Status = ImportRowSkipped
+		case err != nil:
+			setImportRowError(&row, err)
+		default:
+			transaction.Source = result.Source
+			row.Status, row.Transaction = ImportRowReady, transaction
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if len(result.Rows) > maxImportRows {
+		return &CustomError{Code: "IMPORT_TOO_LARGE", Message: fmt.Sprintf("An import can contain at most %d rows.", maxImportRows)}
+	}
+	return nil
+}
+
+// readImportCSV đọc toàn bộ file CSV, chấp nhận số cột khác nhau giữa các dòng (phần mô tả trước header)
+func readImportCSV(file io.Reader, delimiter rune) ([][]string, error) {
+	reader := csv.NewReader(file)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, &CustomError{Code: "INVALID_IMPORT_FILE", Message: fmt.Sprintf("The file could not be read as CSV: %v", err)}
+	}
+	return records, nil
+}
+
+// isBlankRecord kiểm tra dòng không có dữ liệu
+func isBlankRecord(record []string) bool {
+	for _, value := range record {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// setImportRowError đánh dấu dòng bị lỗi, giữ mã lỗi nếu err là CustomError
+func setImportRowError(row *ImportRow, err error) {
+	row.Status, row.Error = ImportRowError, err.Error()
+	if customErr, ok := err.(*CustomError); ok {
+		row.Code = customErr.Code
+	} else {
+		row.Code = "INVALID_ROW"
+	}
+}
+
+// processImport kiểm tra các dòng đã đọc theo cùng luồng với AddTransaction, đánh dấu các dòng trùng,
+// thử replay sổ giao dịch của danh mục result.PortfolioID cùng các giao dịch mới rồi ghi chúng
+// (trừ khi result.DryRun)
+func processImport(userID primitive.ObjectID, result *ImportResult) error {
+	user, err := GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("error fetching user: %v", err)
+	}
+	target, err := writablePortfolio(userID, result.PortfolioID)
+	if err != nil {
+		return err
+	}
+	result.PortfolioID = target.ID
+	if !result.AccountID.IsZero() {
+		check := &models.Transaction{PortfolioID: target.ID, AccountID: result.AccountID}
+		if err := checkAccounts(userID, check); err != nil {
+			return err
+		}
+	}
+	_, currencies, err := GetUserCurrencies(userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range result.Rows {
+		row := &result.Rows[i]
+		if row.Status != ImportRowReady {
+			continue
+		}
+		if err := ValidateTransaction(row.Transaction); err != nil {
+			setImportRowError(row, err)
+			continue
+		}
+		row.Transaction.PortfolioID = target.ID
+		row.Transaction.AccountID = result.AccountID
+	}
+	if err := markDuplicates(userID, result.Rows); err != nil {
+		return err
+	}
+
+	// Dòng mới được chuẩn bị như ở AddTransaction (kể cả khi dry run) để kết quả xem trước khớp với
+	// lần ghi thật. Tỷ giá tại ngày giao dịch được lấy ngoài transaction MongoDB
+	for i := range result.Rows {
+		row := &result.Rows[i]
+		if row.Status != ImportRowReady {
+			continue
+		}
+		if err := PrepareTransaction(userID, row.Transaction, currencies); err != nil {
+			setImportRowError(row, err)
+		}
+	}
+
+	method := user.GetCostBasisMethod()
+	if result.DryRun {
+		ctx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+		defer cancel()
+		ledger, err := loadLedger(ctx, userID, target.ID)
+		if err != nil {
+			return err
+		}
+		if _, err := simulateImport(&models.Portfolio{ID: target.ID, UserID: userID}, ledger, result.Rows, method); err != nil {
+			return err
+		}
+		countImportRows(result)
+		return nil
+	}
+
+	imported := make(map[primitive.ObjectID]bool)
+	importedIDs := []primitive.ObjectID{}
+	for _, row := range result.Rows {
+		if row.Status == ImportRowReady {
+			imported[row.Transaction.ID] = true
+			importedIDs = append(importedIDs, row.Transaction.ID)
+		}
+	}
+	err = updateLedger(userID, target.ID, func(ctx context.Context, portfolio *models.Portfolio) error {
+		ledger, err := loadLedger(ctx, userID, portfolio.ID)
+		if err != nil {
+			return err
+		}
+		// Bỏ các dòng đã được ghi bởi một lần thử trước để không tính hai lần
+		ledger = excludeTransactions(ledger, imported)
+		transactions, err := simulateImport(portfolio, ledger, result.Rows, method)
+		if err != nil {
+			return err
+		}
+
+		var writes []mongo.WriteModel
+		existing := make([]models.Transaction, 0, len(ledger))
+		for _, transaction := range transactions {
+			if !imported[transaction.ID] {
+				existing = append(existing, transaction)
+				continue
+			}
+			// Ghi theo _id để lần thử lại không tạo bản ghi trùng
+			writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": transaction.ID, "user_id": userID}).SetReplacement(transaction).SetUpsert(true))
+		}
+		if len(writes) > 0 {
+			registerLedgerUndo(ctx, func(ctx context.Context) error {
+				_, err := configs.GetCollection("transactions").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": importedIDs}, "user_id": userID})
+				return err
+			})
+			if _, err := configs.GetCollection("transactions").BulkWrite(ctx, writes); err != nil {
+				return fmt.Errorf("error saving imported transactions: %v", err)
+			}
+		}
+		return saveLedgerFields(ctx, existing)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range result.Rows {
+		if result.Rows[i].Status == ImportRowReady {
+			result.Rows[i].Status = ImportRowImported
+		}
+	}
+	countImportRows(result)
+	return nil
+}
+
+// importFingerprint là khóa nhận diện giao dịch trùng khi sàn không cung cấp ID giao dịch
+func importFingerprint(transaction *models.Transaction) string {
+	return fmt.Sprintf("%s|%s|%.8f|%.8f|%.8f|%d", transaction.TransactionType, transaction.Coin, transaction.Amount,
+		transaction.Price, transaction.Amount*transaction.Price, transaction.Date.Unix())
+}
+
+// importExternalKey là khóa nhận diện giao dịch theo ID phía sàn
+func importExternalKey(transaction *models.Transaction) string {
+	if transaction.ExternalID == "" {
+		return ""
+	}
+	return transaction.Source + ":" + transaction.ExternalID
+}
+
+// markDuplicates đánh dấu các dòng trùng với giao dịch đã có (completed hoặc void) của người dùng
+// hoặc với một dòng trước đó trong cùng file theo ID phía sàn. Dòng không có ID phía sàn được so
+// theo loại, coin, số lượng, giá và thời gian; các lệnh khớp từng phần giống hệt nhau là giao dịch
+// thật nên số lần xuất hiện được đếm ở cả hai phía: chỉ những dòng vượt quá số giao dịch đã có mới được ghi
+func markDuplicates(userID primitive.ObjectID, rows []ImportRow) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "status": bson.M{"$in": bson.A{models.StatusCompleted, models.StatusVoid}}}
+	projection := bson.M{"transaction_type": 1, "coin": 1, "amount": 1, "price": 1, "date": 1, "source": 1, "external_id": 1}
+	cursor, err := configs.GetCollection("transactions").Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return fmt.Errorf("error fetching transactions: %v", err)
+	}
+	var existing []models.Transaction
+	if err := cursor.All(ctx, &existing); err != nil {
+		return fmt.Errorf("error decoding transactions: %v", err)
+	}
+
+	fingerprints := make(map[string]int, len(existing))
+	externals := make(map[string]bool, len(existing))
+	for i := range existing {
+		if key := importExternalKey(&existing[i]); key != "" {
+			externals[key] = true
+		}
+		fingerprints[importFingerprint(&existing[i])]++
+	}
+	for i := range rows {
+		row := &rows[i]
+		if row.Status != ImportRowReady {
+			continue
+		}
+		if external := importExternalKey(row.Transaction); external != "" {
+			if externals[external] {
+				row.Status = ImportRowDuplicate
+			}
+			externals[external] = true
+			continue
+		}
+		fingerprint := importFingerprint(row.Transaction)
+		if fingerprints[fingerprint] > 0 {
+			fingerprints[fingerprint]--
+			row.Status = ImportRowDuplicate
+		}
+	}
+	return nil
+}
+
+// simulateImport replay sổ giao dịch hiện tại cùng các dòng ready vào portfolio. Dòng làm replay thất bại
+// (ví dụ bán vượt số lượng đang giữ) được đánh dấu lỗi và bị loại, rồi replay lại từ đầu.
+// Trả về toàn bộ giao dịch đã replay, gồm cả giao dịch mới với các trường suy ra đã được tính
+func simulateImport(portfolio *models.Portfolio, ledger []models.Transaction, rows []ImportRow, method string) ([]models.Transaction, error) {
+	for {
+		pending := make(map[primitive.ObjectID]*ImportRow)
+		transactions := make([]models.Transaction, 0, len(ledger)+len(rows))
+		transactions = append(transactions, ledger...)
+		for i := range rows {
+			if rows[i].Status == ImportRowReady {
+				pending[rows[i].Transaction.ID] = &rows[i]
+				transactions = append(transactions, *rows[i].Transaction)
+			}
+		}
+
+		portfolio.CoinHoldings = make(map[string]models.CoinHolding)
+		portfolio.AccountHoldings = make(map[string]map[string]models.CoinHolding)
+		portfolio.RealizedPL = nil
+		portfolio.Income = nil
+		sortTransactions(transactions)
+
+		var failed *ImportRow
+		for i := range transactions {
+			err := applyTransaction(portfolio, &transactions[i], method)
+			if err == nil {
+				continue
+			}
+			row, ok := pending[transactions[i].ID]
+			if !ok {
+				return nil, &CustomError{Code: "IMPORT_CONFLICTS_WITH_LEDGER", Message: fmt.Sprintf("Your existing transactions cannot be replayed: %v", err)}
+			}
+			setImportRowError(row, err)
+			failed = row
+			break
+		}
+		if failed != nil {
+			continue
+		}
+
+		for i := range transactions {
+			if row, ok := pending[transactions[i].ID]; ok {
+				transaction := transactions[i]
+				row.Transaction = &transaction
+			}
+		}
+		return transactions, nil
+	}
+}
+
+// countImportRows đếm số dòng theo trạng thái
+func countImportRows(result *ImportResult) {
+	result.Total = len(result.Rows)
+	result.Ready, result.Imported, result.Duplicates, result.Skipped, result.Failed = 0, 0, 0, 0, 0
+	for _, row := range result.Rows {
+		switch row.Status {
+		case ImportRowReady:
+			result.Ready++
+		case ImportRowImported:
+			result.Imported++
+		case ImportRowDuplicate:
+			result.Duplicates++
+		case ImportRowSkipped:
+			result.Skipped++
+		case ImportRowError:
+			result.Failed++
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// customImportSource là nguồn của các giao dịch được import bằng template tùy chỉnh
+const customImportSource = "custom"
+
+// dateFormatTokens chuyển định dạng ngày quen thuộc (YYYY-MM-DD HH:mm:ss) sang layout của Go.
+// Token dài hơn được đặt trước để YYYY không bị thay thành hai lần YY
+var dateFormatTokens = strings.NewReplacer(
+	"YYYY", "2006", "YY", "06",
+	"MM", "01", "DD", "02",
+	"HH", "15", "hh", "03", "mm", "04", "ss", "05",
+	"SSS", "000",
+)
+
+// Giới hạn giải nén file XLSX của template: file nén nhỏ vẫn có thể bung ra rất lớn (zip bomb)
+const (
+	maxTemplateUnzipSize    = 100 << 20
+	maxTemplateUnzipXMLSize = 16 << 20
+)
+
+// thousandsGroupedPattern là số dùng dấu phẩy phân tách hàng nghìn đúng từng nhóm 3 chữ số, ví dụ "1,234.5"
+var thousandsGroupedPattern = regexp.MustCompile(`^[-+]?[0-9]{1,3}(,[0-9]{3})+(\.[0-9]*)?([eE][-+]?[0-9]+)?$`)
+
+// defaultDateLayouts là các layout được thử khi template không có DateFormat
+var defaultDateLayouts = []string{
+	time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02",
+	"2006/01/02 15:04:05", "2006/01/02 15:04", "2006/01/02",
+}
+
+// xlsxSignature là 4 byte đầu của file XLSX (file zip)
+var xlsxSignature = []byte("PK\x03\x04")
+
+// ValidateImportTemplate kiểm tra và chuẩn hóa template import
+func ValidateImportTemplate(template *models.ImportTemplate) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" {
+		return invalidImportTemplate("Specify a template name.")
+	}
+	columns := &template.Columns
+	for _, column := range []*string{&columns.Date, &columns.Type, &columns.Coin, &columns.Amount, &columns.Price,
+		&columns.Total, &columns.Currency, &columns.Fee, &columns.FeeCurrency, &columns.ExternalID} {
+		*column = strings.TrimSpace(*column)
+	}
+	if columns.Date == "" || columns.Coin == "" || columns.Amount == "" {
+		return invalidImportTemplate("Map the date, coin and amount columns.")
+	}
+
+	template.DefaultType = strings.ToLower(strings.TrimSpace(template.DefaultType))
+	if columns.Type == "" && template.DefaultType == "" {
+		return invalidImportTemplate("Map the type column or set a default type.")
+	}
+	if template.DefaultType != "" && !models.IsValidTransactionType(template.DefaultType) {
+		return invalidImportTemplate(fmt.Sprintf("Default type %q is not supported.", template.DefaultType))
+	}
+	typeMap := make(map[string]string, len(template.TypeMap))
+	for value, transactionType := range template.TypeMap {
+		transactionType = strings.ToLower(strings.TrimSpace(transactionType))
+		if !models.IsValidTransactionType(transactionType) {
+			return invalidImportTemplate(fmt.Sprintf("Type %q mapped from %q is not supported.", transactionType, value))
+		}
+		typeMap[strings.ToLower(strings.TrimSpace(value))] = transactionType
+	}
+	template.TypeMap = typeMap
+
+	if template.DefaultQuoteCurrency != "" {
+		template.DefaultQuoteCurrency = normalizeSymbol(template.DefaultQuoteCurrency)
+		if !currencySymbolPattern.MatchString(template.DefaultQuoteCurrency) {
+			return invalidImportTemplate(fmt.Sprintf("Quote currency %s is not valid.", template.DefaultQuoteCurrency))
+		}
+	}
+	if template.Timezone != "" {
+		if _, err := time.LoadLocation(template.Timezone); err != nil {
+			return invalidImportTemplate(fmt.Sprintf("Time zone %q is not valid.", template.Timezone))
+		}
+	}
+	if template.Delimiter != "" && utf8.RuneCountInString(template.Delimiter) != 1 {
+		return invalidImportTemplate("The delimiter must be a single character.")
+	}
+	return nil
+}
+
+// invalidImportTemplate trả về lỗi cho template import không hợp lệ
+func invalidImportTemplate(message string) error {
+	return &CustomError{Code: "INVALID_IMPORT_TEMPLATE", Message: message}
+}
+
+// ListImportTemplates trả về các template import của người dùng theo tên
+func ListImportTemplates(userID primitive.ObjectID) ([]models.ImportTemplate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := configs.GetCollection("import_templates").Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching import templates: %v", err)
+	}
+	templates := []models.ImportTemplate{}
+	if err := cursor.All(ctx, &templates); err != nil {
+		return nil, fmt.Errorf("error decoding import templates: %v", err)
+	}
+	return templates, nil
+}
+
+// GetImportTemplate lấy template import theo ID, chỉ khi template thuộc về người dùng userID
+func GetImportTemplate(userID primitive.ObjectID, id string) (*models.ImportTemplate, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, &CustomError{Code: "IMPORT_TEMPLATE_NOT_FOUND", Message: "Import template not found."}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var template models.ImportTemplate
+	err = configs.GetCollection("import_templates").FindOne(ctx, bson.M{"_id": objectID, "user_id": userID}).Decode(&template)
+	if err != nil {
+		return nil, &CustomError{Code: "IMPORT_TEMPLATE_NOT_FOUND", Message: "Import template not found."}
+	}
+	return &template, nil
+}
+
+// SaveImportTemplate tạo template mới hoặc cập nhật template id (nếu id khác rỗng) của người dùng.
+// Tên template là duy nhất theo người dùng
+func SaveImportTemplate(userID primitive.ObjectID, id string, template *models.ImportTemplate) error {
+	if err := ValidateImportTemplate(template); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collection := configs.GetCollection("import_templates")
+
+	now := time.Now()
+	template.UserID = userID
+	template.UpdatedAt = now
+	if id == "" {
+		template.ID = primitive.NewObjectID()
+		template.CreatedAt = now
+		_, err := collection.InsertOne(ctx, template)
+		return importTemplateWriteError(err)
+	}
+
+	existing, err := GetImportTemplate(userID, id)
+	if err != nil {
+		return err
+	}
+	template.ID = existing.ID
+	template.CreatedAt = existing.CreatedAt
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": existing.ID, "user_id": userID}, template)
+	return importTemplateWriteError(err)
+}
+
+// importTemplateWriteError chuyển lỗi trùng tên template thành CustomError
+func importTemplateWriteError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return &CustomError{Code: "IMPORT_TEMPLATE_EXISTS", Message: "An import template with this name already exists."}
+	} else if err != nil {
+		return fmt.Errorf("error saving import template: %v", err)
+	}
+	return nil
+}
+
+// DeleteImportTemplate xóa template import của người dùng
+func DeleteImportTemplate(userID primitive.ObjectID, id string) error {
+	template, err := GetImportTemplate(userID, id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := configs.GetCollection("import_templates").DeleteOne(ctx, bson.M{"_id": template.ID, "user_id": userID}); err != nil {
+		return fmt.Errorf("error deleting import template: %v", err)
+	}
+	return nil
+}
+
+// ImportWithTemplate đọc file CSV hoặc XLSX theo ánh xạ cột của template và ghi các giao dịch vào danh mục
+// portfolioID (tài khoản accountID nếu có) qua cùng luồng kiểm tra, phát hiện trùng và replay với import từ sàn
+func ImportWithTemplate(userID, portfolioID, accountID primitive.ObjectID, template *models.ImportTemplate, data []byte, dryRun bool) (*ImportResult, error) {
+	if err := ValidateImportTemplate(template); err != nil {
+		return nil, err
+	}
+	records, err := readTemplateFile(data, template)
+	if err != nil {
+		return nil, err
+	}
+
+	format := templateFormat(template)
+	headerIndex, header := -1, []string(nil)
+	for index, record := range records {
+		if index >= maxHeaderSearchRows {
+			break
+		}
+		if normalized := normalizeHeader(record, nil); hasColumns(normalized, format.required) {
+			headerIndex, header = index, normalized
+			break
+		}
+	}
+	if headerIndex < 0 {
+		return nil, &CustomError{Code: "INVALID_IMPORT_FILE", Message: fmt.Sprintf("The file does not contain the columns %s.", strings.Join(format.required, ", "))}
+	}
+
+	result := &ImportResult{Source: customImportSource, Format: template.Name, PortfolioID: portfolioID, AccountID: accountID, DryRun: dryRun}
+	if err := parseImportRows(result, format, records, headerIndex, header); err != nil {
+		return nil, err
+	}
+	if err := processImport(userID, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readTemplateFile đọc các dòng của file XLSX (nhận diện theo chữ ký zip) hoặc CSV
+func readTemplateFile(data []byte, template *models.ImportTemplate) ([][]string, error) {
+	if !bytes.HasPrefix(data, xlsxSignature) {
+		delimiter := ','
+		if template.Delimiter != "" {
+			delimiter, _ = utf8.DecodeRuneInString(template.Delimiter)
+		}
+		return readImportCSV(bytes.NewReader(data), delimiter)
+	}
+
+	// Giá trị thô giữ ngày ở dạng số serial của Excel thay vì chuỗi theo định dạng hiển thị
+	workbook, err := excelize.OpenReader(bytes.NewReader(data), excelize.Options{
+		RawCellValue:      true,
+		UnzipSizeLimit:    maxTemplateUnzipSize,
+		UnzipXMLSizeLimit: maxTemplateUnzipXMLSize,
+	})
+	if err != nil {
+		return nil, &CustomError{Code: "INVALID_IMPORT_FILE", Message: fmt.Sprintf("The file could not be read as XLSX: %v", err)}
+	}
+	defer workbook.Close()
+
+	sheet := template.Sheet
+	if sheet == "" {
+		sheet = workbook.GetSheetName(0)
+	}
+	records, err := workbook.GetRows(sheet)
+	if err != nil {
+		return nil, &CustomError{Code: "INVALID_IMPORT_FILE", Message: fmt.Sprintf("Sheet %q could not be read: %v", sheet, err)}
+	}
+	return records, nil
+}
+
+// templateFormat tạo định dạng import từ ánh xạ cột của template
+func templateFormat(template *models.ImportTemplate) *importFormat {
+	location := time.UTC
+	if template.Timezone != "" {
+		location, _ = time.LoadLocation(template.Timezone)
+	}
+	columns := template.Columns
+	column := func(name string) string {
+		return strings.ToLower(name)
+	}
+
+	required := []string{column(columns.Date), column(columns.Coin), column(columns.Amount)}
+	for _, optional := range []string{columns.Type, columns.Price, columns.Total, columns.Currency, columns.Fee, columns.FeeCurrency, columns.ExternalID} {
+		if optional != "" {
+			required = append(required, column(optional))
+		}
+	}
+
+	parse := func(record importRecord) (*models.Transaction, error) {
+		transactionType := template.DefaultType
+		if columns.Type != "" {
+			if value := strings.ToLower(record.get(column(columns.Type))); value != "" {
+				transactionType = value
+				if mapped, ok := template.TypeMap[value]; ok {
+					transactionType = mapped
+				}
+			}
+		}
+		date, err := parseTemplateDate(record.get(column(columns.Date)), template.DateFormat, location)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := parseTemplateNumber(record.get(column(columns.Amount)), template.DecimalComma)
+		if err != nil {
+			return nil, err
+		}
+
+		transaction := &models.Transaction{
+			Coin:            record.get(column(columns.Coin)),
+			TransactionType: transactionType,
+			Amount:          math.Abs(amount),
+			Date:            date,
+			QuoteCurrency:   template.DefaultQuoteCurrency,
+		}
+		if columns.Currency != "" {
+			if currency := record.get(column(columns.Currency)); currency != "" {
+				transaction.QuoteCurrency = currency
+			}
+		}
+		if columns.Price != "" {
+			if transaction.Price, err = parseTemplateNumber(record.get(column(columns.Price)), template.DecimalComma); err != nil {
+				return nil, err
+			}
+		}
+		if columns.Total != "" && transaction.Price == 0 && transaction.Amount > 0 {
+			total, err := parseTemplateNumber(record.get(column(columns.Total)), template.DecimalComma)
+			if err != nil {
+				return nil, err
+			}
+			transaction.Price = math.Abs(total) / transaction.Amount
+		}
+		if columns.Fee != "" {
+			fee, err := parseTemplateNumber(record.get(column(columns.Fee)), template.DecimalComma)
+			if err != nil {
+				return nil, err
+			}
+			transaction.FeeAmount = math.Abs(fee)
+		}
+		if columns.FeeCurrency != "" {
+			transaction.FeeCurrency = record.get(column(columns.FeeCurrency))
+		}
+		if columns.ExternalID != "" {
+			transaction.ExternalID = record.get(column(columns.ExternalID))
+		}
+		return transaction, nil
+	}
+	return &importFormat{name: template.Name, required: required, parse: parse}
+}
+
+// parseTemplateNumber đọc số theo cấu hình dấu thập phân của template
+func parseTemplateNumber(value string, decimalComma bool) (float64, error) {
+	if decimalComma {
+		value = strings.ReplaceAll(strings.ReplaceAll(value, ".", ""), ",", ".")
+	} else if strings.Contains(value, ",") {
+		// Dấu phẩy chỉ được chấp nhận khi phân tách hàng nghìn, "1,5" là số thập phân của file
+		// dùng dấu phẩy thập phân và bỏ dấu phẩy sẽ đọc thành 15
+		digits := strings.Map(func(r rune) rune {
+			if strings.ContainsRune("0123456789,.-+eE", r) {
+				return r
+			}
+			return -1
+		}, value)
+		if !thousandsGroupedPattern.MatchString(digits) {
+			return 0, fmt.Errorf("invalid number %q, enable decimal_comma if the file uses a decimal comma", value)
+		}
+	}
+	return parseImportNumber(value)
+}
+
+// parseTemplateDate đọc ngày theo DateFormat của template: định dạng dạng token (YYYY-MM-DD...),
+// layout của Go, "unix" hoặc "unix_ms". Ô XLSX chứa ngày ở dạng số serial của Excel cũng được chấp nhận
+func parseTemplateDate(value, format string, location *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(format) {
+	case "unix", "unix_ms":
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+		}
+		if strings.EqualFold(format, "unix_ms") {
+			return time.UnixMilli(int64(seconds)).UTC(), nil
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), nil
+	}
+
+	layouts := defaultDateLayouts
+	if format != "" {
+		layouts = []string{dateFormatTokens.Replace(format)}
+	}
+	if date, err := parseImportTime(value, location, layouts...); err == nil {
+		return date, nil
+	}
+	if serial, err := strconv.ParseFloat(value, 64); err == nil && serial > 0 {
+		date, err := excelize.ExcelDateToTime(serial, false)
+		if err == nil {
+			// Ngày serial của Excel không có múi giờ, được hiểu theo múi giờ của template
+			return time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), 0, location), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTemplateNumber(t *testing.T) {
+	tests := []struct {
+		value        string
+		decimalComma bool
+		want         float64
+		wantErr      bool
+	}{
+		{value: "1234.5", want: 1234.5},
+		{value: "1,234.5", want: 1234.5},
+		{value: "$1,234,567", want: 1234567},
+		{value: "-1,000", want: -1000},
+		{value: "1,5", wantErr: true},
+		{value: "12,34", wantErr: true},
+		{value: "1,2345", wantErr: true},
+		{value: ",100", wantErr: true},
+		{value: "1,5", decimalComma: true, want: 1.5},
+		{value: "1.234,56", decimalComma: true, want: 1234.56},
+		{value: "€ 1.000", decimalComma: true, want: 1000},
+		{value: "", want: 0},
+		{value: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTemplateNumber(tt.value, tt.decimalComma)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTemplateNumber(%q, %v) error = %v, wantErr %v", tt.value, tt.decimalComma, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseTemplateNumber(%q, %v) = %v, want %v", tt.value, tt.decimalComma, got, tt.want)
+		}
+	}
+}
+
+func TestParseTemplateDate(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+
+	tests := []struct {
+		name     string
+		value    string
+		format   string
+		location *time.Location
+		want     time.Time
+		wantErr  bool
+	}{
+		{name: "token format", value: "2025/03/01 10:30:00", format: "YYYY/MM/DD HH:mm:ss", location: time.UTC, want: time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC)},
+		{name: "token format in template timezone", value: "01.03.25 19:00", format: "DD.MM.YY HH:mm", location: tokyo, want: time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{name: "go layout", value: "Mar 1, 2025", format: "Jan 2, 2006", location: time.UTC, want: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "default layouts", value: "2025-03-01T10:30:00Z", location: time.UTC, want: time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC)},
+		{name: "unix seconds", value: "1740825000", format: "unix", location: tokyo, want: time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC)},
+		{name: "unix milliseconds", value: "1740825000123", format: "unix_ms", location: time.UTC, want: time.Date(2025, 3, 1, 10, 30, 0, 123000000, time.UTC)},
+		{name: "excel serial date", value: "45717.5", format: "YYYY-MM-DD", location: time.UTC, want: time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{name: "excel serial in template timezone", value: "45717", location: tokyo, want: time.Date(2025, 3, 1, 0, 0, 0, 0, tokyo)},
+		{name: "does not match format", value: "2025-03-01", format: "DD/MM/YYYY", location: time.UTC, wantErr: true},
+		{name: "invalid timestamp", value: "soon", format: "unix", location: time.UTC, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTemplateDate(tt.value, tt.format, tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("parseTemplateDate(%q, %q) = %v, want %v", tt.value, tt.format, got, tt.want)
+			}
+		})
+	}
+}
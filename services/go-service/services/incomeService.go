@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// incomePeriodLayouts là định dạng khóa thời gian dùng để gom thu nhập theo kỳ
+var incomePeriodLayouts = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// IncomePeriod là tổng thu nhập trong một kỳ theo từng tiền tệ
+type IncomePeriod struct {
+	Period string             `json:"period"`
+	Income map[string]float64 `json:"income"`
+}
+
+// IncomeSummary tổng hợp thu nhập theo coin, theo loại và theo kỳ
+type IncomeSummary struct {
+	Period string                        `json:"period"`
+	ByCoin map[string]map[string]float64 `json:"by_coin"`
+	ByType map[string]map[string]float64 `json:"by_type"`
+	ByDate []IncomePeriod                `json:"by_period"`
+	Totals map[string]float64            `json:"totals"`
+}
+
+// GetIncomeSummary tổng hợp thu nhập của người dùng trong khoảng [from, to), gom theo kỳ
+// day, month hoặc year. from hoặc to bằng zero nghĩa là không giới hạn
+func GetIncomeSummary(userID primitive.ObjectID, period string, from, to time.Time) (*IncomeSummary, error) {
+	if period == "" {
+		period = "month"
+	}
+	layout, ok := incomePeriodLayouts[period]
+	if !ok {
+		return nil, &CustomError{Code: "INVALID_PERIOD", Message: "Period must be day, month or year."}
+	}
+
+	filter := bson.M{
+		"user_id":          userID,
+		"transaction_type": bson.M{"$in": models.IncomeTransactionTypes},
+		"status":           "completed",
+	}
+	dateFilter := bson.M{}
+	if !from.IsZero() {
+		dateFilter["$gte"] = from
+	}
+	if !to.IsZero() {
+		dateFilter["$lt"] = to
+	}
+	if len(dateFilter) > 0 {
+		filter["date"] = dateFilter
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := configs.GetCollection("transactions").Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching income transactions: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var transactions []models.Transaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, fmt.Errorf("error decoding income transactions: %v", err)
+	}
+
+	summary := &IncomeSummary{
+		Period: period,
+		ByCoin: map[string]map[string]float64{},
+		ByType: map[string]map[string]float64{},
+		ByDate: []IncomePeriod{},
+		Totals: map[string]float64{},
+	}
+	byPeriod := map[string]map[string]float64{}
+	for _, transaction := range transactions {
+		key := transaction.Date.UTC().Format(layout)
+		addAmountsByCoin(&summary.ByCoin, transaction.Coin, transaction.Income)
+		addAmountsByCoin(&summary.ByType, transaction.TransactionType, transaction.Income)
+		addAmountsByCoin(&byPeriod, key, transaction.Income)
+		for currency, amount := range transaction.Income {
+			summary.Totals[currency] += amount
+		}
+	}
+	for key, amounts := range byPeriod {
+		summary.ByDate = append(summary.ByDate, IncomePeriod{Period: key, Income: amounts})
+	}
+	sort.Slice(summary.ByDate, func(a, b int) bool {
+		return summary.ByDate[a].Period < summary.ByDate[b].Period
+	})
+	return summary, nil
+}
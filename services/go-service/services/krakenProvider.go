@@ -0,0 +1,130 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultKrakenURL = "https://api.kraken.com"
+
+// krakenAssetAliases ánh xạ ký hiệu coin thông dụng sang ký hiệu riêng của Kraken
+var krakenAssetAliases = map[string]string{
+	"BTC":  "XBT",
+	"DOGE": "XDG",
+}
+
+// KrakenProvider lấy giá coin từ cặp <coin>USD trên Kraken
+type KrakenProvider struct {
+	baseURL string
+	fiatURL string
+}
+
+// NewKrakenProvider tạo KrakenProvider, dùng URL mặc định nếu baseURL rỗng
+func NewKrakenProvider(baseURL, fiatURL string) *KrakenProvider {
+	if baseURL == "" {
+		baseURL = defaultKrakenURL
+	}
+	return &KrakenProvider{baseURL: strings.TrimRight(baseURL, "/"), fiatURL: fiatURL}
+}
+
+func (p *KrakenProvider) Name() string {
+	return "kraken"
+}
+
+// krakenTicker là phần dữ liệu cần dùng trong phản hồi Ticker của Kraken
+type krakenTicker struct {
+	Error  []string `json:"error"`
+	Result map[string]struct {
+		// C là giao dịch gần nhất: [giá, khối lượng]
+		C []string `json:"c"`
+	} `json:"result"`
+}
+
+// GetPrice lấy giá giao dịch gần nhất của cặp <symbol>USD từ Kraken
+func (p *KrakenProvider) GetPrice(symbol string) (float64, error) {
+	asset := normalizeSymbol(symbol)
+	if alias, ok := krakenAssetAliases[asset]; ok {
+		asset = alias
+	}
+
+	var ticker krakenTicker
+	url := fmt.Sprintf("%s/0/public/Ticker?pair=%sUSD", p.baseURL, asset)
+	if err := getJSON(url, &ticker); err != nil {
+		return 0, err
+	}
+	if len(ticker.Error) > 0 {
+		return 0, errors.New(strings.Join(ticker.Error, "; "))
+	}
+
+	// Kraken trả về key theo tên cặp nội bộ (ví dụ XXBTZUSD) nên chỉ lấy phần tử duy nhất
+	for _, pair := range ticker.Result {
+		if len(pair.C) == 0 {
+			break
+		}
+		return strconv.ParseFloat(pair.C[0], 64)
+	}
+	return 0, fmt.Errorf("price not found for %s on kraken", symbol)
+}
+
+// GetPrices lấy giá của nhiều coin song song vì Kraken không có endpoint lấy theo lô
+func (p *KrakenProvider) GetPrices(symbols []string) (map[string]float64, error) {
+	return fetchPricesConcurrently(symbols, p.GetPrice)
+}
+
+// GetFiatRate lấy tỷ giá tiền pháp định từ exchangerate-api
+func (p *KrakenProvider) GetFiatRate(base, quote string) (float64, error) {
+	return fetchFiatRate(p.fiatURL, base, quote)
+}
+
+// GetHistoricalPrice lấy giá đóng cửa nến ngày của cặp <symbol>USD tại ngày date từ Kraken.
+// Kraken chỉ trả về khoảng 720 nến gần nhất nên ngày quá xa sẽ không có dữ liệu
+func (p *KrakenProvider) GetHistoricalPrice(symbol string, date time.Time) (float64, error) {
+	asset := normalizeSymbol(symbol)
+	if alias, ok := krakenAssetAliases[asset]; ok {
+		asset = alias
+	}
+	day := date.UTC().Truncate(24 * time.Hour)
+
+	// Mỗi nến là một mảng [time, open, high, low, close, vwap, volume, count]
+	var ohlc struct {
+		Error  []string                   `json:"error"`
+		Result map[string]json.RawMessage `json:"result"`
+	}
+	url := fmt.Sprintf("%s/0/public/OHLC?pair=%sUSD&interval=1440&since=%d", p.baseURL, asset, day.Unix()-1)
+	if err := getJSON(url, &ohlc); err != nil {
+		return 0, err
+	}
+	if len(ohlc.Error) > 0 {
+		message := strings.Join(ohlc.Error, "; ")
+		// Kraken trả lỗi trong body (HTTP 200) khi không niêm yết cặp giao dịch
+		if strings.Contains(message, "Unknown asset pair") {
+			return 0, fmt.Errorf("%w for %s: %s", errNoHistoricalPrice, symbol, message)
+		}
+		return 0, errors.New(message)
+	}
+
+	for key, raw := range ohlc.Result {
+		if key == "last" {
+			continue
+		}
+		var candles [][]interface{}
+		if err := json.Unmarshal(raw, &candles); err != nil {
+			return 0, err
+		}
+		for _, candle := range candles {
+			if len(candle) < 5 {
+				continue
+			}
+			if openTime, ok := candle[0].(float64); ok && int64(openTime) == day.Unix() {
+				if closePrice, ok := candle[4].(string); ok {
+					return strconv.ParseFloat(closePrice, 64)
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w for %s on %s", errNoHistoricalPrice, symbol, day.Format("2006-01-02"))
+}
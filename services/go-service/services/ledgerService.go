@@ -0,0 +1,468 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// applyTransaction áp dụng một giao dịch vào danh mục trong bộ nhớ. Hàm không truy cập
+// cơ sở dữ liệu nên cùng một chuỗi giao dịch luôn cho ra cùng một danh mục
+func applyTransaction(portfolio *models.Portfolio, transaction *models.Transaction, method string) error {
+	if portfolio.CoinHoldings == nil {
+		portfolio.CoinHoldings = make(map[string]models.CoinHolding)
+	}
+	ensureAccountHoldings(portfolio)
+	if !models.IsValidTransactionType(transaction.TransactionType) {
+		return invalidTransactionType(transaction.TransactionType)
+	}
+	if transaction.FeeAmount < 0 {
+		return &CustomError{Code: "INVALID_FEE_AMOUNT", Message: "The fee amount cannot be negative."}
+	}
+	// Xóa các trường suy ra của lần áp dụng trước (khi replay hoặc khi giao dịch bị sửa loại)
+	transaction.ConsumedLots, transaction.Proceeds, transaction.RealizedPL = nil, nil, nil
+	transaction.FeeValue, transaction.FeeLots, transaction.Income = nil, nil, nil
+	if fee := transaction.FeeIn(); len(fee) > 0 {
+		transaction.FeeValue = fee
+	}
+
+	switch transaction.TransactionType {
+	case models.TransactionBuy:
+		return applyAcquisition(portfolio, transaction, method, transaction.Date)
+	case models.TransactionDeposit:
+		// Coin nạp vào giữ ngày mua ban đầu nếu người dùng cung cấp
+		acquiredAt := transaction.AcquiredAt
+		if acquiredAt.IsZero() {
+			acquiredAt = transaction.Date
+		}
+		return applyAcquisition(portfolio, transaction, method, acquiredAt)
+	case models.TransactionSell, models.TransactionWithdrawal:
+		return applyDisposal(portfolio, transaction, method)
+	case models.TransactionSwap:
+		return applySwap(portfolio, transaction, method)
+	case models.TransactionTransfer:
+		return applyTransfer(portfolio, transaction, method)
+	default:
+		// Thu nhập được ghi nhận theo giá thị trường lúc nhận, giá trị này cũng là giá vốn của lô
+		transaction.Income = transaction.CostIn()
+		addAmountsByCoin(&portfolio.Income, transaction.Coin, transaction.Income)
+		return applyAcquisition(portfolio, transaction, method, transaction.Date)
+	}
+}
+
+// replayTransactions dựng lại danh mục từ đầu bằng cách áp dụng lần lượt các giao dịch theo
+// thứ tự thời gian. Các trường suy ra (lô đã trừ, tiền thu về, lời/lỗ...) của từng giao dịch
+// được tính lại trong slice transactions
+func replayTransactions(portfolio *models.Portfolio, transactions []models.Transaction, method string) error {
+	portfolio.CoinHoldings = make(map[string]models.CoinHolding)
+	portfolio.AccountHoldings = make(map[string]map[string]models.CoinHolding)
+	portfolio.RealizedPL = nil
+	portfolio.Income = nil
+
+	sortTransactions(transactions)
+	for i := range transactions {
+		if err := applyTransaction(portfolio, &transactions[i], method); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortTransactions sắp xếp giao dịch theo ngày giao dịch, rồi ngày tạo và ID để thứ tự replay luôn cố định
+func sortTransactions(transactions []models.Transaction) {
+	sort.SliceStable(transactions, func(a, b int) bool {
+		left, right := transactions[a], transactions[b]
+		if !left.Date.Equal(right.Date) {
+			return left.Date.Before(right.Date)
+		}
+		if !left.CreatedAt.Equal(right.CreatedAt) {
+			return left.CreatedAt.Before(right.CreatedAt)
+		}
+		return left.ID.Hex() < right.ID.Hex()
+	})
+}
+
+// invalidTransactionType trả về lỗi cho loại giao dịch không được hỗ trợ
+func invalidTransactionType(transactionType string) error {
+	return &CustomError{Code: "INVALID_TRANSACTION_TYPE", Message: fmt.Sprintf("Transaction type %q is not supported.", transactionType)}
+}
+
+// applyAcquisition ghi nhận giao dịch mua hoặc nạp coin thành một lô mới.
+// Phí trả bằng chính coin làm giảm số lượng nhận được, giá vốn vẫn là toàn bộ số tiền đã trả.
+// Phí trả bằng tiền khác được cộng vào giá vốn của lô
+func applyAcquisition(portfolio *models.Portfolio, transaction *models.Transaction, method string, acquiredAt time.Time) error {
+	quantity := transaction.Amount
+	costBasis := transaction.CostIn()
+	if transaction.FeeInCoin() {
+		quantity -= transaction.FeeAmount
+		if quantity <= quantityEpsilon {
+			return &CustomError{Code: "FEE_EXCEEDS_AMOUNT", Message: "The fee must be smaller than the received amount."}
+		}
+	} else if len(transaction.FeeValue) > 0 {
+		costBasis = combineAmounts(costBasis, transaction.FeeValue, 1)
+	}
+	if err := payFeeWithAsset(portfolio, transaction, method); err != nil {
+		return err
+	}
+
+	account := accountKey(transaction.AccountID)
+	holding, _ := accountHolding(portfolio, account, transaction.Coin)
+	acquireLot(&holding, models.Lot{
+		ID:               transaction.ID.Hex(),
+		TransactionID:    transaction.ID,
+		Quantity:         quantity,
+		OriginalQuantity: quantity,
+		AcquiredAt:       acquiredAt,
+		CostBasis:        costBasis,
+	})
+	setAccountHolding(portfolio, account, transaction.Coin, holding)
+	return nil
+}
+
+// applyDisposal trừ coin khỏi danh mục khi bán hoặc rút. Chỉ giao dịch bán phát sinh
+// tiền thu về và lời/lỗ đã thực hiện; rút coin chỉ mang giá vốn ra khỏi danh mục
+func applyDisposal(portfolio *models.Portfolio, transaction *models.Transaction, method string) error {
+	account := accountKey(transaction.AccountID)
+	holding, exists := accountHolding(portfolio, account, transaction.Coin)
+	if !exists {
+		return coinNotInAccount(account)
+	}
+	// Giữ nguyên phương pháp đã dùng khi giao dịch được ghi nhận lần đầu
+	if transaction.CostBasisMethod == "" {
+		transaction.CostBasisMethod = method
+	}
+
+	// Phí trả bằng chính coin được trừ thêm khỏi holding, phí trả bằng tiền khác được trừ khỏi tiền thu về
+	quantity := transaction.Amount
+	if transaction.FeeInCoin() {
+		quantity += transaction.FeeAmount
+	}
+	consumed, err := consumeLots(&holding, quantity, transaction.CostBasisMethod, transaction.LotIDs, transaction.Date)
+	if err != nil {
+		return err
+	}
+	transaction.ConsumedLots = consumed
+	setAccountHolding(portfolio, account, transaction.Coin, holding)
+
+	if transaction.TransactionType == models.TransactionSell {
+		proceeds := transaction.CostIn()
+		if !transaction.FeeInCoin() && len(transaction.FeeValue) > 0 {
+			proceeds = combineAmounts(proceeds, transaction.FeeValue, -1)
+		}
+		transaction.Proceeds = proceeds
+		transaction.RealizedPL = realizedPL(proceeds, consumed)
+		addRealizedPL(portfolio, transaction.Coin, transaction.RealizedPL)
+	}
+
+	return payFeeWithAsset(portfolio, transaction, transaction.CostBasisMethod)
+}
+
+// applyTransfer chuyển coin nội bộ mà không phát sinh lời/lỗ: các lô bị trừ ở tài khoản nguồn được
+// ghi lại vào tài khoản nhận (ToAccountID, mặc định là chính tài khoản nguồn) với nguyên ngày mua
+// và giá vốn. Phí trả bằng chính coin làm giảm số lượng nhận được nhưng giá vốn của nó được giữ
+// lại trong các lô đã chuyển
+func applyTransfer(portfolio *models.Portfolio, transaction *models.Transaction, method string) error {
+	account := accountKey(transaction.AccountID)
+	holding, exists := accountHolding(portfolio, account, transaction.Coin)
+	if !exists {
+		return coinNotInAccount(account)
+	}
+	if transaction.CostBasisMethod == "" {
+		transaction.CostBasisMethod = method
+	}
+
+	received := transaction.Amount
+	if transaction.FeeInCoin() {
+		received -= transaction.FeeAmount
+		if received <= quantityEpsilon {
+			return &CustomError{Code: "FEE_EXCEEDS_AMOUNT", Message: "The fee must be smaller than the transferred amount."}
+		}
+	}
+	consumed, err := consumeLots(&holding, transaction.Amount, transaction.CostBasisMethod, transaction.LotIDs, transaction.Date)
+	if err != nil {
+		return err
+	}
+	transaction.ConsumedLots = consumed
+
+	// Các lô được chuyển sang tài khoản nhận (hoặc ghi lại vào chính tài khoản nguồn)
+	destination := account
+	if !transaction.ToAccountID.IsZero() {
+		destination = accountKey(transaction.ToAccountID)
+	}
+	if destination != account {
+		setAccountHolding(portfolio, account, transaction.Coin, holding)
+		holding, _ = accountHolding(portfolio, destination, transaction.Coin)
+	}
+	restoreLots(&holding, consumed, received/transaction.Amount)
+	setAccountHolding(portfolio, destination, transaction.Coin, holding)
+
+	return payFeeWithAsset(portfolio, transaction, transaction.CostBasisMethod)
+}
+
+// applySwap trừ Coin và cộng ToCoin trong cùng một giao dịch. Cả hai vế được định giá bằng
+// giá trị của ToCoin nhận về tại thời điểm giao dịch: giá trị này là tiền thu về của vế bán
+// (phát sinh lời/lỗ đã thực hiện) và là giá vốn của lô ToCoin mới
+func applySwap(portfolio *models.Portfolio, transaction *models.Transaction, method string) error {
+	account := accountKey(transaction.AccountID)
+	holding, exists := accountHolding(portfolio, account, transaction.Coin)
+	if !exists {
+		return coinNotInAccount(account)
+	}
+	if transaction.CostBasisMethod == "" {
+		transaction.CostBasisMethod = method
+	}
+
+	// Phí trả bằng coin bán được trừ thêm khỏi holding, phí trả bằng coin nhận về làm giảm
+	// số lượng nhận được, phí trả bằng tài sản khác được trừ khỏi tiền thu về
+	disposed, received := transaction.Amount, transaction.ToAmount
+	value := transaction.CostIn()
+	proceeds := value
+	switch {
+	case transaction.FeeInCoin():
+		disposed += transaction.FeeAmount
+	case transaction.FeeInToCoin():
+		received -= transaction.FeeAmount
+		if received <= quantityEpsilon {
+			return &CustomError{Code: "FEE_EXCEEDS_AMOUNT", Message: "The fee must be smaller than the received amount."}
+		}
+	case len(transaction.FeeValue) > 0:
+		proceeds = combineAmounts(proceeds, transaction.FeeValue, -1)
+	}
+
+	consumed, err := consumeLots(&holding, disposed, transaction.CostBasisMethod, transaction.LotIDs, transaction.Date)
+	if err != nil {
+		return err
+	}
+	transaction.ConsumedLots = consumed
+	transaction.Proceeds = proceeds
+	transaction.RealizedPL = realizedPL(proceeds, consumed)
+	addRealizedPL(portfolio, transaction.Coin, transaction.RealizedPL)
+	setAccountHolding(portfolio, account, transaction.Coin, holding)
+
+	acquired, _ := accountHolding(portfolio, account, transaction.ToCoin)
+	acquireLot(&acquired, models.Lot{
+		ID:               transaction.ID.Hex(),
+		TransactionID:    transaction.ID,
+		Quantity:         received,
+		OriginalQuantity: received,
+		AcquiredAt:       transaction.Date,
+		CostBasis:        value,
+	})
+	setAccountHolding(portfolio, account, transaction.ToCoin, acquired)
+
+	return payFeeWithAsset(portfolio, transaction, transaction.CostBasisMethod)
+}
+
+// payFeeWithAsset trừ phí trả bằng một coin khác (ví dụ BNB) khỏi holding của coin đó trong tài khoản của giao dịch.
+// Việc dùng coin để trả phí được xem như bán coin đó với giá trị bằng giá trị phí
+func payFeeWithAsset(portfolio *models.Portfolio, transaction *models.Transaction, method string) error {
+	transaction.FeeLots = nil
+	if transaction.FeeAmount <= 0 || transaction.FeeInQuote() || transaction.FeeInCoin() || transaction.FeeInToCoin() {
+		return nil
+	}
+	feeCoin := transaction.GetFeeCurrency()
+	// Phí trả bằng tiền pháp định hoặc stablecoin không được theo dõi trong danh mục
+	if IsSupportedCurrency(resolvePeg(feeCoin)) {
+		return nil
+	}
+
+	account := accountKey(transaction.AccountID)
+	holding, exists := accountHolding(portfolio, account, feeCoin)
+	if !exists || holding.Quantity+quantityEpsilon < transaction.FeeAmount {
+		return &CustomError{Code: "INSUFFICIENT_FEE_BALANCE", Message: fmt.Sprintf("Your %s holding does not cover the fee.", feeCoin)}
+	}
+	// Lô chỉ định trong lot_ids thuộc về coin giao dịch nên phí dùng FIFO
+	if method == models.CostBasisSpecific {
+		method = models.CostBasisFIFO
+	}
+	consumed, err := consumeLots(&holding, transaction.FeeAmount, method, nil, transaction.Date)
+	if err != nil {
+		return err
+	}
+	transaction.FeeLots = consumed
+	addRealizedPL(portfolio, feeCoin, realizedPL(transaction.FeeIn(), consumed))
+	setAccountHolding(portfolio, account, feeCoin, holding)
+	return nil
+}
+
+// combineAmounts cộng (sign = 1) hoặc trừ (sign = -1) hai map số tiền, chỉ giữ các tiền tệ có ở cả hai
+func combineAmounts(amounts, other map[string]float64, sign float64) map[string]float64 {
+	result := make(map[string]float64, len(amounts))
+	for currency, amount := range amounts {
+		if value, ok := other[currency]; ok {
+			result[currency] = amount + sign*value
+		}
+	}
+	return result
+}
+
+// consumedCost cộng giá vốn của các lô đã trừ. Tiền tệ nào không có ở mọi lô bị bỏ qua
+// để không báo cáo giá vốn thiếu
+func consumedCost(consumed []models.LotConsumption) map[string]float64 {
+	total := map[string]float64{}
+	counts := map[string]int{}
+	for _, consumption := range consumed {
+		for currency, cost := range consumption.CostBasis {
+			total[currency] += cost
+			counts[currency]++
+		}
+	}
+	for currency, count := range counts {
+		if count != len(consumed) {
+			delete(total, currency)
+		}
+	}
+	return total
+}
+
+// realizedPL tính lời/lỗ đã thực hiện theo từng tiền tệ có cả tiền thu về lẫn giá vốn
+func realizedPL(proceeds map[string]float64, consumed []models.LotConsumption) map[string]float64 {
+	cost := consumedCost(consumed)
+	result := make(map[string]float64, len(proceeds))
+	for currency, amount := range proceeds {
+		if basis, ok := cost[currency]; ok {
+			result[currency] = amount - basis
+		}
+	}
+	return result
+}
+
+// addRealizedPL cộng dồn lời/lỗ đã thực hiện của một coin vào danh mục
+func addRealizedPL(portfolio *models.Portfolio, coin string, amounts map[string]float64) {
+	addAmountsByCoin(&portfolio.RealizedPL, coin, amounts)
+}
+
+// addAmountsByCoin cộng dồn số tiền theo tiền tệ của một coin vào map theo coin
+func addAmountsByCoin(target *map[string]map[string]float64, coin string, amounts map[string]float64) {
+	if len(amounts) == 0 {
+		return
+	}
+	if *target == nil {
+		*target = make(map[string]map[string]float64)
+	}
+	if (*target)[coin] == nil {
+		(*target)[coin] = make(map[string]float64)
+	}
+	for currency, amount := range amounts {
+		(*target)[coin][currency] += amount
+	}
+}
+
+// setHolding ghi holding vào danh mục, xóa coin khỏi danh mục khi số lượng về 0
+func setHolding(portfolio *models.Portfolio, coin string, holding models.CoinHolding) {
+	if holding.Quantity <= quantityEpsilon {
+		delete(portfolio.CoinHoldings, coin)
+		return
+	}
+	portfolio.CoinHoldings[coin] = holding
+}
+
+// accountKey trả về key của tài khoản trong Portfolio.AccountHoldings
+func accountKey(accountID primitive.ObjectID) string {
+	if accountID.IsZero() {
+		return models.UnassignedAccount
+	}
+	return accountID.Hex()
+}
+
+// coinNotInAccount trả về lỗi khi tài khoản của giao dịch không giữ coin cần trừ
+func coinNotInAccount(account string) error {
+	if account == models.UnassignedAccount {
+		return &CustomError{Code: "COIN_NOT_IN_PORTFOLIO", Message: "This coin is not in your portfolio."}
+	}
+	return &CustomError{Code: "COIN_NOT_IN_ACCOUNT", Message: "This coin is not held in the selected account."}
+}
+
+// ensureAccountHoldings chuyển holding của danh mục được lưu trước khi có tài khoản sang tài khoản
+// UnassignedAccount để các giao dịch sau vẫn trừ được từ đó
+func ensureAccountHoldings(portfolio *models.Portfolio) {
+	if portfolio.AccountHoldings != nil {
+		return
+	}
+	portfolio.AccountHoldings = make(map[string]map[string]models.CoinHolding)
+	if len(portfolio.CoinHoldings) == 0 {
+		return
+	}
+	unassigned := make(map[string]models.CoinHolding, len(portfolio.CoinHoldings))
+	for coin, holding := range portfolio.CoinHoldings {
+		ensureLots(&holding)
+		unassigned[coin] = copyHolding(holding)
+	}
+	portfolio.AccountHoldings[models.UnassignedAccount] = unassigned
+}
+
+// HoldingsByAccount trả về holding của danh mục theo tài khoản (khóa là ID tài khoản hoặc
+// UnassignedAccount). Danh mục lưu trước khi có tài khoản được xem như nằm hết ở UnassignedAccount
+func HoldingsByAccount(portfolio *models.Portfolio) map[string]map[string]models.CoinHolding {
+	if portfolio.AccountHoldings != nil {
+		return portfolio.AccountHoldings
+	}
+	if len(portfolio.CoinHoldings) == 0 {
+		return map[string]map[string]models.CoinHolding{}
+	}
+	return map[string]map[string]models.CoinHolding{models.UnassignedAccount: portfolio.CoinHoldings}
+}
+
+// accountHolding trả về holding của coin trong tài khoản account
+func accountHolding(portfolio *models.Portfolio, account, coin string) (models.CoinHolding, bool) {
+	holding, exists := portfolio.AccountHoldings[account][coin]
+	return holding, exists
+}
+
+// setAccountHolding ghi holding của coin trong tài khoản account (xóa khi số lượng về 0)
+// rồi tính lại holding tổng hợp của coin đó
+func setAccountHolding(portfolio *models.Portfolio, account, coin string, holding models.CoinHolding) {
+	holdings := portfolio.AccountHoldings[account]
+	if holding.Quantity <= quantityEpsilon {
+		delete(holdings, coin)
+		if len(holdings) == 0 {
+			delete(portfolio.AccountHoldings, account)
+		}
+	} else {
+		if holdings == nil {
+			holdings = make(map[string]models.CoinHolding)
+			portfolio.AccountHoldings[account] = holdings
+		}
+		holdings[coin] = holding
+	}
+	syncCoinHolding(portfolio, coin)
+}
+
+// syncCoinHolding tính lại holding tổng hợp của coin từ các lô của mọi tài khoản
+func syncCoinHolding(portfolio *models.Portfolio, coin string) {
+	total := models.CoinHolding{}
+	for _, account := range sortedAccounts(portfolio.AccountHoldings) {
+		if holding, exists := portfolio.AccountHoldings[account][coin]; exists {
+			total.Lots = append(total.Lots, copyHolding(holding).Lots...)
+		}
+	}
+	sort.SliceStable(total.Lots, func(a, b int) bool { return total.Lots[a].AcquiredAt.Before(total.Lots[b].AcquiredAt) })
+	syncHoldingTotals(&total)
+	setHolding(portfolio, coin, total)
+}
+
+// sortedAccounts trả về các key tài khoản theo thứ tự cố định
+func sortedAccounts(holdings map[string]map[string]models.CoinHolding) []string {
+	accounts := make([]string, 0, len(holdings))
+	for account := range holdings {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// copyHolding trả về bản sao của holding, không dùng chung lô hay map giá vốn với bản gốc
+func copyHolding(holding models.CoinHolding) models.CoinHolding {
+	holding.CostBasis = copyAmounts(holding.CostBasis)
+	lots := make([]models.Lot, len(holding.Lots))
+	for i, lot := range holding.Lots {
+		lot.CostBasis = copyAmounts(lot.CostBasis)
+		lots[i] = lot
+	}
+	holding.Lots = lots
+	return holding
+}
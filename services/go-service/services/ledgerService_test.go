@@ -0,0 +1,221 @@
+package services
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testDay = time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+// testID trả về ObjectID cố định để lô có ID biết trước
+func testID(n byte) primitive.ObjectID {
+	var id primitive.ObjectID
+	id[11] = n
+	return id
+}
+
+// usdTrade tạo giao dịch định giá bằng USD vào ngày thứ day kể từ testDay
+func usdTrade(id byte, transactionType, coin string, amount, price float64, day int) models.Transaction {
+	return models.Transaction{
+		ID:              testID(id),
+		TransactionType: transactionType,
+		Coin:            coin,
+		Amount:          amount,
+		Price:           price,
+		QuoteCurrency:   "USD",
+		FXRates:         map[string]float64{"USD": 1},
+		Date:            testDay.AddDate(0, 0, day),
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestLotOrder(t *testing.T) {
+	lots := []models.Lot{
+		{ID: "b", Quantity: 1, AcquiredAt: testDay.AddDate(0, 0, 2), CostBasis: map[string]float64{"USD": 300}},
+		{ID: "a", Quantity: 1, AcquiredAt: testDay.AddDate(0, 0, 1), CostBasis: map[string]float64{"USD": 100}},
+		{ID: "c", Quantity: 2, AcquiredAt: testDay.AddDate(0, 0, 3), CostBasis: map[string]float64{"USD": 400}},
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		lotIDs  []string
+		want    []int
+		errCode string
+	}{
+		{name: "fifo", method: models.CostBasisFIFO, want: []int{1, 0, 2}},
+		{name: "lifo", method: models.CostBasisLIFO, want: []int{2, 0, 1}},
+		{name: "hifo", method: models.CostBasisHIFO, want: []int{0, 2, 1}},
+		{name: "unknown method falls back to fifo", method: "bogus", want: []int{1, 0, 2}},
+		{name: "specific", method: models.CostBasisSpecific, lotIDs: []string{"c", "a"}, want: []int{2, 1}},
+		{name: "specific without lot ids", method: models.CostBasisSpecific, errCode: "LOT_IDS_REQUIRED"},
+		{name: "specific with unknown lot", method: models.CostBasisSpecific, lotIDs: []string{"z"}, errCode: "LOT_NOT_FOUND"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lotOrder(lots, tt.method, tt.lotIDs)
+			if tt.errCode != "" {
+				assertErrorCode(t, err, tt.errCode)
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lotOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyTransactionCostBasisMethods(t *testing.T) {
+	buyLow := usdTrade(1, models.TransactionBuy, "BTC", 1, 100, 0)
+	buyHigh := usdTrade(2, models.TransactionBuy, "BTC", 1, 200, 1)
+	sell := usdTrade(3, models.TransactionSell, "BTC", 1, 300, 2)
+	specific := sell
+	specific.LotIDs = []string{testID(2).Hex()}
+
+	tests := []struct {
+		name          string
+		method        string
+		transactions  []models.Transaction
+		wantQuantity  float64
+		wantCostBasis float64
+		wantPL        float64
+	}{
+		{name: "fifo sells the oldest lot", method: models.CostBasisFIFO, transactions: []models.Transaction{buyLow, buyHigh, sell}, wantQuantity: 1, wantCostBasis: 200, wantPL: 200},
+		{name: "lifo sells the newest lot", method: models.CostBasisLIFO, transactions: []models.Transaction{buyLow, buyHigh, sell}, wantQuantity: 1, wantCostBasis: 100, wantPL: 100},
+		{name: "hifo sells the most expensive lot", method: models.CostBasisHIFO, transactions: []models.Transaction{buyHigh, buyLow, sell}, wantQuantity: 1, wantCostBasis: 100, wantPL: 100},
+		{name: "average sells from every lot", method: models.CostBasisAverage, transactions: []models.Transaction{buyLow, buyHigh, sell}, wantQuantity: 1, wantCostBasis: 150, wantPL: 150},
+		{name: "specific sells the chosen lot", method: models.CostBasisSpecific, transactions: []models.Transaction{buyLow, buyHigh, specific}, wantQuantity: 1, wantCostBasis: 100, wantPL: 100},
+		{name: "replay sorts by trade date", method: models.CostBasisFIFO, transactions: []models.Transaction{sell, buyHigh, buyLow}, wantQuantity: 1, wantCostBasis: 200, wantPL: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portfolio := &models.Portfolio{}
+			transactions := append([]models.Transaction{}, tt.transactions...)
+			if err := replayTransactions(portfolio, transactions, tt.method); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			holding := portfolio.CoinHoldings["BTC"]
+			if !approxEqual(holding.Quantity, tt.wantQuantity) {
+				t.Errorf("quantity = %v, want %v", holding.Quantity, tt.wantQuantity)
+			}
+			if !approxEqual(holding.CostBasis["USD"], tt.wantCostBasis) {
+				t.Errorf("cost basis = %v, want %v", holding.CostBasis["USD"], tt.wantCostBasis)
+			}
+			if got := portfolio.RealizedPL["BTC"]["USD"]; !approxEqual(got, tt.wantPL) {
+				t.Errorf("realized P/L = %v, want %v", got, tt.wantPL)
+			}
+		})
+	}
+}
+
+func TestApplyTransactionErrors(t *testing.T) {
+	buy := usdTrade(1, models.TransactionBuy, "BTC", 1, 100, 0)
+
+	feeTooLarge := usdTrade(2, models.TransactionBuy, "BTC", 1, 100, 0)
+	feeTooLarge.FeeAmount, feeTooLarge.FeeCurrency = 1, "BTC"
+
+	otherAccount := usdTrade(3, models.TransactionSell, "BTC", 1, 100, 1)
+	otherAccount.AccountID = testID(9)
+
+	tests := []struct {
+		name         string
+		transactions []models.Transaction
+		errCode      string
+	}{
+		{name: "sell more than held", transactions: []models.Transaction{buy, usdTrade(2, models.TransactionSell, "BTC", 2, 100, 1)}, errCode: "SELL_AMOUNT_EXCEEDS_HOLDING"},
+		{name: "sell a coin not held", transactions: []models.Transaction{usdTrade(2, models.TransactionSell, "ETH", 1, 100, 1)}, errCode: "COIN_NOT_IN_PORTFOLIO"},
+		{name: "sell from another account", transactions: []models.Transaction{buy, otherAccount}, errCode: "COIN_NOT_IN_ACCOUNT"},
+		{name: "fee in coin as large as the amount", transactions: []models.Transaction{feeTooLarge}, errCode: "FEE_EXCEEDS_AMOUNT"},
+		{name: "unknown transaction type", transactions: []models.Transaction{usdTrade(2, "gift", "BTC", 1, 100, 0)}, errCode: "INVALID_TRANSACTION_TYPE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := replayTransactions(&models.Portfolio{}, tt.transactions, models.CostBasisFIFO)
+			assertErrorCode(t, err, tt.errCode)
+		})
+	}
+}
+
+func TestApplyTransactionSwapTransferAndIncome(t *testing.T) {
+	// 1 BTC đổi lấy 2 ETH khi 1 ETH = 150 USD: tiền thu về 300 USD và là giá vốn của lô ETH
+	swap := models.Transaction{
+		ID:              testID(2),
+		TransactionType: models.TransactionSwap,
+		Coin:            "BTC",
+		Amount:          1,
+		ToCoin:          "ETH",
+		ToAmount:        2,
+		Price:           2,
+		QuoteCurrency:   "ETH",
+		FXRates:         map[string]float64{"USD": 150},
+		Date:            testDay.AddDate(0, 0, 1),
+	}
+
+	exchange, wallet := testID(10), testID(11)
+	buyOnExchange := usdTrade(3, models.TransactionBuy, "SOL", 1, 100, 0)
+	buyOnExchange.AccountID = exchange
+	transfer := usdTrade(4, models.TransactionTransfer, "SOL", 1, 0, 1)
+	transfer.AccountID, transfer.ToAccountID = exchange, wallet
+	transfer.FeeAmount, transfer.FeeCurrency = 0.1, "SOL"
+
+	staking := usdTrade(5, models.TransactionStaking, "ADA", 10, 5, 0)
+
+	portfolio := &models.Portfolio{}
+	transactions := []models.Transaction{usdTrade(1, models.TransactionBuy, "BTC", 1, 100, 0), swap, buyOnExchange, transfer, staking}
+	if err := replayTransactions(portfolio, transactions, models.CostBasisFIFO); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := portfolio.CoinHoldings["BTC"]; ok {
+		t.Errorf("BTC should be fully swapped out")
+	}
+	if got := portfolio.RealizedPL["BTC"]["USD"]; !approxEqual(got, 200) {
+		t.Errorf("swap realized P/L = %v, want 200", got)
+	}
+	eth := portfolio.CoinHoldings["ETH"]
+	if !approxEqual(eth.Quantity, 2) || !approxEqual(eth.CostBasis["USD"], 300) {
+		t.Errorf("ETH holding = %v with cost %v, want 2 with cost 300", eth.Quantity, eth.CostBasis["USD"])
+	}
+
+	if _, ok := portfolio.AccountHoldings[exchange.Hex()]["SOL"]; ok {
+		t.Errorf("SOL should have left the exchange account")
+	}
+	sol := portfolio.AccountHoldings[wallet.Hex()]["SOL"]
+	if !approxEqual(sol.Quantity, 0.9) || !approxEqual(sol.CostBasis["USD"], 100) {
+		t.Errorf("wallet SOL = %v with cost %v, want 0.9 with cost 100", sol.Quantity, sol.CostBasis["USD"])
+	}
+	if _, ok := portfolio.RealizedPL["SOL"]; ok {
+		t.Errorf("a transfer must not realize P/L")
+	}
+
+	if got := portfolio.Income["ADA"]["USD"]; !approxEqual(got, 50) {
+		t.Errorf("staking income = %v, want 50", got)
+	}
+	if ada := portfolio.CoinHoldings["ADA"]; !approxEqual(ada.CostBasis["USD"], 50) {
+		t.Errorf("staking lot cost = %v, want 50", ada.CostBasis["USD"])
+	}
+}
+
+// assertErrorCode kiểm tra err là CustomError có mã code
+func assertErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	customErr, ok := err.(*CustomError)
+	if !ok {
+		t.Fatalf("error = %v, want CustomError %s", err, code)
+	}
+	if customErr.Code != code {
+		t.Errorf("error code = %s, want %s", customErr.Code, code)
+	}
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"crypto-folio/models"
+)
+
+// quantityEpsilon là ngưỡng dưới đó số lượng được xem như bằng 0 (tránh sai số dấu phẩy động)
+const quantityEpsilon = 1e-12
+
+// legacyLotID là ID của lô được tạo từ holding cũ chưa có dữ liệu lô
+const legacyLotID = "legacy"
+
+// ensureLots tạo một lô duy nhất từ số lượng và giá vốn hiện có cho holding được
+// ghi nhận trước khi có hệ thống lô, để các lần bán sau vẫn trừ được giá vốn
+func ensureLots(holding *models.CoinHolding) {
+	if len(holding.Lots) > 0 || holding.Quantity <= quantityEpsilon {
+		return
+	}
+	costBasis := copyAmounts(holding.CostBasis)
+	if _, ok := costBasis["USD"]; !ok {
+		costBasis["USD"] = holding.Quantity * holding.AvgBuyPrice
+	}
+	holding.Lots = []models.Lot{{
+		ID:               legacyLotID,
+		Quantity:         holding.Quantity,
+		OriginalQuantity: holding.Quantity,
+		CostBasis:        costBasis,
+	}}
+}
+
+// acquireLot thêm một lô mới vào holding và cập nhật lại tổng số lượng và giá vốn
+func acquireLot(holding *models.CoinHolding, lot models.Lot) {
+	ensureLots(holding)
+	holding.Lots = append(holding.Lots, lot)
+	syncHoldingTotals(holding)
+}
+
+// consumeLots trừ quantity khỏi các lô của holding theo phương pháp method và trả về
+// phần đã trừ của từng lô. Với phương pháp specific, lotIDs quy định lô và thứ tự trừ
+func consumeLots(holding *models.CoinHolding, quantity float64, method string, lotIDs []string, at time.Time) ([]models.LotConsumption, error) {
+	ensureLots(holding)
+	if holding.Quantity+quantityEpsilon < quantity {
+		return nil, &CustomError{Code: "SELL_AMOUNT_EXCEEDS_HOLDING", Message: "The sell amount exceeds your current holding."}
+	}
+
+	var consumed []models.LotConsumption
+	if method == models.CostBasisAverage {
+		consumed = consumeLotsProportionally(holding, quantity, at)
+	} else {
+		order, err := lotOrder(holding.Lots, method, lotIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		remaining := quantity
+		for _, index := range order {
+			if remaining <= quantityEpsilon {
+				break
+			}
+			lot := &holding.Lots[index]
+			take := math.Min(lot.Quantity, remaining)
+			if take <= 0 {
+				continue
+			}
+			consumed = append(consumed, takeFromLot(lot, take, at))
+			remaining -= take
+		}
+		if remaining > quantityEpsilon {
+			return nil, &CustomError{Code: "INSUFFICIENT_LOT_QUANTITY", Message: "The selected lots do not cover the sell amount."}
+		}
+	}
+
+	// Loại bỏ các lô đã hết số lượng
+	open := holding.Lots[:0]
+	for _, lot := range holding.Lots {
+		if lot.Quantity > quantityEpsilon {
+			open = append(open, lot)
+		}
+	}
+	holding.Lots = open
+	syncHoldingTotals(holding)
+	return consumed, nil
+}
+
+// restoreLots ghi lại các phần lô đã trừ vào holding với nguyên ID, ngày mua và giá vốn.
+// Số lượng được nhân với ratio (ví dụ phần còn lại sau phí chuyển), giá vốn giữ nguyên
+func restoreLots(holding *models.CoinHolding, consumed []models.LotConsumption, ratio float64) {
+	for _, consumption := range consumed {
+		quantity := consumption.Quantity * ratio
+		index := -1
+		for i := range holding.Lots {
+			if holding.Lots[i].ID == consumption.LotID {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			holding.Lots = append(holding.Lots, models.Lot{
+				ID:               consumption.LotID,
+				OriginalQuantity: quantity,
+				AcquiredAt:       consumption.AcquiredAt,
+				CostBasis:        map[string]float64{},
+			})
+			index = len(holding.Lots) - 1
+		}
+		lot := &holding.Lots[index]
+		lot.Quantity += quantity
+		if lot.CostBasis == nil {
+			lot.CostBasis = map[string]float64{}
+		}
+		for currency, cost := range consumption.CostBasis {
+			lot.CostBasis[currency] += cost
+		}
+	}
+	syncHoldingTotals(holding)
+}
+
+// consumeLotsProportionally trừ đều trên mọi lô theo cùng một tỷ lệ (phương pháp bình quân)
+func consumeLotsProportionally(holding *models.CoinHolding, quantity float64, at time.Time) []models.LotConsumption {
+	ratio := quantity / holding.Quantity
+	if ratio > 1 {
+		ratio = 1
+	}
+	consumed := make([]models.LotConsumption, 0, len(holding.Lots))
+	for i := range holding.Lots {
+		lot := &holding.Lots[i]
+		consumed = append(consumed, takeFromLot(lot, lot.Quantity*ratio, at))
+	}
+	return consumed
+}
+
+// takeFromLot trừ quantity khỏi lot, giảm giá vốn theo tỷ lệ và trả về phần đã trừ
+func takeFromLot(lot *models.Lot, quantity float64, at time.Time) models.LotConsumption {
+	ratio := quantity / lot.Quantity
+	consumption := models.LotConsumption{
+		LotID:      lot.ID,
+		Quantity:   quantity,
+		AcquiredAt: lot.AcquiredAt,
+		CostBasis:  make(map[string]float64, len(lot.CostBasis)),
+	}
+	for currency, cost := range lot.CostBasis {
+		taken := cost * ratio
+		consumption.CostBasis[currency] = taken
+		lot.CostBasis[currency] = cost - taken
+	}
+	lot.Quantity -= quantity
+
+	if !lot.AcquiredAt.IsZero() {
+		consumption.HoldingDays = int(at.Sub(lot.AcquiredAt).Hours() / 24)
+		consumption.LongTerm = consumption.HoldingDays >= models.LongTermHoldingDays
+	}
+	return consumption
+}
+
+// lotOrder trả về thứ tự chỉ mục các lô cần trừ theo phương pháp tính giá vốn
+func lotOrder(lots []models.Lot, method string, lotIDs []string) ([]int, error) {
+	if method == models.CostBasisSpecific {
+		if len(lotIDs) == 0 {
+			return nil, &CustomError{Code: "LOT_IDS_REQUIRED", Message: "Specify lot_ids when using specific identification."}
+		}
+		order := make([]int, 0, len(lotIDs))
+		for _, id := range lotIDs {
+			index := -1
+			for i, lot := range lots {
+				if lot.ID == id {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				return nil, &CustomError{Code: "LOT_NOT_FOUND", Message: fmt.Sprintf("Lot %s is not in your holding.", id)}
+			}
+			order = append(order, index)
+		}
+		return order, nil
+	}
+
+	order := make([]int, len(lots))
+	for i := range lots {
+		order[i] = i
+	}
+	switch method {
+	case models.CostBasisLIFO:
+		sort.SliceStable(order, func(a, b int) bool {
+			return lots[order[a]].AcquiredAt.After(lots[order[b]].AcquiredAt)
+		})
+	case models.CostBasisHIFO:
+		sort.SliceStable(order, func(a, b int) bool {
+			return unitCost(lots[order[a]]) > unitCost(lots[order[b]])
+		})
+	default:
+		sort.SliceStable(order, func(a, b int) bool {
+			return lots[order[a]].AcquiredAt.Before(lots[order[b]].AcquiredAt)
+		})
+	}
+	return order, nil
+}
+
+// unitCost trả về giá vốn trên một đơn vị coin của lô theo USD
+func unitCost(lot models.Lot) float64 {
+	if lot.Quantity <= 0 {
+		return 0
+	}
+	return lot.CostBasis["USD"] / lot.Quantity
+}
+
+// syncHoldingTotals tính lại số lượng, giá vốn và giá mua trung bình từ các lô.
+// Giá vốn của một tiền tệ chỉ được tổng hợp khi mọi lô đều có tiền tệ đó
+func syncHoldingTotals(holding *models.CoinHolding) {
+	quantity := 0.0
+	costBasis := map[string]float64{}
+	counts := map[string]int{}
+	for _, lot := range holding.Lots {
+		quantity += lot.Quantity
+		for currency, cost := range lot.CostBasis {
+			costBasis[currency] += cost
+			counts[currency]++
+		}
+	}
+	for currency, count := range counts {
+		if count != len(holding.Lots) {
+			delete(costBasis, currency)
+		}
+	}
+
+	holding.Quantity = quantity
+	holding.CostBasis = costBasis
+	holding.AvgBuyPrice = 0
+	if quantity > quantityEpsilon {
+		holding.AvgBuyPrice = costBasis["USD"] / quantity
+	}
+}
+
+// copyAmounts trả về bản sao của một map số tiền theo tiền tệ
+func copyAmounts(amounts map[string]float64) map[string]float64 {
+	result := make(map[string]float64, len(amounts))
+	for currency, amount := range amounts {
+		result[currency] = amount
+	}
+	return result
+}
+
+// LotView là thông tin một lô đang mở kèm thời gian nắm giữ, dùng cho báo cáo
+type LotView struct {
+	models.Lot
+	Coin        string  `json:"coin"`
+	AccountID   string  `json:"account_id"` // ID tài khoản giữ lô hoặc "unassigned"
+	UnitCostUSD float64 `json:"unit_cost_usd"`
+	HoldingDays int     `json:"holding_days"`
+	LongTerm    bool    `json:"long_term"`
+}
+
+// BuildLotViews trả về các lô đang mở của danh mục theo từng tài khoản, lọc theo coin nếu coin khác rỗng
+func BuildLotViews(portfolio *models.Portfolio, coin string, now time.Time) []LotView {
+	views := []LotView{}
+	for account, holdings := range HoldingsByAccount(portfolio) {
+		for symbol, holding := range holdings {
+			if coin != "" && symbol != coin {
+				continue
+			}
+			ensureLots(&holding)
+			for _, lot := range holding.Lots {
+				view := LotView{Lot: lot, Coin: symbol, AccountID: account, UnitCostUSD: unitCost(lot)}
+				if !lot.AcquiredAt.IsZero() {
+					view.HoldingDays = int(now.Sub(lot.AcquiredAt).Hours() / 24)
+					view.LongTerm = view.HoldingDays >= models.LongTermHoldingDays
+				}
+				views = append(views, view)
+			}
+		}
+	}
+	sort.Slice(views, func(a, b int) bool {
+		if views[a].Coin != views[b].Coin {
+			return views[a].Coin < views[b].Coin
+		}
+		if !views[a].AcquiredAt.Equal(views[b].AcquiredAt) {
+			return views[a].AcquiredAt.Before(views[b].AcquiredAt)
+		}
+		return views[a].AccountID < views[b].AccountID
+	})
+	return views
+}
@@ -0,0 +1,384 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxPortfolioNameLength là độ dài tối đa (ký tự) của tên danh mục
+const maxPortfolioNameLength = 50
+
+// AllPortfolios là giá trị portfolio_id chọn chế độ xem tổng hợp mọi danh mục chưa lưu trữ
+const AllPortfolios = "all"
+
+// portfolioNotFound trả về lỗi khi danh mục không tồn tại hoặc không thuộc về người dùng
+func portfolioNotFound() error {
+	return &CustomError{Code: "PORTFOLIO_NOT_FOUND", Message: "Portfolio not found."}
+}
+
+// validatePortfolioName chuẩn hóa và kiểm tra tên danh mục
+func validatePortfolioName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxPortfolioNameLength {
+		return "", &CustomError{Code: "INVALID_PORTFOLIO_NAME", Message: fmt.Sprintf("The portfolio name must be 1 to %d characters.", maxPortfolioNameLength)}
+	}
+	return name, nil
+}
+
+// portfolioWriteError chuyển lỗi trùng tên (index unique user_id + name) thành CustomError
+func portfolioWriteError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return &CustomError{Code: "PORTFOLIO_EXISTS", Message: "A portfolio with this name already exists."}
+	}
+	return fmt.Errorf("error saving portfolio: %v", err)
+}
+
+// defaultPortfolio trả về danh mục mặc định của người dùng (User.PortfolioID). Lần đầu được gọi,
+// danh mục cũ từ trước khi có nhiều danh mục (hoặc một danh mục mới tên "Main") trở thành mặc định
+// và các giao dịch chưa gắn danh mục được gắn vào đó
+func defaultPortfolio(ctx context.Context, userID primitive.ObjectID) (*models.Portfolio, error) {
+	var user models.User
+	if err := configs.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		return nil, fmt.Errorf("error fetching user: %v", err)
+	}
+	if !user.PortfolioID.IsZero() {
+		portfolio, err := loadPortfolio(ctx, userID, user.PortfolioID)
+		if err == nil {
+			portfolio.IsDefault = true
+			return portfolio, nil
+		}
+		if _, missing := err.(*CustomError); !missing {
+			return nil, err
+		}
+	}
+
+	// Danh mục được tạo sớm nhất (danh mục cũ nếu có) trở thành mặc định
+	collection := configs.GetCollection("portfolios")
+	var portfolio models.Portfolio
+	filter := bson.M{"user_id": userID, "archived": bson.M{"$ne": true}}
+	err := collection.FindOne(ctx, filter, options.FindOne().SetSort(bson.M{"_id": 1})).Decode(&portfolio)
+	if err == mongo.ErrNoDocuments {
+		portfolio = models.Portfolio{
+			ID:           primitive.NewObjectID(),
+			UserID:       userID,
+			Name:         models.DefaultPortfolioName,
+			CreatedAt:    time.Now(),
+			CoinHoldings: make(map[string]models.CoinHolding),
+		}
+		if _, err := collection.InsertOne(ctx, portfolio); mongo.IsDuplicateKeyError(err) {
+			// Một yêu cầu khác vừa tạo danh mục mặc định
+			err = collection.FindOne(ctx, bson.M{"user_id": userID, "name": models.DefaultPortfolioName}).Decode(&portfolio)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching portfolio: %v", err)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("error creating portfolio: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching portfolio: %v", err)
+	}
+
+	if portfolio.Name == "" {
+		// Danh mục cũ chưa có tên và ngày tạo
+		portfolio.Name, portfolio.CreatedAt = models.DefaultPortfolioName, portfolio.ID.Timestamp()
+		update := bson.M{"$set": bson.M{"name": portfolio.Name, "created_at": portfolio.CreatedAt}}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": portfolio.ID}, update); err != nil {
+			return nil, portfolioWriteError(err)
+		}
+	}
+	legacy := bson.M{"user_id": userID, "portfolio_id": bson.M{"$exists": false}}
+	if _, err := configs.GetCollection("transactions").UpdateMany(ctx, legacy, bson.M{"$set": bson.M{"portfolio_id": portfolio.ID}}); err != nil {
+		return nil, fmt.Errorf("error assigning transactions to portfolio: %v", err)
+	}
+	if _, err := configs.GetCollection("users").UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"portfolio_id": portfolio.ID}}); err != nil {
+		return nil, fmt.Errorf("error updating user: %v", err)
+	}
+	if portfolio.CoinHoldings == nil {
+		portfolio.CoinHoldings = make(map[string]models.CoinHolding)
+	}
+	portfolio.IsDefault = true
+	return &portfolio, nil
+}
+
+// userPortfolio trả về danh mục portfolioID của người dùng, hoặc danh mục mặc định nếu portfolioID trống
+func userPortfolio(ctx context.Context, userID, portfolioID primitive.ObjectID) (*models.Portfolio, error) {
+	if portfolioID.IsZero() {
+		return defaultPortfolio(ctx, userID)
+	}
+	return loadPortfolio(ctx, userID, portfolioID)
+}
+
+// writablePortfolio trả về danh mục nhận giao dịch mới, từ chối danh mục đã lưu trữ
+func writablePortfolio(userID, portfolioID primitive.ObjectID) (*models.Portfolio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	portfolio, err := userPortfolio(ctx, userID, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	if portfolio.Archived {
+		return nil, &CustomError{Code: "PORTFOLIO_ARCHIVED", Message: fmt.Sprintf("Portfolio %q is archived and cannot receive new transactions.", portfolio.Name)}
+	}
+	return portfolio, nil
+}
+
+// FindUserPortfolio lấy danh mục {id} của người dùng; id rỗng trả về danh mục mặc định
+func FindUserPortfolio(userID primitive.ObjectID, id string) (*models.Portfolio, error) {
+	portfolioID := primitive.NilObjectID
+	if id != "" {
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, portfolioNotFound()
+		}
+		portfolioID = objectID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defaults, err := defaultPortfolio(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if portfolioID.IsZero() || portfolioID == defaults.ID {
+		return defaults, nil
+	}
+	return loadPortfolio(ctx, userID, portfolioID)
+}
+
+// ListPortfolios trả về mọi danh mục của người dùng (kể cả đã lưu trữ) theo thứ tự tạo
+func ListPortfolios(userID primitive.ObjectID) ([]models.Portfolio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	defaults, err := defaultPortfolio(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := configs.GetCollection("portfolios").Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching portfolios: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	portfolios := []models.Portfolio{}
+	if err := cursor.All(ctx, &portfolios); err != nil {
+		return nil, fmt.Errorf("error decoding portfolios: %v", err)
+	}
+	for i := range portfolios {
+		portfolios[i].IsDefault = portfolios[i].ID == defaults.ID
+	}
+	return portfolios, nil
+}
+
+// CreatePortfolio tạo một danh mục rỗng mới cho người dùng
+func CreatePortfolio(userID primitive.ObjectID, name string) (*models.Portfolio, error) {
+	name, err := validatePortfolioName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Tạo danh mục mặc định trước để giao dịch cũ không bị gắn vào danh mục mới
+	if _, err := defaultPortfolio(ctx, userID); err != nil {
+		return nil, err
+	}
+	portfolio := &models.Portfolio{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		Name:         name,
+		CreatedAt:    time.Now(),
+		CoinHoldings: make(map[string]models.CoinHolding),
+	}
+	if _, err := configs.GetCollection("portfolios").InsertOne(ctx, portfolio); err != nil {
+		return nil, portfolioWriteError(err)
+	}
+	return portfolio, nil
+}
+
+// UpdatePortfolio đổi tên, lưu trữ/bỏ lưu trữ hoặc chọn danh mục {id} làm mặc định.
+// Danh mục mặc định không thể lưu trữ và danh mục đã lưu trữ không thể làm mặc định
+func UpdatePortfolio(userID primitive.ObjectID, id string, patch *models.PortfolioPatch) (*models.Portfolio, error) {
+	portfolio, err := FindUserPortfolio(userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	set, unset := bson.M{}, bson.M{}
+	if patch.Name != nil {
+		if portfolio.Name, err = validatePortfolioName(*patch.Name); err != nil {
+			return nil, err
+		}
+		set["name"] = portfolio.Name
+	}
+	if patch.Archived != nil && *patch.Archived != portfolio.Archived {
+		portfolio.Archived = *patch.Archived
+		if portfolio.Archived {
+			portfolio.ArchivedAt = time.Now()
+			set["archived"], set["archived_at"] = true, portfolio.ArchivedAt
+		} else {
+			portfolio.ArchivedAt = time.Time{}
+			unset["archived"], unset["archived_at"] = "", ""
+		}
+	}
+	makeDefault := patch.Default != nil && *patch.Default && !portfolio.IsDefault
+	if portfolio.Archived && portfolio.IsDefault {
+		return nil, &CustomError{Code: "PORTFOLIO_IS_DEFAULT", Message: "The default portfolio cannot be archived. Choose another default portfolio first."}
+	}
+	if portfolio.Archived && makeDefault {
+		return nil, &CustomError{Code: "PORTFOLIO_ARCHIVED", Message: "An archived portfolio cannot be the default portfolio."}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) > 0 {
+		result, err := configs.GetCollection("portfolios").UpdateOne(ctx, bson.M{"_id": portfolio.ID, "user_id": userID}, update)
+		if err != nil {
+			return nil, portfolioWriteError(err)
+		}
+		if result.MatchedCount == 0 {
+			return nil, portfolioNotFound()
+		}
+	}
+	if makeDefault {
+		userUpdate := bson.M{"$set": bson.M{"portfolio_id": portfolio.ID, "updated_at": time.Now()}}
+		if _, err := configs.GetCollection("users").UpdateOne(ctx, bson.M{"_id": userID}, userUpdate); err != nil {
+			return nil, fmt.Errorf("error updating default portfolio: %v", err)
+		}
+		portfolio.IsDefault = true
+	}
+	return portfolio, nil
+}
+
+// DeletePortfolio xóa danh mục {id} của người dùng. Chỉ danh mục không còn giao dịch (trừ giao dịch
+// đã xóa) và không phải danh mục mặc định mới được xóa; danh mục còn lịch sử nên được lưu trữ
+func DeletePortfolio(userID primitive.ObjectID, id string) error {
+	portfolio, err := FindUserPortfolio(userID, id)
+	if err != nil {
+		return err
+	}
+	if portfolio.IsDefault {
+		return &CustomError{Code: "PORTFOLIO_IS_DEFAULT", Message: "The default portfolio cannot be deleted. Choose another default portfolio first."}
+	}
+
+	// Đếm và xóa trong cùng một transaction để không xóa mất danh mục vừa nhận giao dịch mới
+	return runInTransaction(func(ctx context.Context) error {
+		filter := bson.M{"user_id": userID, "portfolio_id": portfolio.ID, "status": bson.M{"$ne": models.StatusDeleted}}
+		count, err := configs.GetCollection("transactions").CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			return fmt.Errorf("error checking transactions: %v", err)
+		}
+		if count > 0 {
+			return &CustomError{Code: "PORTFOLIO_NOT_EMPTY", Message: "The portfolio still has transactions. Archive it instead, or remove its transactions first."}
+		}
+		if _, err := configs.GetCollection("portfolios").DeleteOne(ctx, bson.M{"_id": portfolio.ID, "user_id": userID}); err != nil {
+			return fmt.Errorf("error deleting portfolio: %v", err)
+		}
+		if _, err := configs.GetCollection("accounts").DeleteMany(ctx, bson.M{"portfolio_id": portfolio.ID, "user_id": userID}); err != nil {
+			return fmt.Errorf("error deleting accounts: %v", err)
+		}
+		if _, err := configs.GetCollection("portfolio_snapshots").DeleteMany(ctx, bson.M{"portfolio_id": portfolio.ID, "user_id": userID}); err != nil {
+			return fmt.Errorf("error deleting portfolio snapshots: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetPortfolioView trả về danh mục {id} của người dùng, hoặc danh mục tổng hợp của mọi danh mục
+// chưa lưu trữ khi id rỗng hoặc là "all", kèm ID của các danh mục được tính
+func GetPortfolioView(userID primitive.ObjectID, id string) (*models.Portfolio, []primitive.ObjectID, error) {
+	if id != "" && id != AllPortfolios {
+		portfolio, err := FindUserPortfolio(userID, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return portfolio, []primitive.ObjectID{portfolio.ID}, nil
+	}
+
+	portfolios, err := ListPortfolios(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	active := make([]models.Portfolio, 0, len(portfolios))
+	ids := make([]primitive.ObjectID, 0, len(portfolios))
+	for _, portfolio := range portfolios {
+		if !portfolio.Archived {
+			active = append(active, portfolio)
+			ids = append(ids, portfolio.ID)
+		}
+	}
+	return aggregatePortfolios(userID, active), ids, nil
+}
+
+// aggregatePortfolios gộp các danh mục thành một danh mục chỉ dùng để hiển thị: các lô của cùng
+// coin trong cùng tài khoản được gộp lại rồi tính lại tổng số lượng và giá vốn; lời/lỗ đã thực hiện
+// và thu nhập được cộng theo các tiền tệ mà mọi danh mục có coin đó đều ghi nhận
+func aggregatePortfolios(userID primitive.ObjectID, portfolios []models.Portfolio) *models.Portfolio {
+	aggregate := &models.Portfolio{
+		UserID:          userID,
+		Name:            "All portfolios",
+		CoinHoldings:    make(map[string]models.CoinHolding),
+		AccountHoldings: make(map[string]map[string]models.CoinHolding),
+	}
+	coins := map[string]bool{}
+	for _, portfolio := range portfolios {
+		ensureAccountHoldings(&portfolio)
+		for account, holdings := range portfolio.AccountHoldings {
+			if aggregate.AccountHoldings[account] == nil {
+				aggregate.AccountHoldings[account] = make(map[string]models.CoinHolding)
+			}
+			for coin, holding := range holdings {
+				ensureLots(&holding)
+				merged := aggregate.AccountHoldings[account][coin]
+				merged.Lots = append(merged.Lots, holding.Lots...)
+				aggregate.AccountHoldings[account][coin] = merged
+				coins[coin] = true
+			}
+		}
+		mergeAmountsByCoin(&aggregate.RealizedPL, portfolio.RealizedPL)
+		mergeAmountsByCoin(&aggregate.Income, portfolio.Income)
+	}
+	for _, holdings := range aggregate.AccountHoldings {
+		for coin, holding := range holdings {
+			syncHoldingTotals(&holding)
+			holdings[coin] = holding
+		}
+	}
+	for coin := range coins {
+		syncCoinHolding(aggregate, coin)
+	}
+	return aggregate
+}
+
+// mergeAmountsByCoin cộng các số tiền theo coin của source vào target. Coin đã có trong target
+// chỉ giữ các tiền tệ có ở cả hai để tổng không bị thiếu phần của một danh mục
+func mergeAmountsByCoin(target *map[string]map[string]float64, source map[string]map[string]float64) {
+	for coin, amounts := range source {
+		if existing, ok := (*target)[coin]; ok {
+			(*target)[coin] = combineAmounts(existing, amounts, 1)
+			continue
+		}
+		addAmountsByCoin(target, coin, amounts)
+	}
+}
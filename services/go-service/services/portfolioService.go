@@ -4,25 +4,15 @@ import (
 	"context"
 	"crypto-folio/configs"
 	"crypto-folio/models"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"net/http"
-	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// Hàm phụ để tính toán giá mua trung bình mới
-func calculateAveragePrice(currentQuantity, currentPrice, additionalQuantity, additionalPrice float64) float64 {
-	totalCost := currentQuantity*currentPrice + additionalQuantity*additionalPrice
-	newQuantity := currentQuantity + additionalQuantity
-	return totalCost / newQuantity
-}
-
 // CustomError định nghĩa lỗi có mã lỗi và thông báo
 type CustomError struct {
 	Code    string `json:"code"`
@@ -33,187 +23,259 @@ func (e *CustomError) Error() string {
 	return e.Message
 }
 
-// UpdatePortfolio cập nhật danh mục đầu tư của người dùng dựa trên giao dịch mới
-func UpdatePortfolio(userID primitive.ObjectID, transaction models.Transaction) error {
-	// Tạo collection của portfolio và context với thời gian chờ
-	portfolioCollection := configs.GetCollection("portfolios")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Tìm hoặc tạo danh mục đầu tư của người dùng
-	var portfolio models.Portfolio
-	err := portfolioCollection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&portfolio)
+// RecordTransaction áp dụng giao dịch mới vào danh mục được gắn với giao dịch (danh mục mặc định nếu
+// PortfolioID trống) và lưu cả danh mục lẫn giao dịch trong cùng một lần ghi nguyên tử.
+// Các lô bị trừ khi bán được ghi ngược lại vào transaction
+func RecordTransaction(userID primitive.ObjectID, transaction *models.Transaction) error {
+	// Lấy phương pháp tính giá vốn của người dùng cho giao dịch bán
+	user, err := GetUser(userID)
 	if err != nil {
-		portfolio = models.Portfolio{
-			ID:           primitive.NewObjectID(),
-			UserID:       userID,
-			CoinHoldings: make(map[string]models.CoinHolding),
-		}
+		return fmt.Errorf("error fetching user: %v", err)
+	}
+	target, err := writablePortfolio(userID, transaction.PortfolioID)
+	if err != nil {
+		return err
+	}
+	transaction.PortfolioID = target.ID
+	if err := checkAccounts(userID, transaction); err != nil {
+		return err
 	}
 
-	// Lấy dữ liệu coin hiện tại từ danh mục đầu tư (nếu có)
-	holding, exists := portfolio.CoinHoldings[transaction.Coin]
-
-	// Xử lý giao dịch mua
-	if transaction.TransactionType == "buy" {
-		if exists {
-			// Tính toán giá trung bình mới nếu đã có coin
-			holding.AvgBuyPrice = calculateAveragePrice(holding.Quantity, holding.AvgBuyPrice, transaction.Amount, transaction.Price)
-			holding.Quantity += transaction.Amount
-		} else {
-			// Thêm coin mới vào danh mục nếu chưa có
-			holding = models.CoinHolding{
-				Quantity:    transaction.Amount,
-				AvgBuyPrice: transaction.Price,
+	return updateLedger(userID, target.ID, func(ctx context.Context, portfolio *models.Portfolio) error {
+		// Giao dịch ghi lùi ngày trước các giao dịch đã có làm thay đổi thứ tự trừ lô,
+		// nên danh mục được dựng lại bằng cách replay toàn bộ giao dịch theo thứ tự thời gian
+		backdated, err := hasLaterTransactions(ctx, userID, portfolio.ID, transaction.Date)
+		if err != nil {
+			return err
+		}
+		if backdated {
+			if err := replayWithTransaction(ctx, portfolio, transaction, user.GetCostBasisMethod()); err != nil {
+				return err
 			}
+		} else if err := applyTransaction(portfolio, transaction, user.GetCostBasisMethod()); err != nil {
+			return err
 		}
-		portfolio.CoinHoldings[transaction.Coin] = holding
 
-	} else if transaction.TransactionType == "sell" {
-		if !exists {
-			return &CustomError{Code: "COIN_NOT_IN_PORTFOLIO", Message: "This coin is not in your portfolio."}
-		}
-		if holding.Quantity < transaction.Amount {
-			return &CustomError{Code: "SELL_AMOUNT_EXCEEDS_HOLDING", Message: "The sell amount exceeds your current holding."}
-		}
-		holding.Quantity -= transaction.Amount
-		if holding.Quantity <= 0 {
-			delete(portfolio.CoinHoldings, transaction.Coin)
-		} else {
-			portfolio.CoinHoldings[transaction.Coin] = holding
+		// Ghi theo _id để lần thử lại không tạo bản ghi trùng
+		filter := bson.M{"_id": transaction.ID, "user_id": userID}
+		registerLedgerUndo(ctx, func(ctx context.Context) error {
+			_, err := configs.GetCollection("transactions").DeleteOne(ctx, filter)
+			return err
+		})
+		_, err = configs.GetCollection("transactions").ReplaceOne(ctx, filter, transaction, options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("error saving transaction: %v", err)
 		}
+		return nil
+	})
+}
+
+// loadPortfolio tìm danh mục portfolioID của người dùng
+func loadPortfolio(ctx context.Context, userID, portfolioID primitive.ObjectID) (*models.Portfolio, error) {
+	var portfolio models.Portfolio
+	err := configs.GetCollection("portfolios").FindOne(ctx, bson.M{"_id": portfolioID, "user_id": userID}).Decode(&portfolio)
+	if err == mongo.ErrNoDocuments {
+		return nil, portfolioNotFound()
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching portfolio: %v", err)
+	}
+	if portfolio.CoinHoldings == nil {
+		portfolio.CoinHoldings = make(map[string]models.CoinHolding)
 	}
+	return &portfolio, nil
+}
 
-	// Cập nhật hoặc thêm mới danh mục đầu tư với tùy chọn Upsert
-	filter := bson.M{"user_id": userID}
-	update := bson.M{"$set": bson.M{"coin_holdings": portfolio.CoinHoldings, "user_id": userID}}
-	_, err = portfolioCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+// savePortfolio lưu danh mục nếu version trong cơ sở dữ liệu vẫn là version đã đọc, rồi tăng version.
+// Trả về errPortfolioConflict nếu danh mục đã bị một yêu cầu khác ghi trước
+func savePortfolio(ctx context.Context, portfolio *models.Portfolio) error {
+	filter := bson.M{"_id": portfolio.ID, "version": portfolio.Version}
+	if portfolio.Version == 0 {
+		// Danh mục tạo trước khi có version không có trường này
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"coin_holdings":    portfolio.CoinHoldings,
+			"account_holdings": portfolio.AccountHoldings,
+			"realized_pl":      portfolio.RealizedPL,
+			"income":           portfolio.Income,
+		},
+		"$inc": bson.M{"version": 1},
+	}
+	result, err := configs.GetCollection("portfolios").UpdateOne(ctx, filter, update)
 	if err != nil {
 		return fmt.Errorf("error updating portfolio: %v", err)
 	}
-
+	if result.MatchedCount == 0 {
+		return errPortfolioConflict
+	}
+	portfolio.Version++
 	return nil
 }
 
-// GetUserPortfolio lấy danh mục đầu tư của người dùng từ cơ sở dữ liệu
-func GetUserPortfolio(userID primitive.ObjectID) (*models.Portfolio, error) {
-	// Kết nối tới collection portfolios
-	portfolioCollection := configs.GetCollection("portfolios")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Tìm danh mục đầu tư của người dùng với userID tương ứng
-	var portfolio models.Portfolio
-	err := portfolioCollection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&portfolio)
+// hasLaterTransactions kiểm tra danh mục có giao dịch đã hoàn thành nào sau thời điểm date hay không
+func hasLaterTransactions(ctx context.Context, userID, portfolioID primitive.ObjectID, date time.Time) (bool, error) {
+	filter := bson.M{"user_id": userID, "portfolio_id": portfolioID, "status": "completed", "date": bson.M{"$gt": date}}
+	count, err := configs.GetCollection("transactions").CountDocuments(ctx, filter, options.Count().SetLimit(1))
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("error checking transactions: %v", err)
 	}
-
-	// Trả về danh mục đầu tư của người dùng
-	return &portfolio, nil
+	return count > 0, nil
 }
 
-// BinancePrice là cấu trúc để parse kết quả từ Binance API
-type BinancePrice struct {
-	Symbol string `json:"symbol"`
-	Price  string `json:"price"`
-}
-
-// getCurrentPrice lấy giá hiện tại của coin từ Binance API
-func GetCurrentPrice(symbol string) (float64, float64, error) {
-	// Lấy giá USD từ Binance API
-	urlUSD := fmt.Sprintf("https://api.binance.com/api/v3/ticker/price?symbol=%sUSDT", symbol)
-	resp, err := http.Get(urlUSD)
+// loadLedger lấy toàn bộ giao dịch đã hoàn thành của danh mục portfolioID
+func loadLedger(ctx context.Context, userID, portfolioID primitive.ObjectID) ([]models.Transaction, error) {
+	filter := bson.M{"user_id": userID, "portfolio_id": portfolioID, "status": "completed"}
+	cursor, err := configs.GetCollection("transactions").Find(ctx, filter)
 	if err != nil {
-		return 0, 0, err
+		return nil, fmt.Errorf("error fetching transactions: %v", err)
 	}
-	defer resp.Body.Close()
+	defer cursor.Close(ctx)
 
-	var priceUSD BinancePrice
-	if err := json.NewDecoder(resp.Body).Decode(&priceUSD); err != nil {
-		return 0, 0, err
+	var transactions []models.Transaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, fmt.Errorf("error decoding transactions: %v", err)
 	}
+	return transactions, nil
+}
 
-	// Chuyển đổi chuỗi giá trị USD thành float
-	priceUSDValue, err := strconv.ParseFloat(priceUSD.Price, 64)
+// replayWithTransaction dựng lại danh mục từ các giao dịch đã lưu cộng thêm giao dịch mới (chưa lưu),
+// ghi các trường suy ra của giao dịch mới vào transaction và lưu lại các giao dịch cũ bị thay đổi
+func replayWithTransaction(ctx context.Context, portfolio *models.Portfolio, transaction *models.Transaction, method string) error {
+	transactions, err := loadLedger(ctx, portfolio.UserID, portfolio.ID)
 	if err != nil {
-		return 0, 0, err
+		return err
+	}
+	// Bỏ bản ghi của chính giao dịch nếu đã được ghi bởi một lần thử trước
+	transactions = excludeTransactions(transactions, map[primitive.ObjectID]bool{transaction.ID: true})
+	transactions = append(transactions, *transaction)
+	if err := replayTransactions(portfolio, transactions, method); err != nil {
+		return err
 	}
 
-	// Lấy giá JPY từ Binance API (nếu có)
-	urlJPY := fmt.Sprintf("https://api.binance.com/api/v3/ticker/price?symbol=%sJPY", symbol)
-	resp, err = http.Get(urlJPY)
-	if err != nil {
-		// Nếu không lấy được giá JPY trực tiếp, sử dụng tỷ giá USD/JPY
-		usdToJpyRate, rateErr := GetUSDToJPYRate()
-		if rateErr != nil {
-			return priceUSDValue, 0, nil // Trả về giá USD và bỏ qua JPY nếu không thể lấy tỷ giá
+	existing := make([]models.Transaction, 0, len(transactions)-1)
+	for _, replayed := range transactions {
+		if replayed.ID == transaction.ID {
+			*transaction = replayed
+			continue
 		}
-		return priceUSDValue, priceUSDValue * usdToJpyRate, nil // Tính giá JPY từ USD nếu không có JPY trực tiếp
+		existing = append(existing, replayed)
 	}
-	defer resp.Body.Close()
+	return saveLedgerFields(ctx, existing)
+}
 
-	var priceJPY BinancePrice
-	if err := json.NewDecoder(resp.Body).Decode(&priceJPY); err != nil {
-		// Nếu lỗi khi decode JPY, sử dụng tỷ giá USD/JPY
-		usdToJpyRate, rateErr := GetUSDToJPYRate()
-		if rateErr != nil {
-			return priceUSDValue, 0, nil
+// excludeTransactions trả về các giao dịch không có ID trong ids
+func excludeTransactions(transactions []models.Transaction, ids map[primitive.ObjectID]bool) []models.Transaction {
+	kept := transactions[:0]
+	for _, transaction := range transactions {
+		if !ids[transaction.ID] {
+			kept = append(kept, transaction)
 		}
-		return priceUSDValue, priceUSDValue * usdToJpyRate, nil
 	}
+	return kept
+}
 
-	// Chuyển đổi chuỗi giá trị JPY thành float
-	priceJPYValue, err := strconv.ParseFloat(priceJPY.Price, 64)
-	if err != nil {
-		// Nếu không thể chuyển đổi giá trị JPY thành số, sử dụng tỷ giá USD/JPY
-		usdToJpyRate, rateErr := GetUSDToJPYRate()
-		if rateErr != nil {
-			return priceUSDValue, 0, nil
+// saveLedgerFields lưu các trường được tính lại khi replay của những giao dịch đã có. Khi không có
+// transaction MongoDB, giá trị cũ được đọc trước để có thể hoàn tác nếu danh mục không lưu được
+func saveLedgerFields(ctx context.Context, transactions []models.Transaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+	if ledgerUndoActive(ctx) {
+		ids := make([]primitive.ObjectID, len(transactions))
+		for i, transaction := range transactions {
+			ids[i] = transaction.ID
 		}
-		return priceUSDValue, priceUSDValue * usdToJpyRate, nil
+		cursor, err := configs.GetCollection("transactions").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return fmt.Errorf("error fetching transactions: %v", err)
+		}
+		var previous []models.Transaction
+		if err := cursor.All(ctx, &previous); err != nil {
+			return fmt.Errorf("error decoding transactions: %v", err)
+		}
+		registerLedgerUndo(ctx, func(ctx context.Context) error {
+			return writeLedgerFields(ctx, previous)
+		})
 	}
-
-	return priceUSDValue, priceJPYValue, nil
+	return writeLedgerFields(ctx, transactions)
 }
 
-// GetUSDToJPYRate lấy tỷ giá USD sang JPY từ API
-func GetUSDToJPYRate() (float64, error) {
-	resp, err := http.Get("https://api.exchangerate-api.com/v4/latest/USD")
-	if err != nil {
-		return 0, err
+// writeLedgerFields ghi các trường suy ra khi replay của từng giao dịch theo _id
+func writeLedgerFields(ctx context.Context, transactions []models.Transaction) error {
+	if len(transactions) == 0 {
+		return nil
 	}
-	defer resp.Body.Close()
-
-	var data map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return 0, err
+	writes := make([]mongo.WriteModel, 0, len(transactions))
+	for _, transaction := range transactions {
+		update := bson.M{"$set": bson.M{
+			"cost_basis_method": transaction.CostBasisMethod,
+			"consumed_lots":     transaction.ConsumedLots,
+			"proceeds":          transaction.Proceeds,
+			"realized_pl":       transaction.RealizedPL,
+			"fee_value":         transaction.FeeValue,
+			"fee_lots":          transaction.FeeLots,
+			"income":            transaction.Income,
+		}}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": transaction.ID}).SetUpdate(update))
+	}
+	if _, err := configs.GetCollection("transactions").BulkWrite(ctx, writes); err != nil {
+		return fmt.Errorf("error saving replayed transactions: %v", err)
 	}
+	return nil
+}
 
-	rates, ok := data["rates"].(map[string]interface{})
-	if !ok {
-		return 0, errors.New("error parsing rates data")
+// GetCurrentPrice lấy giá hiện tại của coin theo USD và JPY thông qua cache giá
+func GetCurrentPrice(symbol string) (float64, float64, error) {
+	quotes, err := GetPrices([]string{symbol})
+	if err != nil {
+		return 0, 0, err
 	}
+	priceUSD := quotes[normalizeSymbol(symbol)].Price
 
-	jpyRate, ok := rates["JPY"].(float64)
-	if !ok {
-		return 0, errors.New("JPY rate not found")
+	// Tính giá JPY từ giá USD, bỏ qua JPY nếu không lấy được tỷ giá
+	usdToJpyRate, err := GetUSDToJPYRate()
+	if err != nil {
+		return priceUSD, 0, nil
 	}
+	return priceUSD, priceUSD * usdToJpyRate, nil
+}
 
-	return jpyRate, nil
+// GetUSDToJPYRate lấy tỷ giá USD sang JPY thông qua cache giá
+func GetUSDToJPYRate() (float64, error) {
+	return GetFiatRate("USD", "JPY")
 }
 
 // GetPriceHistory lấy lịch sử giá mua cho một coin cụ thể của người dùng chỉ cho các tháng có giao dịch mua
 func GetPriceHistory(userID primitive.ObjectID, coinSymbol string) ([]float64, error) {
+	histories, err := GetPriceHistories(userID, nil, []string{coinSymbol})
+	if err != nil {
+		return nil, err
+	}
+	return histories[coinSymbol], nil
+}
+
+// GetPriceHistories lấy lịch sử giá mua theo tháng cho nhiều coin chỉ với một truy vấn.
+// Chỉ tính giao dịch trong 12 tháng dương lịch gần nhất (tính cả tháng hiện tại) để mỗi chỉ mục tháng (0-11)
+// chỉ ứng với một tháng của một năm. portfolioIDs giới hạn các danh mục được tính, rỗng nghĩa là mọi danh mục của người dùng
+func GetPriceHistories(userID primitive.ObjectID, portfolioIDs []primitive.ObjectID, coinSymbols []string) (map[string][]float64, error) {
 	// Kết nối đến collection transactions
 	transactionCollection := configs.GetCollection("transactions")
 
-	// Tạo bộ lọc truy vấn các giao dịch mua của người dùng và coin cụ thể
+	// Giao dịch ghi lùi ngày có thể thuộc năm trước, chỉ lấy từ ngày đầu tiên của tháng cách đây 11 tháng
+	now := time.Now().UTC()
+	windowStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -11, 0)
+
+	// Tạo bộ lọc truy vấn các giao dịch mua của người dùng cho các coin cần lấy
 	filter := bson.M{
 		"user_id":          userID,
-		"coin":             coinSymbol,
+		"coin":             bson.M{"$in": coinSymbols},
 		"transaction_type": "buy",       // Lọc các giao dịch là mua
 		"status":           "completed", // Lấy các giao dịch đã hoàn thành
+		"date":             bson.M{"$gte": windowStart},
+	}
+	if len(portfolioIDs) > 0 {
+		filter["portfolio_id"] = bson.M{"$in": portfolioIDs}
 	}
 
 	// Sắp xếp các giao dịch theo thời gian để tính toán giá theo thứ tự
@@ -226,35 +288,42 @@ func GetPriceHistory(userID primitive.ObjectID, coinSymbol string) ([]float64, e
 	}
 	defer cursor.Close(context.Background())
 
-	// Khởi tạo mảng priceHistory với giá trị 0 cho mỗi tháng
-	priceHistory := make([]float64, 12)
-
-	// Tạo bản đồ lưu tổng giá và số lượng cho từng tháng có giao dịch mua
-	monthlyTotals := make(map[int]struct {
-		totalPrice  float64
-		totalAmount float64
-	})
-
-	// Duyệt qua các giao dịch và tổng hợp giá theo từng tháng có giao dịch mua
 	var transactions []models.Transaction
 	if err = cursor.All(context.Background(), &transactions); err != nil {
 		return nil, err
 	}
 
+	// Tạo bản đồ lưu tổng giá và số lượng cho từng coin và từng tháng có giao dịch mua
+	type monthlyTotal struct {
+		totalPrice  float64
+		totalAmount float64
+	}
+	totals := make(map[string]*[12]monthlyTotal)
 	for _, transaction := range transactions {
-		month := int(transaction.Date.Month()) - 1 // Lấy tháng, trừ đi 1 để phù hợp với chỉ mục mảng (0-11)
-		entry := monthlyTotals[month]
-		entry.totalPrice += transaction.Price * transaction.Amount
-		entry.totalAmount += transaction.Amount
-		monthlyTotals[month] = entry
+		coinTotals, ok := totals[transaction.Coin]
+		if !ok {
+			coinTotals = &[12]monthlyTotal{}
+			totals[transaction.Coin] = coinTotals
+		}
+		month := int(transaction.Date.UTC().Month()) - 1 // Lấy tháng, trừ đi 1 để phù hợp với chỉ mục mảng (0-11)
+		priceUSD, _ := transaction.PriceIn("USD")
+		coinTotals[month].totalPrice += priceUSD * transaction.Amount
+		coinTotals[month].totalAmount += transaction.Amount
 	}
 
-	// Tính giá trung bình cho mỗi tháng có giao dịch và lưu vào mảng priceHistory
-	for month, entry := range monthlyTotals {
-		if entry.totalAmount > 0 {
-			priceHistory[month] = entry.totalPrice / entry.totalAmount
+	// Tính giá trung bình cho mỗi tháng có giao dịch, các tháng không có giao dịch giữ giá trị 0
+	histories := make(map[string][]float64, len(coinSymbols))
+	for _, coinSymbol := range coinSymbols {
+		priceHistory := make([]float64, 12)
+		if coinTotals, ok := totals[coinSymbol]; ok {
+			for month, entry := range coinTotals {
+				if entry.totalAmount > 0 {
+					priceHistory[month] = entry.totalPrice / entry.totalAmount
+				}
+			}
 		}
+		histories[coinSymbol] = priceHistory
 	}
 
-	return priceHistory, nil
+	return histories, nil
 }
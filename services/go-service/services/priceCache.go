@@ -0,0 +1,405 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"crypto-folio/configs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPriceCacheTTL   = 30 * time.Second
+	defaultFiatCacheTTL    = time.Hour
+	defaultPriceStaleTTL   = 5 * time.Minute
+	defaultRefreshInterval = time.Minute
+	// fiatSource là tên nguồn dùng để cấu hình TTL cho tỷ giá tiền pháp định
+	fiatSource = "fx"
+)
+
+// PriceQuote là giá của một coin kèm nguồn và thời điểm lấy giá
+type PriceQuote struct {
+	Price     float64   `json:"price"`
+	Source    string    `json:"source"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	// Stale cho biết giá là giá cuối cùng đã biết vì mọi nguồn giá đều không phản hồi
+	Stale bool `json:"stale,omitempty"`
+}
+
+// PriceCache lưu giá và tỷ giá trong bộ nhớ với TTL theo từng nguồn.
+// Khi một giá hết hạn nhưng vẫn nằm trong khoảng stale, cache trả về giá cũ
+// và làm mới ở nền (stale-while-revalidate)
+type PriceCache struct {
+	mu         sync.RWMutex
+	entries    map[string]PriceQuote
+	refreshing map[string]bool
+	ttls       map[string]time.Duration
+	defaultTTL time.Duration
+	staleTTL   time.Duration
+}
+
+// NewPriceCache tạo cache với TTL mặc định, TTL riêng theo nguồn và khoảng stale cho phép
+func NewPriceCache(defaultTTL, staleTTL time.Duration, ttls map[string]time.Duration) *PriceCache {
+	if ttls == nil {
+		ttls = map[string]time.Duration{}
+	}
+	return &PriceCache{
+		entries:    make(map[string]PriceQuote),
+		refreshing: make(map[string]bool),
+		ttls:       ttls,
+		defaultTTL: defaultTTL,
+		staleTTL:   staleTTL,
+	}
+}
+
+// NewPriceCacheFromEnv đọc cấu hình cache từ biến môi trường
+// - PRICE_CACHE_TTL: TTL mặc định cho giá coin (ví dụ "30s")
+// - PRICE_CACHE_TTL_<NGUỒN>: TTL riêng cho từng nguồn, ví dụ PRICE_CACHE_TTL_BINANCE, PRICE_CACHE_TTL_FX
+// - PRICE_CACHE_STALE: thời gian tối đa vẫn trả về giá cũ sau khi hết hạn
+func NewPriceCacheFromEnv() *PriceCache {
+	ttls := map[string]time.Duration{fiatSource: defaultFiatCacheTTL}
+	for _, source := range []string{"binance", "coinbase", "kraken", "static", fiatSource} {
+		if ttl := durationFromEnv("PRICE_CACHE_TTL_"+strings.ToUpper(source), 0); ttl > 0 {
+			ttls[source] = ttl
+		}
+	}
+	return NewPriceCache(
+		durationFromEnv("PRICE_CACHE_TTL", defaultPriceCacheTTL),
+		durationFromEnv("PRICE_CACHE_STALE", defaultPriceStaleTTL),
+		ttls,
+	)
+}
+
+// durationFromEnv đọc một khoảng thời gian từ biến môi trường, trả về fallback nếu không hợp lệ
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid duration %q for %s, using %v", value, key, fallback)
+		return fallback
+	}
+	return duration
+}
+
+var (
+	priceCacheOnce sync.Once
+	priceCache     *PriceCache
+)
+
+// GetPriceCache trả về cache giá dùng chung của service
+func GetPriceCache() *PriceCache {
+	priceCacheOnce.Do(func() {
+		priceCache = NewPriceCacheFromEnv()
+	})
+	return priceCache
+}
+
+func priceKey(symbol string) string {
+	return "price:" + normalizeSymbol(symbol)
+}
+
+func fiatKey(base, quote string) string {
+	return "fx:" + normalizeSymbol(base) + ":" + normalizeSymbol(quote)
+}
+
+// ttlFor trả về TTL áp dụng cho một nguồn giá
+func (c *PriceCache) ttlFor(source string) time.Duration {
+	if ttl, ok := c.ttls[source]; ok {
+		return ttl
+	}
+	return c.defaultTTL
+}
+
+// lastKnown trả về giá cuối cùng đã biết của key, bất kể đã cũ bao lâu
+func (c *PriceCache) lastKnown(key string) (PriceQuote, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	quote, ok := c.entries[key]
+	if !ok {
+		return PriceQuote{}, false
+	}
+	quote.Stale = true
+	return quote, true
+}
+
+// lookup trả về giá trong cache và cho biết giá còn mới hay đã cũ nhưng vẫn dùng được
+func (c *PriceCache) lookup(key string) (quote PriceQuote, fresh bool, usable bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	quote, ok := c.entries[key]
+	if !ok {
+		return PriceQuote{}, false, false
+	}
+	age := time.Since(quote.FetchedAt)
+	ttl := c.ttlFor(quote.Source)
+	return quote, age <= ttl, age <= ttl+c.staleTTL
+}
+
+func (c *PriceCache) store(key string, quote PriceQuote) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = quote
+}
+
+// markRefreshing đánh dấu các key đang được làm mới, trả về những key chưa có ai làm mới
+func (c *PriceCache) markRefreshing(keys []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var marked []string
+	for _, key := range keys {
+		if !c.refreshing[key] {
+			c.refreshing[key] = true
+			marked = append(marked, key)
+		}
+	}
+	return marked
+}
+
+func (c *PriceCache) unmarkRefreshing(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		delete(c.refreshing, key)
+	}
+}
+
+// GetPrices trả về giá của các coin, ưu tiên lấy từ cache. Giá đã cũ được trả về ngay
+// và làm mới ở nền, còn giá chưa có hoặc quá cũ được lấy đồng bộ qua chuỗi nguồn giá.
+// Nếu mọi nguồn đều lỗi, giá cuối cùng đã biết được dùng thay thế; coin không có giá
+// nào sẽ vắng mặt trong kết quả và được liệt kê trong lỗi trả về
+func (c *PriceCache) GetPrices(symbols []string) (map[string]PriceQuote, error) {
+	symbols = uniqueSymbols(symbols)
+	quotes := make(map[string]PriceQuote, len(symbols))
+
+	var missing, stale []string
+	for _, symbol := range symbols {
+		quote, fresh, usable := c.lookup(priceKey(symbol))
+		switch {
+		case fresh:
+			quotes[symbol] = quote
+		case usable:
+			quotes[symbol] = quote
+			stale = append(stale, symbol)
+		default:
+			missing = append(missing, symbol)
+		}
+	}
+
+	if len(stale) > 0 {
+		go c.revalidatePrices(stale)
+	}
+
+	if len(missing) == 0 {
+		return quotes, nil
+	}
+
+	fetched, err := c.RefreshPrices(missing)
+	var unavailable []string
+	for _, symbol := range missing {
+		if quote, ok := fetched[symbol]; ok {
+			quotes[symbol] = quote
+		} else if quote, ok := c.lastKnown(priceKey(symbol)); ok {
+			quotes[symbol] = quote
+		} else {
+			unavailable = append(unavailable, symbol)
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: price refresh failed: %v", err)
+	}
+	if len(unavailable) > 0 {
+		return quotes, fmt.Errorf("price unavailable for %s", strings.Join(unavailable, ", "))
+	}
+	return quotes, nil
+}
+
+// revalidatePrices làm mới các giá đã cũ ở nền, bỏ qua những coin đang được làm mới
+func (c *PriceCache) revalidatePrices(symbols []string) {
+	keys := make([]string, len(symbols))
+	for i, symbol := range symbols {
+		keys[i] = priceKey(symbol)
+	}
+	marked := c.markRefreshing(keys)
+	if len(marked) == 0 {
+		return
+	}
+	defer c.unmarkRefreshing(marked)
+
+	toRefresh := make([]string, len(marked))
+	for i, key := range marked {
+		toRefresh[i] = strings.TrimPrefix(key, "price:")
+	}
+	if _, err := c.RefreshPrices(toRefresh); err != nil {
+		log.Printf("Warning: background price refresh failed: %v", err)
+	}
+}
+
+// RefreshPrices lấy giá mới nhất từ nguồn giá và ghi đè vào cache. Những giá lấy
+// được vẫn được lưu ngay cả khi một vài coin bị lỗi
+func (c *PriceCache) RefreshPrices(symbols []string) (map[string]PriceQuote, error) {
+	quotes, err := fetchPricesFromChain(symbols)
+	for symbol, quote := range quotes {
+		c.store(priceKey(symbol), quote)
+	}
+	return quotes, err
+}
+
+// GetFiatRate trả về tỷ giá base -> quote từ cache, áp dụng cùng cơ chế stale-while-revalidate
+func (c *PriceCache) GetFiatRate(base, quote string) (float64, error) {
+	key := fiatKey(base, quote)
+	cached, fresh, usable := c.lookup(key)
+	if fresh {
+		return cached.Price, nil
+	}
+	if usable {
+		go func() {
+			if len(c.markRefreshing([]string{key})) == 0 {
+				return
+			}
+			defer c.unmarkRefreshing([]string{key})
+			if _, err := c.RefreshFiatRate(base, quote); err != nil {
+				log.Printf("Warning: background fiat rate refresh failed: %v", err)
+			}
+		}()
+		return cached.Price, nil
+	}
+
+	rate, err := c.RefreshFiatRate(base, quote)
+	if err != nil {
+		if last, ok := c.lastKnown(key); ok {
+			log.Printf("Warning: using last known %s/%s rate: %v", base, quote, err)
+			return last.Price, nil
+		}
+		return 0, err
+	}
+	return rate, nil
+}
+
+// RefreshFiatRate lấy tỷ giá mới nhất qua chuỗi nguồn giá và ghi đè vào cache
+func (c *PriceCache) RefreshFiatRate(base, quote string) (float64, error) {
+	rate, err := fetchFiatRateFromChain(base, quote)
+	if err != nil {
+		return 0, err
+	}
+	c.store(fiatKey(base, quote), rate)
+	return rate.Price, nil
+}
+
+// cachedFiatPairs trả về các cặp tỷ giá đang có trong cache
+func (c *PriceCache) cachedFiatPairs() [][2]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var pairs [][2]string
+	for key := range c.entries {
+		parts := strings.Split(key, ":")
+		if len(parts) == 3 && parts[0] == "fx" {
+			pairs = append(pairs, [2]string{parts[1], parts[2]})
+		}
+	}
+	return pairs
+}
+
+// GetPrices lấy giá của các coin thông qua cache dùng chung
+func GetPrices(symbols []string) (map[string]PriceQuote, error) {
+	return GetPriceCache().GetPrices(symbols)
+}
+
+// GetFiatRate lấy tỷ giá base -> quote thông qua cache dùng chung
+func GetFiatRate(base, quote string) (float64, error) {
+	return GetPriceCache().GetFiatRate(base, quote)
+}
+
+// StartPriceRefresher chạy nền việc làm mới giá cho mọi coin có trong danh mục
+// hoặc watchlist của người dùng, theo chu kỳ PRICE_REFRESH_INTERVAL (đặt 0 để tắt)
+func StartPriceRefresher() {
+	interval := durationFromEnv("PRICE_REFRESH_INTERVAL", defaultRefreshInterval)
+	if interval <= 0 {
+		log.Println("Price refresher disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			refreshTrackedPrices()
+			<-ticker.C
+		}
+	}()
+}
+
+// refreshTrackedPrices làm mới giá của các coin đang được theo dõi và các tỷ giá đã cache
+func refreshTrackedPrices() {
+	cache := GetPriceCache()
+
+	symbols, err := trackedSymbols()
+	if err != nil {
+		log.Printf("Warning: could not load tracked symbols: %v", err)
+	} else if len(symbols) > 0 {
+		if _, err := cache.RefreshPrices(symbols); err != nil {
+			log.Printf("Warning: scheduled price refresh failed: %v", err)
+		}
+	}
+
+	for _, pair := range cache.cachedFiatPairs() {
+		if _, err := cache.RefreshFiatRate(pair[0], pair[1]); err != nil {
+			log.Printf("Warning: scheduled fiat rate refresh failed: %v", err)
+		}
+	}
+}
+
+// trackedSymbols thu thập ký hiệu coin từ mọi danh mục đầu tư và watchlist
+func trackedSymbols() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var symbols []string
+
+	// Lấy các coin đang nắm giữ trong mọi danh mục
+	cursor, err := configs.GetCollection("portfolios").Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"coin_holdings": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var portfolio struct {
+			CoinHoldings map[string]bson.Raw `bson:"coin_holdings"`
+		}
+		if err := cursor.Decode(&portfolio); err != nil {
+			return nil, err
+		}
+		for symbol := range portfolio.CoinHoldings {
+			symbols = append(symbols, symbol)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	// Watchlist lưu theo cặp giao dịch Binance (ví dụ BTCUSDT) nên bỏ hậu tố USDT
+	watched, err := configs.GetCollection("users").Distinct(ctx, "watchlist", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range watched {
+		if pair, ok := value.(string); ok {
+			symbols = append(symbols, strings.TrimSuffix(normalizeSymbol(pair), "USDT"))
+		}
+	}
+
+	return uniqueSymbols(symbols), nil
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// GuardedProvider bọc một PriceProvider bằng circuit breaker riêng
+type GuardedProvider struct {
+	PriceProvider
+	breaker *CircuitBreaker
+}
+
+// NewGuardedProvider bọc provider bằng breaker cấu hình từ PRICE_BREAKER_THRESHOLD và PRICE_BREAKER_COOLDOWN
+func NewGuardedProvider(provider PriceProvider) *GuardedProvider {
+	threshold := defaultBreakerThreshold
+	if value, err := strconv.Atoi(os.Getenv("PRICE_BREAKER_THRESHOLD")); err == nil && value > 0 {
+		threshold = value
+	}
+	cooldown := durationFromEnv("PRICE_BREAKER_COOLDOWN", defaultBreakerCooldown)
+	return &GuardedProvider{PriceProvider: provider, breaker: NewCircuitBreaker(threshold, cooldown)}
+}
+
+// GetPrices gọi nguồn giá nếu breaker cho phép. Nguồn chỉ bị tính là lỗi khi
+// không trả về được giá nào, vì một vài coin không niêm yết trên sàn là chuyện bình thường
+func (p *GuardedProvider) GetPrices(symbols []string) (map[string]float64, error) {
+	if !p.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+	prices, err := p.PriceProvider.GetPrices(symbols)
+	if err != nil && len(prices) == 0 {
+		p.breaker.RecordFailure(err)
+		return nil, err
+	}
+	p.breaker.RecordSuccess()
+	return prices, err
+}
+
+// GetPrice lấy giá một coin thông qua GetPrices để dùng chung logic breaker
+func (p *GuardedProvider) GetPrice(symbol string) (float64, error) {
+	prices, err := p.GetPrices([]string{symbol})
+	if err != nil {
+		return 0, err
+	}
+	return prices[normalizeSymbol(symbol)], nil
+}
+
+// GetFiatRate lấy tỷ giá nếu breaker cho phép
+func (p *GuardedProvider) GetFiatRate(base, quote string) (float64, error) {
+	if !p.breaker.Allow() {
+		return 0, ErrCircuitOpen
+	}
+	rate, err := p.PriceProvider.GetFiatRate(base, quote)
+	if err != nil {
+		p.breaker.RecordFailure(err)
+		return 0, err
+	}
+	p.breaker.RecordSuccess()
+	return rate, nil
+}
+
+// GetHistoricalPrice lấy giá lịch sử nếu nguồn giá hỗ trợ và breaker cho phép. Thiếu dữ liệu (coin không
+// niêm yết hoặc chưa có giá tại ngày đó) không bị tính là lỗi, để breaker dùng chung với giá hiện tại
+// không bị mở chỉ vì một coin mà sàn không có
+func (p *GuardedProvider) GetHistoricalPrice(symbol string, date time.Time) (float64, error) {
+	historical, ok := p.PriceProvider.(HistoricalPriceProvider)
+	if !ok {
+		return 0, fmt.Errorf("%s does not support historical prices", p.Name())
+	}
+	if !p.breaker.Allow() {
+		return 0, ErrCircuitOpen
+	}
+	price, err := historical.GetHistoricalPrice(symbol, date)
+	if err != nil {
+		if isMissingPriceData(err) {
+			p.breaker.RecordSuccess()
+		} else {
+			p.breaker.RecordFailure(err)
+		}
+		return 0, err
+	}
+	p.breaker.RecordSuccess()
+	return price, nil
+}
+
+// Health trả về tình trạng hiện tại của nguồn giá
+func (p *GuardedProvider) Health() ProviderHealth {
+	return p.breaker.Health(p.Name())
+}
+
+// fetchPricesFromChain lấy giá lần lượt qua từng nguồn trong chuỗi, coin nào chưa
+// có giá ở nguồn trước sẽ được hỏi ở nguồn kế tiếp. Kết quả ghi lại nguồn của từng giá
+func fetchPricesFromChain(symbols []string) (map[string]PriceQuote, error) {
+	remaining := uniqueSymbols(symbols)
+	quotes := make(map[string]PriceQuote, len(remaining))
+
+	var errs []string
+	for _, provider := range GetPriceProviders() {
+		if len(remaining) == 0 {
+			break
+		}
+
+		prices, err := provider.GetPrices(remaining)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", provider.Name(), err))
+		}
+
+		now := time.Now()
+		var next []string
+		for _, symbol := range remaining {
+			if price, ok := prices[symbol]; ok {
+				quotes[symbol] = PriceQuote{Price: price, Source: provider.Name(), FetchedAt: now}
+			} else {
+				next = append(next, symbol)
+			}
+		}
+		remaining = next
+	}
+
+	if len(remaining) > 0 {
+		return quotes, fmt.Errorf("no provider could price %s (%s)", strings.Join(remaining, ", "), strings.Join(errs, "; "))
+	}
+	return quotes, nil
+}
+
+// fetchFiatRateFromChain lấy tỷ giá từ nguồn đầu tiên trong chuỗi trả lời thành công
+func fetchFiatRateFromChain(base, quote string) (PriceQuote, error) {
+	var errs []string
+	for _, provider := range GetPriceProviders() {
+		rate, err := provider.GetFiatRate(base, quote)
+		if err == nil {
+			return PriceQuote{Price: rate, Source: fiatSource, FetchedAt: time.Now()}, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", provider.Name(), err))
+	}
+	return PriceQuote{}, fmt.Errorf("no provider could return %s/%s rate (%s)", base, quote, strings.Join(errs, "; "))
+}
+
+// fetchHistoricalPriceFromChain lấy giá lịch sử của coin từ nguồn đầu tiên trả lời thành công
+func fetchHistoricalPriceFromChain(symbol string, date time.Time) (PriceQuote, error) {
+	var errs []string
+	for _, provider := range GetPriceProviders() {
+		price, err := provider.GetHistoricalPrice(symbol, date)
+		if err == nil {
+			return PriceQuote{Price: price, Source: provider.Name(), FetchedAt: time.Now()}, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", provider.Name(), err))
+	}
+	return PriceQuote{}, fmt.Errorf("no provider could return historical price of %s (%s)", symbol, strings.Join(errs, "; "))
+}
+
+// GetProvidersHealth trả về tình trạng của mọi nguồn giá theo thứ tự ưu tiên
+func GetProvidersHealth() []ProviderHealth {
+	providers := GetPriceProviders()
+	health := make([]ProviderHealth, len(providers))
+	for i, provider := range providers {
+		health[i] = provider.Health()
+	}
+	return health
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PriceProvider là nguồn cung cấp giá coin (tính theo USD) và tỷ giá tiền pháp định
+type PriceProvider interface {
+	// Name trả về tên của nguồn giá, ví dụ "binance"
+	Name() string
+	// GetPrice trả về giá hiện tại của một coin theo USD
+	GetPrice(symbol string) (float64, error)
+	// GetPrices trả về giá hiện tại của nhiều coin, key là ký hiệu coin đã chuẩn hóa.
+	// Khi có lỗi, map vẫn có thể chứa giá của những coin lấy được thành công
+	GetPrices(symbols []string) (map[string]float64, error)
+	// GetFiatRate trả về số đơn vị quote nhận được cho 1 đơn vị base (ví dụ USD -> JPY)
+	GetFiatRate(base, quote string) (float64, error)
+}
+
+// HistoricalPriceProvider là nguồn giá có thể trả về giá đóng cửa của coin (theo USD) tại một ngày trong quá khứ
+type HistoricalPriceProvider interface {
+	GetHistoricalPrice(symbol string, date time.Time) (float64, error)
+}
+
+const (
+	defaultFiatRateURL = "https://api.exchangerate-api.com"
+	// defaultPriceWorkers là số request giá chạy song song tối đa khi sàn không hỗ trợ lấy theo lô
+	defaultPriceWorkers = 8
+)
+
+// errNoHistoricalPrice cho biết nguồn giá trả lời bình thường nhưng không có giá của coin tại ngày cần tính
+var errNoHistoricalPrice = errors.New("no historical price")
+
+// httpStatusError là phản hồi HTTP khác 200 từ API giá
+type httpStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.StatusCode, e.URL)
+}
+
+// isMissingPriceData cho biết lỗi là do nguồn giá không có dữ liệu (không có giá lịch sử hoặc phản hồi 4xx,
+// ví dụ coin không niêm yết) chứ không phải nguồn giá gặp sự cố. 429 vẫn là sự cố vì nguồn đang giới hạn request
+func isMissingPriceData(err error) bool {
+	if errors.Is(err, errNoHistoricalPrice) {
+		return true
+	}
+	var statusErr *httpStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+		statusErr.StatusCode != http.StatusTooManyRequests
+}
+
+// httpClient dùng chung cho mọi lời gọi API giá, có thời gian chờ để tránh treo request
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// defaultProviderChain là thứ tự nguồn giá mặc định khi không cấu hình
+const defaultProviderChain = "binance,coinbase,kraken"
+
+var (
+	priceProvidersMu sync.RWMutex
+	priceProviders   []*GuardedProvider
+)
+
+// InitPriceProviders khởi tạo chuỗi nguồn giá dựa trên biến môi trường
+// - PRICE_PROVIDERS: danh sách nguồn theo thứ tự ưu tiên, ví dụ "binance,coinbase,kraken"
+// - PRICE_PROVIDER: dùng một nguồn duy nhất nếu PRICE_PROVIDERS không được đặt
+// - PRICE_PROVIDER_URL_<TÊN>: ghi đè base URL của từng sàn, ví dụ PRICE_PROVIDER_URL_BINANCE (dùng cho stub khi test)
+// - PRICE_PROVIDER_URL: ghi đè base URL của nguồn đầu tiên trong chuỗi nếu nguồn đó không có biến riêng
+// - FIAT_RATE_URL: ghi đè base URL của API tỷ giá
+// - PRICE_FIXTURE_FILE: tệp JSON giá cố định cho nguồn static
+func InitPriceProviders() error {
+	names := os.Getenv("PRICE_PROVIDERS")
+	if names == "" {
+		names = os.Getenv("PRICE_PROVIDER")
+	}
+	if names == "" {
+		names = defaultProviderChain
+	}
+
+	var providers []PriceProvider
+	for _, name := range strings.Split(names, ",") {
+		// Bỏ qua phần tử rỗng, ví dụ dấu phẩy thừa ở cuối danh sách
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		baseURL := os.Getenv("PRICE_PROVIDER_URL_" + strings.ToUpper(name))
+		if baseURL == "" && len(providers) == 0 {
+			baseURL = os.Getenv("PRICE_PROVIDER_URL")
+		}
+		provider, err := newPriceProvider(name, baseURL)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		return fmt.Errorf("no price provider configured")
+	}
+	SetPriceProviders(providers...)
+	return nil
+}
+
+// NewPriceProvider tạo PriceProvider theo tên, base URL được ghi đè bằng PRICE_PROVIDER_URL_<TÊN> nếu có
+func NewPriceProvider(name string) (PriceProvider, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return newPriceProvider(name, os.Getenv("PRICE_PROVIDER_URL_"+strings.ToUpper(name)))
+}
+
+// newPriceProvider tạo PriceProvider theo tên với base URL baseURL (rỗng là URL mặc định của sàn)
+func newPriceProvider(name, baseURL string) (PriceProvider, error) {
+	fiatURL := os.Getenv("FIAT_RATE_URL")
+	if fiatURL == "" {
+		fiatURL = defaultFiatRateURL
+	}
+
+	switch name {
+	case "binance":
+		return NewBinanceProvider(baseURL, fiatURL), nil
+	case "coinbase":
+		return NewCoinbaseProvider(baseURL), nil
+	case "kraken":
+		return NewKrakenProvider(baseURL, fiatURL), nil
+	case "static":
+		return NewStaticProviderFromFile(os.Getenv("PRICE_FIXTURE_FILE"))
+	default:
+		return nil, fmt.Errorf("unknown price provider: %s", name)
+	}
+}
+
+// SetPriceProviders thay thế chuỗi nguồn giá, mỗi nguồn có circuit breaker riêng
+func SetPriceProviders(providers ...PriceProvider) {
+	guarded := make([]*GuardedProvider, len(providers))
+	for i, provider := range providers {
+		guarded[i] = NewGuardedProvider(provider)
+	}
+
+	priceProvidersMu.Lock()
+	defer priceProvidersMu.Unlock()
+	priceProviders = guarded
+}
+
+// SetPriceProvider dùng một nguồn giá duy nhất (ví dụ StaticProvider trong test)
+func SetPriceProvider(provider PriceProvider) {
+	SetPriceProviders(provider)
+}
+
+// GetPriceProviders trả về chuỗi nguồn giá hiện tại, mặc định là Binance nếu chưa khởi tạo
+func GetPriceProviders() []*GuardedProvider {
+	priceProvidersMu.RLock()
+	providers := priceProviders
+	priceProvidersMu.RUnlock()
+	if len(providers) > 0 {
+		return providers
+	}
+
+	priceProvidersMu.Lock()
+	defer priceProvidersMu.Unlock()
+	if len(priceProviders) == 0 {
+		priceProviders = []*GuardedProvider{NewGuardedProvider(NewBinanceProvider("", defaultFiatRateURL))}
+	}
+	return priceProviders
+}
+
+// GetPriceProvider trả về nguồn giá ưu tiên cao nhất trong chuỗi
+func GetPriceProvider() PriceProvider {
+	return GetPriceProviders()[0]
+}
+
+// normalizeSymbol chuẩn hóa ký hiệu coin hoặc tiền tệ về dạng chữ hoa
+func normalizeSymbol(symbol string) string {
+	return strings.ToUpper(strings.TrimSpace(symbol))
+}
+
+// getJSON gọi GET tới url và giải mã phản hồi JSON vào out
+func getJSON(url string, out interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{StatusCode: resp.StatusCode, URL: url}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fetchFiatRate lấy tỷ giá base -> quote từ API tương thích exchangerate-api
+func fetchFiatRate(baseURL, base, quote string) (float64, error) {
+	base, quote = normalizeSymbol(base), normalizeSymbol(quote)
+	if base == quote {
+		return 1, nil
+	}
+
+	var data struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := getJSON(fmt.Sprintf("%s/v4/latest/%s", strings.TrimRight(baseURL, "/"), base), &data); err != nil {
+		return 0, err
+	}
+
+	rate, ok := data.Rates[quote]
+	if !ok {
+		return 0, errors.New(quote + " rate not found")
+	}
+	return rate, nil
+}
+
+// priceWorkers trả về kích thước worker pool lấy giá, cấu hình bằng PRICE_FETCH_WORKERS
+func priceWorkers() int {
+	if workers, err := strconv.Atoi(os.Getenv("PRICE_FETCH_WORKERS")); err == nil && workers > 0 {
+		return workers
+	}
+	return defaultPriceWorkers
+}
+
+// uniqueSymbols chuẩn hóa và loại bỏ ký hiệu trùng lặp, giữ nguyên thứ tự ban đầu
+func uniqueSymbols(symbols []string) []string {
+	seen := make(map[string]bool, len(symbols))
+	result := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		symbol = normalizeSymbol(symbol)
+		if symbol == "" || seen[symbol] {
+			continue
+		}
+		seen[symbol] = true
+		result = append(result, symbol)
+	}
+	return result
+}
+
+// fetchPricesConcurrently gọi fetch cho từng coin bằng một worker pool có giới hạn.
+// Nếu có coin không lấy được giá, hàm trả về lỗi đầu tiên kèm giá của các coin còn lại
+func fetchPricesConcurrently(symbols []string, fetch func(symbol string) (float64, error)) (map[string]float64, error) {
+	symbols = uniqueSymbols(symbols)
+	prices := make(map[string]float64, len(symbols))
+	if len(symbols) == 0 {
+		return prices, nil
+	}
+
+	workers := priceWorkers()
+	if workers > len(symbols) {
+		workers = len(symbols)
+	}
+
+	type result struct {
+		symbol string
+		price  float64
+		err    error
+	}
+	jobs := make(chan string)
+	results := make(chan result, len(symbols))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for symbol := range jobs {
+				price, err := fetch(symbol)
+				results <- result{symbol: symbol, price: price, err: err}
+			}
+		}()
+	}
+
+	for _, symbol := range symbols {
+		jobs <- symbol
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	var firstErr error
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to get price for %s: %v", res.symbol, res.err)
+			}
+			continue
+		}
+		prices[res.symbol] = res.price
+	}
+	return prices, firstErr
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rebuildTimeout là thời gian chờ khi dựng lại danh mục vì phải đọc và ghi toàn bộ sổ giao dịch
+const rebuildTimeout = 30 * time.Second
+
+// driftTolerance là sai lệch tối đa giữa dữ liệu đã lưu và dữ liệu replay vẫn được xem là khớp
+const driftTolerance = 1e-8
+
+// HoldingDrift là sai lệch của một coin giữa danh mục đã lưu và danh mục dựng lại từ sổ giao dịch
+type HoldingDrift struct {
+	Coin                  string  `json:"coin"`
+	StoredQuantity        float64 `json:"stored_quantity"`
+	ReplayedQuantity      float64 `json:"replayed_quantity"`
+	StoredCostBasisUSD    float64 `json:"stored_cost_basis_usd"`
+	ReplayedCostBasisUSD  float64 `json:"replayed_cost_basis_usd"`
+	StoredRealizedPLUSD   float64 `json:"stored_realized_pl_usd"`
+	ReplayedRealizedPLUSD float64 `json:"replayed_realized_pl_usd"`
+}
+
+// ConsistencyReport là kết quả so sánh một danh mục đã lưu với danh mục replay từ sổ giao dịch của nó
+type ConsistencyReport struct {
+	UserID        primitive.ObjectID `json:"user_id"`
+	PortfolioID   primitive.ObjectID `json:"portfolio_id"`
+	PortfolioName string             `json:"portfolio_name"`
+	Consistent    bool               `json:"consistent"`
+	Drifts        []HoldingDrift     `json:"drifts"`
+	ReplayError   *CustomError       `json:"replay_error,omitempty"` // Lỗi khi sổ giao dịch không thể replay (ví dụ bán vượt số lượng)
+	CheckedAt     time.Time          `json:"checked_at"`
+}
+
+// RebuildPortfolio dựng lại mọi danh mục của người dùng bằng cách replay sổ giao dịch của từng danh mục
+// theo thứ tự thời gian, lưu danh mục mới và các trường suy ra của từng giao dịch
+func RebuildPortfolio(userID primitive.ObjectID) ([]models.Portfolio, error) {
+	user, err := GetUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user: %v", err)
+	}
+	portfolios, err := ListPortfolios(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rebuilt := make([]models.Portfolio, 0, len(portfolios))
+	for _, stored := range portfolios {
+		var result *models.Portfolio
+		err = updateLedger(userID, stored.ID, func(ctx context.Context, portfolio *models.Portfolio) error {
+			transactions, err := loadLedger(ctx, userID, portfolio.ID)
+			if err != nil {
+				return err
+			}
+			if err := replayTransactions(portfolio, transactions, user.GetCostBasisMethod()); err != nil {
+				return err
+			}
+			result = portfolio
+			return saveLedgerFields(ctx, transactions)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.IsDefault = stored.IsDefault
+		rebuilt = append(rebuilt, *result)
+	}
+	return rebuilt, nil
+}
+
+// replayLedger replay sổ giao dịch của danh mục portfolioID vào một danh mục mới trong bộ nhớ mà không lưu lại
+func replayLedger(ctx context.Context, userID, portfolioID primitive.ObjectID) (*models.Portfolio, []models.Transaction, error) {
+	user, err := GetUser(userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching user: %v", err)
+	}
+	transactions, err := loadLedger(ctx, userID, portfolioID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	portfolio := &models.Portfolio{ID: portfolioID, UserID: userID}
+	if err := replayTransactions(portfolio, transactions, user.GetCostBasisMethod()); err != nil {
+		return nil, nil, err
+	}
+	return portfolio, transactions, nil
+}
+
+// CheckPortfolioConsistency so sánh từng danh mục đã lưu của người dùng với danh mục replay từ sổ giao dịch
+// và báo cáo các coin bị lệch số lượng, giá vốn hoặc lời/lỗ đã thực hiện
+func CheckPortfolioConsistency(userID primitive.ObjectID) ([]*ConsistencyReport, error) {
+	portfolios, err := ListPortfolios(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+	defer cancel()
+
+	reports := make([]*ConsistencyReport, 0, len(portfolios))
+	for i := range portfolios {
+		stored := &portfolios[i]
+		report := &ConsistencyReport{
+			UserID:        userID,
+			PortfolioID:   stored.ID,
+			PortfolioName: stored.Name,
+			Drifts:        []HoldingDrift{},
+			CheckedAt:     time.Now(),
+		}
+		reports = append(reports, report)
+
+		replayed, _, err := replayLedger(ctx, userID, stored.ID)
+		if customErr, ok := err.(*CustomError); ok {
+			report.ReplayError = customErr
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		report.Drifts = comparePortfolios(stored, replayed)
+		report.Consistent = len(report.Drifts) == 0
+	}
+	return reports, nil
+}
+
+// CheckAllPortfolios chạy kiểm tra nhất quán cho mọi danh mục và chỉ trả về các danh mục bị lệch
+func CheckAllPortfolios() ([]*ConsistencyReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userIDs, err := configs.GetCollection("portfolios").Distinct(ctx, "user_id", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing portfolios: %v", err)
+	}
+
+	reports := []*ConsistencyReport{}
+	for _, value := range userIDs {
+		userID, ok := value.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		userReports, err := CheckPortfolioConsistency(userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, report := range userReports {
+			if !report.Consistent {
+				reports = append(reports, report)
+			}
+		}
+	}
+	return reports, nil
+}
+
+// comparePortfolios trả về các coin có số lượng, giá vốn USD hoặc lời/lỗ đã thực hiện USD khác nhau
+func comparePortfolios(stored, replayed *models.Portfolio) []HoldingDrift {
+	coins := map[string]bool{}
+	for _, portfolio := range []*models.Portfolio{stored, replayed} {
+		for coin := range portfolio.CoinHoldings {
+			coins[coin] = true
+		}
+		for coin := range portfolio.RealizedPL {
+			coins[coin] = true
+		}
+	}
+
+	drifts := []HoldingDrift{}
+	for coin := range coins {
+		storedHolding, replayedHolding := stored.CoinHoldings[coin], replayed.CoinHoldings[coin]
+		drift := HoldingDrift{
+			Coin:                  coin,
+			StoredQuantity:        storedHolding.Quantity,
+			ReplayedQuantity:      replayedHolding.Quantity,
+			StoredCostBasisUSD:    storedHolding.Quantity * storedHolding.AvgBuyPrice,
+			ReplayedCostBasisUSD:  replayedHolding.Quantity * replayedHolding.AvgBuyPrice,
+			StoredRealizedPLUSD:   stored.RealizedPL[coin]["USD"],
+			ReplayedRealizedPLUSD: replayed.RealizedPL[coin]["USD"],
+		}
+		if differs(drift.StoredQuantity, drift.ReplayedQuantity) ||
+			differs(drift.StoredCostBasisUSD, drift.ReplayedCostBasisUSD) ||
+			differs(drift.StoredRealizedPLUSD, drift.ReplayedRealizedPLUSD) {
+			drifts = append(drifts, drift)
+		}
+	}
+	sort.Slice(drifts, func(a, b int) bool { return drifts[a].Coin < drifts[b].Coin })
+	return drifts
+}
+
+// differs so sánh hai số theo sai số tương đối driftTolerance
+func differs(a, b float64) bool {
+	scale := math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+	return math.Abs(a-b) > driftTolerance*scale
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// StaticProvider trả về giá cố định, dùng cho test hoặc môi trường không có internet
+type StaticProvider struct {
+	// Prices là giá USD theo ký hiệu coin
+	Prices map[string]float64 `json:"prices"`
+	// Rates là số đơn vị tiền tệ tương ứng với 1 USD
+	Rates map[string]float64 `json:"rates"`
+}
+
+// NewStaticProvider tạo StaticProvider từ bảng giá và tỷ giá cho trước
+func NewStaticProvider(prices, rates map[string]float64) *StaticProvider {
+	provider := &StaticProvider{Prices: map[string]float64{}, Rates: map[string]float64{"USD": 1}}
+	for symbol, price := range prices {
+		provider.Prices[normalizeSymbol(symbol)] = price
+	}
+	for currency, rate := range rates {
+		provider.Rates[normalizeSymbol(currency)] = rate
+	}
+	return provider
+}
+
+// NewStaticProviderFromFile đọc bảng giá từ tệp JSON dạng {"prices": {...}, "rates": {...}}
+func NewStaticProviderFromFile(path string) (*StaticProvider, error) {
+	if path == "" {
+		return nil, errors.New("PRICE_FIXTURE_FILE is required for the static price provider")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture StaticProvider
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("invalid price fixture: %v", err)
+	}
+	return NewStaticProvider(fixture.Prices, fixture.Rates), nil
+}
+
+func (p *StaticProvider) Name() string {
+	return "static"
+}
+
+func (p *StaticProvider) GetPrice(symbol string) (float64, error) {
+	price, ok := p.Prices[normalizeSymbol(symbol)]
+	if !ok {
+		return 0, fmt.Errorf("price not found for %s", symbol)
+	}
+	return price, nil
+}
+
+func (p *StaticProvider) GetPrices(symbols []string) (map[string]float64, error) {
+	symbols = uniqueSymbols(symbols)
+	prices := make(map[string]float64, len(symbols))
+	var firstErr error
+	for _, symbol := range symbols {
+		price, err := p.GetPrice(symbol)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		prices[symbol] = price
+	}
+	return prices, firstErr
+}
+
+// GetFiatRate tính tỷ giá chéo base -> quote thông qua USD
+func (p *StaticProvider) GetFiatRate(base, quote string) (float64, error) {
+	baseRate, ok := p.Rates[normalizeSymbol(base)]
+	if !ok || baseRate == 0 {
+		return 0, errors.New(base + " rate not found")
+	}
+	quoteRate, ok := p.Rates[normalizeSymbol(quote)]
+	if !ok {
+		return 0, errors.New(quote + " rate not found")
+	}
+	return quoteRate / baseRate, nil
+}
+
+// GetHistoricalPrice luôn trả về lỗi vì bảng giá static không có lịch sử; giá hiện tại không được dùng thay
+// vì sẽ bị lưu như giá tại ngày giao dịch
+func (p *StaticProvider) GetHistoricalPrice(symbol string, date time.Time) (float64, error) {
+	return 0, fmt.Errorf("%w for %s on %s: static prices have no history", errNoHistoricalPrice, normalizeSymbol(symbol), date.UTC().Format("2006-01-02"))
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TransactionFilter là điều kiện lọc giao dịch của người dùng khi liệt kê hoặc export.
+// From bao gồm, To không bao gồm; danh sách rỗng nghĩa là không lọc theo trường đó.
+// Statuses rỗng lấy mọi giao dịch chưa bị xóa; PortfolioID trống lấy giao dịch của mọi danh mục.
+// AccountID lấy giao dịch từ hoặc tới tài khoản đó (kể cả chuyển giữa các tài khoản)
+type TransactionFilter struct {
+	From        time.Time
+	To          time.Time
+	Coins       []string
+	Types       []string
+	Statuses    []string
+	PortfolioID primitive.ObjectID
+	AccountID   primitive.ObjectID
+}
+
+// Validate chuẩn hóa ký hiệu coin và kiểm tra loại, trạng thái và khoảng thời gian của bộ lọc
+func (f *TransactionFilter) Validate() error {
+	for i, coin := range f.Coins {
+		f.Coins[i] = normalizeSymbol(coin)
+	}
+	for i, transactionType := range f.Types {
+		f.Types[i] = strings.ToLower(strings.TrimSpace(transactionType))
+		if !models.IsValidTransactionType(f.Types[i]) {
+			return invalidTransactionType(f.Types[i])
+		}
+	}
+	for i, status := range f.Statuses {
+		f.Statuses[i] = strings.ToLower(strings.TrimSpace(status))
+		switch f.Statuses[i] {
+		case models.StatusCompleted, models.StatusVoid, models.StatusDeleted:
+		default:
+			return &CustomError{Code: "INVALID_STATUS", Message: fmt.Sprintf("Transaction status %q is not supported.", status)}
+		}
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return &CustomError{Code: "INVALID_DATE_RANGE", Message: "The start date must be before the end date."}
+	}
+	return nil
+}
+
+// query tạo bộ lọc MongoDB cho các giao dịch của người dùng userID
+func (f *TransactionFilter) query(userID primitive.ObjectID) bson.M {
+	query := bson.M{"user_id": userID}
+	if !f.PortfolioID.IsZero() {
+		query["portfolio_id"] = f.PortfolioID
+	}
+	// Các điều kiện $or được gộp trong $and để không đè lên nhau hay lên $or của tìm kiếm khi liệt kê giao dịch
+	var and bson.A
+	if !f.AccountID.IsZero() {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"account_id": f.AccountID}, bson.M{"to_account_id": f.AccountID},
+		}})
+	}
+	if len(f.Statuses) > 0 {
+		query["status"] = bson.M{"$in": f.Statuses}
+	} else {
+		query["status"] = bson.M{"$ne": models.StatusDeleted}
+	}
+	if len(f.Coins) > 0 {
+		// Swap thuộc về cả coin gửi đi lẫn coin nhận về
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"coin": bson.M{"$in": f.Coins}}, bson.M{"to_coin": bson.M{"$in": f.Coins}},
+		}})
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+	if len(f.Types) > 0 {
+		query["transaction_type"] = bson.M{"$in": f.Types}
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		date := bson.M{}
+		if !f.From.IsZero() {
+			date["$gte"] = f.From
+		}
+		if !f.To.IsZero() {
+			date["$lt"] = f.To
+		}
+		query["date"] = date
+	}
+	return query
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Giới hạn số giao dịch trên một trang
+const (
+	defaultTransactionPageSize = 50
+	maxTransactionPageSize     = 200
+)
+
+// transactionSortFields là các trường được phép sắp xếp danh sách giao dịch
+var transactionSortFields = map[string]bool{"date": true, "created_at": true, "amount": true}
+
+// TransactionPage là tham số phân trang của danh sách giao dịch. Cursor là giá trị next_cursor của trang trước;
+// Search tìm theo coin, coin nhận về, nguồn import, ID phía sàn và lý do hủy (không phân biệt hoa thường)
+type TransactionPage struct {
+	Limit  int
+	Cursor string
+	Sort   string // date (mặc định), created_at hoặc amount
+	Order  string // desc (mặc định) hoặc asc
+	Search string
+}
+
+// TransactionList là một trang giao dịch kèm tổng số giao dịch khớp bộ lọc
+type TransactionList struct {
+	Transactions []models.Transaction `json:"transactions"`
+	Total        int64                `json:"total"`
+	Limit        int                  `json:"limit"`
+	NextCursor   string               `json:"next_cursor,omitempty"`
+	HasMore      bool                 `json:"has_more"`
+}
+
+// pageCursor là vị trí của giao dịch cuối trang trước theo trường sắp xếp và _id
+type pageCursor struct {
+	Sort   string    `json:"s"`
+	Order  string    `json:"o"`
+	Time   time.Time `json:"t,omitempty"`
+	Number float64   `json:"n,omitempty"`
+	ID     string    `json:"id"`
+}
+
+// invalidPageCursor trả về lỗi cho cursor không hợp lệ hoặc không khớp cách sắp xếp hiện tại
+func invalidPageCursor() error {
+	return &CustomError{Code: "INVALID_CURSOR", Message: "The pagination cursor is not valid for this listing."}
+}
+
+// normalize kiểm tra và gán giá trị mặc định cho tham số phân trang
+func (p *TransactionPage) normalize() error {
+	if p.Limit <= 0 {
+		p.Limit = defaultTransactionPageSize
+	}
+	if p.Limit > maxTransactionPageSize {
+		p.Limit = maxTransactionPageSize
+	}
+	p.Sort = strings.ToLower(p.Sort)
+	if p.Sort == "" {
+		p.Sort = "date"
+	}
+	if !transactionSortFields[p.Sort] {
+		return &CustomError{Code: "INVALID_SORT", Message: fmt.Sprintf("Sorting by %q is not supported.", p.Sort)}
+	}
+	p.Order = strings.ToLower(p.Order)
+	if p.Order == "" {
+		p.Order = "desc"
+	}
+	if p.Order != "asc" && p.Order != "desc" {
+		return &CustomError{Code: "INVALID_SORT", Message: "The order must be asc or desc."}
+	}
+	p.Search = strings.TrimSpace(p.Search)
+	return nil
+}
+
+// ListTransactions trả về một trang giao dịch của người dùng theo bộ lọc, cách sắp xếp và cursor.
+// Phân trang theo khóa (trường sắp xếp, _id) nên kết quả ổn định khi có giao dịch mới được thêm
+func ListTransactions(userID primitive.ObjectID, filter TransactionFilter, page TransactionPage) (*TransactionList, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := page.normalize(); err != nil {
+		return nil, err
+	}
+
+	query := filter.query(userID)
+	if page.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(page.Search), Options: "i"}
+		query["$or"] = bson.A{
+			bson.M{"coin": pattern}, bson.M{"to_coin": pattern}, bson.M{"source": pattern},
+			bson.M{"external_id": pattern}, bson.M{"void_reason": pattern},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collection := configs.GetCollection("transactions")
+
+	// Tổng số giao dịch khớp bộ lọc, không phụ thuộc trang hiện tại
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error counting transactions: %v", err)
+	}
+
+	direction := -1
+	if page.Order == "asc" {
+		direction = 1
+	}
+	pageQuery := query
+	if page.Cursor != "" {
+		after, err := page.after(direction)
+		if err != nil {
+			return nil, err
+		}
+		pageQuery = bson.M{"$and": bson.A{query, after}}
+	}
+
+	// Đọc thêm một giao dịch để biết còn trang sau hay không
+	opts := options.Find().
+		SetSort(bson.D{{Key: page.Sort, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(page.Limit + 1))
+	cursor, err := collection.Find(ctx, pageQuery, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching transactions: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	transactions := []models.Transaction{}
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, fmt.Errorf("error decoding transactions: %v", err)
+	}
+
+	list := &TransactionList{Total: total, Limit: page.Limit}
+	if len(transactions) > page.Limit {
+		transactions = transactions[:page.Limit]
+		list.HasMore = true
+		list.NextCursor = page.encodeCursor(transactions[len(transactions)-1])
+	}
+	list.Transactions = transactions
+	return list, nil
+}
+
+// encodeCursor tạo cursor trỏ tới sau giao dịch last
+func (p *TransactionPage) encodeCursor(last models.Transaction) string {
+	position := pageCursor{Sort: p.Sort, Order: p.Order, ID: last.ID.Hex()}
+	switch p.Sort {
+	case "date":
+		position.Time = last.Date
+	case "created_at":
+		position.Time = last.CreatedAt
+	case "amount":
+		position.Number = last.Amount
+	}
+	data, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// after giải mã cursor thành điều kiện lấy các giao dịch nằm sau vị trí của cursor
+func (p *TransactionPage) after(direction int) (bson.M, error) {
+	data, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return nil, invalidPageCursor()
+	}
+	var position pageCursor
+	if err := json.Unmarshal(data, &position); err != nil || position.Sort != p.Sort || position.Order != p.Order {
+		return nil, invalidPageCursor()
+	}
+	id, err := primitive.ObjectIDFromHex(position.ID)
+	if err != nil {
+		return nil, invalidPageCursor()
+	}
+
+	var value interface{} = position.Time
+	if p.Sort == "amount" {
+		value = position.Number
+	}
+	operator := "$lt"
+	if direction > 0 {
+		operator = "$gt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{p.Sort: bson.M{operator: value}},
+		bson.M{p.Sort: value, "_id": bson.M{operator: id}},
+	}}, nil
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxClockSkew là độ lệch đồng hồ cho phép giữa máy người dùng và server khi kiểm tra ngày giao dịch
+const maxClockSkew = 5 * time.Minute
+
+// PrepareTransaction chuẩn bị một giao dịch mới trước khi ghi vào danh mục: kiểm tra dữ liệu,
+// gán metadata (người dùng, ID, ngày tạo, trạng thái) và ghi lại tỷ giá tại ngày giao dịch sang
+// USD và các tiền tệ trong currencies. Dùng chung cho AddTransaction và các luồng import
+func PrepareTransaction(userID primitive.ObjectID, transaction *models.Transaction, currencies []string) error {
+	// Dùng thời điểm hiện tại khi người dùng không gửi ngày giao dịch
+	if transaction.Date.IsZero() {
+		transaction.Date = time.Now()
+	}
+	if err := ValidateTransaction(transaction); err != nil {
+		return err
+	}
+
+	// ID luôn do server cấp, _id gửi kèm trong body bị bỏ qua
+	transaction.UserID = userID
+	transaction.ID = primitive.NewObjectID()
+	transaction.CreatedAt = time.Now()
+	transaction.Status = models.StatusCompleted
+
+	if err := PopulateTransactionFX(transaction, currencies); err != nil {
+		return err
+	}
+	// Value là giá trị giao dịch theo JPY mà giao diện lịch sử hiển thị
+	if transaction.Value == 0 {
+		transaction.Value = transaction.CostIn()["JPY"]
+	}
+	return nil
+}
+
+// ValidateTransaction kiểm tra dữ liệu giao dịch do người dùng gửi lên trước khi lấy tỷ giá
+// và cập nhật danh mục, đồng thời chuẩn hóa ký hiệu coin
+func ValidateTransaction(transaction *models.Transaction) error {
+	if !models.IsValidTransactionType(transaction.TransactionType) {
+		return invalidTransactionType(transaction.TransactionType)
+	}
+
+	transaction.Coin = normalizeSymbol(transaction.Coin)
+	if !currencySymbolPattern.MatchString(transaction.Coin) {
+		return &CustomError{Code: "INVALID_COIN", Message: "Specify a valid coin symbol."}
+	}
+	if transaction.Amount <= 0 {
+		return &CustomError{Code: "INVALID_AMOUNT", Message: "The amount must be greater than zero."}
+	}
+	if transaction.Price < 0 {
+		return &CustomError{Code: "INVALID_PRICE", Message: "The price cannot be negative."}
+	}
+	if transaction.FeeAmount < 0 {
+		return &CustomError{Code: "INVALID_FEE_AMOUNT", Message: "The fee amount cannot be negative."}
+	}
+
+	// Ngày giao dịch do người dùng gửi lên (kèm múi giờ) không được ở tương lai
+	latest := time.Now().Add(maxClockSkew)
+	if transaction.Date.IsZero() {
+		return &CustomError{Code: "INVALID_TRADE_DATE", Message: "Specify the trade date."}
+	}
+	if transaction.Date.After(latest) {
+		return &CustomError{Code: "FUTURE_TRADE_DATE", Message: "The trade date cannot be in the future."}
+	}
+	if !transaction.AcquiredAt.IsZero() && transaction.AcquiredAt.After(transaction.Date) {
+		return &CustomError{Code: "INVALID_ACQUIRED_DATE", Message: "The original acquisition date must be before the trade date."}
+	}
+
+	if !transaction.ToAccountID.IsZero() && transaction.TransactionType != models.TransactionTransfer {
+		return &CustomError{Code: "INVALID_TO_ACCOUNT", Message: "Only a transfer can move coins to another account."}
+	}
+
+	if transaction.TransactionType == models.TransactionSwap {
+		return prepareSwap(transaction)
+	}
+	return nil
+}
+
+// prepareSwap kiểm tra hai vế của giao dịch swap và định giá giao dịch theo coin nhận về:
+// QuoteCurrency là ToCoin và Price là số ToCoin nhận được cho mỗi đơn vị Coin, để tỷ giá
+// tại ngày giao dịch của ToCoin định giá cả hai vế
+func prepareSwap(transaction *models.Transaction) error {
+	transaction.ToCoin = normalizeSymbol(transaction.ToCoin)
+	if !currencySymbolPattern.MatchString(transaction.ToCoin) {
+		return &CustomError{Code: "INVALID_TO_COIN", Message: "Specify a valid coin symbol to receive."}
+	}
+	if transaction.ToCoin == transaction.Coin {
+		return &CustomError{Code: "INVALID_TO_COIN", Message: "A swap must receive a different coin."}
+	}
+	if transaction.ToAmount <= 0 {
+		return &CustomError{Code: "INVALID_TO_AMOUNT", Message: "The received amount must be greater than zero."}
+	}
+	transaction.QuoteCurrency = transaction.ToCoin
+	transaction.Price = transaction.ToAmount / transaction.Amount
+	return nil
+}
+
+// FindUserTransaction lấy giao dịch theo ID, chỉ khi giao dịch thuộc về người dùng userID
+func FindUserTransaction(ctx context.Context, userID primitive.ObjectID, id string) (*models.Transaction, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, &CustomError{Code: "TRANSACTION_NOT_FOUND", Message: "Transaction not found."}
+	}
+
+	var transaction models.Transaction
+	filter := bson.M{"_id": objectID, "user_id": userID, "status": bson.M{"$ne": models.StatusDeleted}}
+	if err := configs.GetCollection("transactions").FindOne(ctx, filter).Decode(&transaction); err != nil {
+		return nil, &CustomError{Code: "TRANSACTION_NOT_FOUND", Message: "Transaction not found."}
+	}
+	return &transaction, nil
+}
+
+// transactionPortfolioID trả về danh mục chứa giao dịch {id}; giao dịch cũ chưa gắn danh mục
+// thuộc danh mục mặc định
+func transactionPortfolioID(userID primitive.ObjectID, id string) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transaction, err := FindUserTransaction(ctx, userID, id)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	portfolio, err := userPortfolio(ctx, userID, transaction.PortfolioID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return portfolio.ID, nil
+}
+
+// RemoveTransaction loại giao dịch khỏi danh mục bằng cách chuyển trạng thái sang void hoặc deleted.
+// Bản ghi gốc được giữ lại; danh mục được dựng lại từ các giao dịch còn lại và thao tác bị từ chối
+// nếu việc bỏ giao dịch làm một giao dịch bán sau đó vượt quá số lượng đang giữ
+func RemoveTransaction(userID primitive.ObjectID, id, status, reason string) error {
+	user, err := GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("error fetching user: %v", err)
+	}
+
+	portfolioID, err := transactionPortfolioID(userID, id)
+	if err != nil {
+		return err
+	}
+
+	return updateLedger(userID, portfolioID, func(ctx context.Context, portfolio *models.Portfolio) error {
+		transaction, err := FindUserTransaction(ctx, userID, id)
+		if err != nil {
+			return err
+		}
+		if transaction.Status != models.StatusCompleted && !(status == models.StatusDeleted && transaction.Status == models.StatusVoid) {
+			return &CustomError{Code: "TRANSACTION_NOT_ACTIVE", Message: fmt.Sprintf("The transaction is already %s.", transaction.Status)}
+		}
+
+		transactions, err := loadLedger(ctx, userID, portfolio.ID)
+		if err != nil {
+			return err
+		}
+		remaining := transactions[:0]
+		for _, existing := range transactions {
+			if existing.ID != transaction.ID {
+				remaining = append(remaining, existing)
+			}
+		}
+
+		// Replay trước khi ghi để không làm hỏng danh mục khi giao dịch còn cần thiết
+		if err := replayTransactions(portfolio, remaining, user.GetCostBasisMethod()); err != nil {
+			if customErr, ok := err.(*CustomError); ok {
+				return &CustomError{Code: "TRANSACTION_REQUIRED_BY_LATER_TRADE", Message: "Removing this transaction would break a later trade: " + customErr.Message}
+			}
+			return err
+		}
+
+		update := bson.M{"$set": bson.M{"status": status, "voided_at": time.Now(), "void_reason": reason}}
+		previous := *transaction
+		registerLedgerUndo(ctx, func(ctx context.Context) error {
+			_, err := configs.GetCollection("transactions").ReplaceOne(ctx, bson.M{"_id": previous.ID, "user_id": userID}, previous)
+			return err
+		})
+		if _, err := configs.GetCollection("transactions").UpdateOne(ctx, bson.M{"_id": transaction.ID}, update); err != nil {
+			return fmt.Errorf("error updating transaction status: %v", err)
+		}
+		return saveLedgerFields(ctx, remaining)
+	})
+}
+
+// EditTransaction sửa các trường được phép của giao dịch thuộc về người dùng, lấy lại tỷ giá khi cần
+// và dựng lại danh mục. Việc sửa bị từ chối nếu sổ giao dịch sau khi sửa không thể replay
+// (ví dụ một giao dịch bán sau đó vượt quá số lượng đang giữ)
+func EditTransaction(userID primitive.ObjectID, id string, patch *models.TransactionPatch) (*models.Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	transaction, err := FindUserTransaction(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if transaction.Status != models.StatusCompleted {
+		return nil, &CustomError{Code: "TRANSACTION_NOT_ACTIVE", Message: fmt.Sprintf("A %s transaction cannot be edited.", transaction.Status)}
+	}
+	portfolio, err := userPortfolio(ctx, userID, transaction.PortfolioID)
+	if err != nil {
+		return nil, err
+	}
+	transaction.PortfolioID = portfolio.ID
+
+	// Giá của swap là số coin nhận về cho mỗi coin gửi đi, không dùng được cho loại giao dịch khác
+	if transaction.TransactionType == models.TransactionSwap && patch.TransactionType != nil &&
+		*patch.TransactionType != models.TransactionSwap && patch.Price == nil {
+		return nil, &CustomError{Code: "INVALID_PRICE", Message: "Specify the price when changing a swap to another type."}
+	}
+
+	// Kiểm tra và lấy tỷ giá trước khi ghi để không gọi API bên ngoài trong transaction MongoDB
+	if patch.Apply(transaction) {
+		transaction.FXRates, transaction.FeeRates = nil, nil
+	}
+	if err := ValidateTransaction(transaction); err != nil {
+		return nil, err
+	}
+	if err := checkTransactionAccounts(ctx, userID, transaction); err != nil {
+		return nil, err
+	}
+	user, err := GetUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user: %v", err)
+	}
+	if err := PopulateTransactionFX(transaction, user.GetDisplayCurrencies()); err != nil {
+		return nil, err
+	}
+	if patch.ChangesValue() {
+		transaction.Value = transaction.CostIn()["JPY"]
+	}
+	edited := *transaction
+
+	err = updateLedger(userID, edited.PortfolioID, func(ctx context.Context, portfolio *models.Portfolio) error {
+		transactions, err := loadLedger(ctx, userID, portfolio.ID)
+		if err != nil {
+			return err
+		}
+		found := false
+		var previous models.Transaction
+		for i := range transactions {
+			if transactions[i].ID == edited.ID {
+				previous = transactions[i]
+				transactions[i], found = edited, true
+			}
+		}
+		if !found {
+			// Giao dịch đã bị hủy hoặc xóa bởi một yêu cầu khác
+			return &CustomError{Code: "TRANSACTION_NOT_FOUND", Message: "Transaction not found."}
+		}
+		if err := replayTransactions(portfolio, transactions, user.GetCostBasisMethod()); err != nil {
+			return err
+		}
+
+		others := make([]models.Transaction, 0, len(transactions))
+		for _, replayed := range transactions {
+			if replayed.ID == edited.ID {
+				*transaction = replayed
+				continue
+			}
+			others = append(others, replayed)
+		}
+		filter := bson.M{"_id": transaction.ID, "user_id": userID}
+		registerLedgerUndo(ctx, func(ctx context.Context) error {
+			_, err := configs.GetCollection("transactions").ReplaceOne(ctx, filter, previous)
+			return err
+		})
+		if _, err := configs.GetCollection("transactions").ReplaceOne(ctx, filter, transaction); err != nil {
+			return fmt.Errorf("error updating transaction: %v", err)
+		}
+		return saveLedgerFields(ctx, others)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
@@ -0,0 +1,552 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"crypto-folio/configs"
+	"crypto-folio/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxValueHistoryPoints giới hạn số điểm của một chuỗi giá trị để tránh lấy quá nhiều giá lịch sử trong một request
+const maxValueHistoryPoints = 1000
+
+// defaultSnapshotInterval là chu kỳ mặc định của việc ghi snapshot giá trị danh mục hằng ngày
+const defaultSnapshotInterval = 24 * time.Hour
+
+// snapshotBackfillDays là số ngày gần nhất được ghi snapshot mỗi lần chạy nền, để bù các ngày server không chạy
+const snapshotBackfillDays = 7
+
+// Một request chuỗi giá trị chỉ định giá tối đa maxPricedPointsPerRequest ngày chưa có snapshot và dừng sau
+// valuePricingTimeout; các ngày còn lại được trả về ở trạng thái pending và được bổ sung nền trong tối đa
+// snapshotBackfillTimeout
+const (
+	maxPricedPointsPerRequest = 31
+	valuePricingTimeout       = 15 * time.Second
+	snapshotBackfillTimeout   = 10 * time.Minute
+)
+
+// snapshotBackfills đánh dấu các danh mục đang được bổ sung snapshot nền để không chạy trùng
+var snapshotBackfills sync.Map
+
+// defaultValueResolutions là độ phân giải mặc định của từng khoảng thời gian
+var defaultValueResolutions = map[string]string{
+	"1W":  "day",
+	"1M":  "day",
+	"YTD": "day",
+	"1Y":  "week",
+	"ALL": "month",
+}
+
+// ValuePoint là giá trị danh mục vào cuối một ngày
+type ValuePoint struct {
+	Date          time.Time `json:"date"`
+	Value         float64   `json:"value"`
+	CostBasis     float64   `json:"cost_basis"`
+	MissingPrices []string  `json:"missing_prices,omitempty"` // Coin không có giá lịch sử tại ngày này
+	Pending       bool      `json:"pending,omitempty"`        // Chưa được định giá, giá trị sẽ có ở lần gọi sau
+}
+
+// ValueHistory là chuỗi giá trị theo thời gian của một danh mục hoặc của danh mục tổng hợp
+type ValueHistory struct {
+	PortfolioID   string       `json:"portfolio_id"` // "all" với danh mục tổng hợp
+	PortfolioName string       `json:"portfolio_name"`
+	Range         string       `json:"range"`
+	Resolution    string       `json:"resolution"`
+	Currency      string       `json:"currency"`
+	From          time.Time    `json:"from"`
+	To            time.Time    `json:"to"`
+	Points        []ValuePoint `json:"points"`
+	Change        float64      `json:"change"`         // Chênh lệch giá trị giữa điểm cuối và điểm đầu đã được định giá
+	ChangePercent float64      `json:"change_percent"` // Bằng 0 khi điểm đầu không có giá trị
+	Pending       bool         `json:"pending"`        // Có điểm đang được định giá nền, gọi lại sau để có chuỗi đầy đủ
+}
+
+// pricingBudget giới hạn số ngày được định giá bằng API giá bên ngoài và thời gian định giá của một lần dựng
+// chuỗi giá trị. Budget nil là không giới hạn
+type pricingBudget struct {
+	points   int // Số ngày còn được định giá, âm là không giới hạn số ngày
+	deadline time.Time
+}
+
+// newPricingBudget tạo budget cho points ngày (âm là không giới hạn) trong thời gian timeout
+func newPricingBudget(points int, timeout time.Duration) *pricingBudget {
+	return &pricingBudget{points: points, deadline: time.Now().Add(timeout)}
+}
+
+// expired cho biết đã hết thời gian định giá
+func (b *pricingBudget) expired() bool {
+	return b != nil && time.Now().After(b.deadline)
+}
+
+// take giữ chỗ định giá cho một ngày, trả về false khi đã hết số ngày hoặc hết thời gian
+func (b *pricingBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	if b.points == 0 || b.expired() {
+		return false
+	}
+	if b.points > 0 {
+		b.points--
+	}
+	return true
+}
+
+// GetValueHistory dựng chuỗi giá trị của danh mục portfolioID ("" hoặc "all" là tổng hợp mọi danh mục chưa lưu trữ)
+// trong khoảng rangeName (1W, 1M, YTD, 1Y, ALL) với độ phân giải day, week hoặc month. Mỗi điểm là giá trị cuối
+// ngày theo giá đóng cửa của các coin đang giữ, quy đổi sang currency (mặc định tiền tệ cơ sở của người dùng).
+// Điểm đã có snapshot được trả về ngay; điểm chưa có được định giá trong giới hạn của pricingBudget, phần còn lại
+// được đánh dấu pending và được định giá nền
+func GetValueHistory(userID primitive.ObjectID, portfolioID, rangeName, resolution, currency string) (*ValueHistory, error) {
+	rangeName = strings.ToUpper(strings.TrimSpace(rangeName))
+	if rangeName == "" {
+		rangeName = "1M"
+	}
+	defaultResolution, ok := defaultValueResolutions[rangeName]
+	if !ok {
+		return nil, &CustomError{Code: "INVALID_RANGE", Message: "Range must be 1W, 1M, YTD, 1Y or ALL."}
+	}
+	resolution = strings.ToLower(strings.TrimSpace(resolution))
+	if resolution == "" {
+		resolution = defaultResolution
+	}
+	if resolution != "day" && resolution != "week" && resolution != "month" {
+		return nil, &CustomError{Code: "INVALID_RESOLUTION", Message: "Resolution must be day, week or month."}
+	}
+	if currency == "" {
+		baseCurrency, _, err := GetUserCurrencies(userID)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching user currencies: %v", err)
+		}
+		currency = baseCurrency
+	}
+	currency, err := NormalizeCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := GetUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user: %v", err)
+	}
+	portfolio, portfolioIDs, err := GetPortfolioView(userID, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	ledgers, err := loadLedgers(userID, portfolioIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	today := startOfDay(time.Now())
+	dates := valueSeriesDates(valueRangeStart(rangeName, today, ledgers), today, resolution)
+	if len(dates) > maxValueHistoryPoints {
+		return nil, &CustomError{Code: "INVALID_RESOLUTION", Message: fmt.Sprintf("The range has more than %d points. Choose a coarser resolution.", maxValueHistoryPoints)}
+	}
+
+	history := &ValueHistory{
+		PortfolioID:   AllPortfolios,
+		PortfolioName: portfolio.Name,
+		Range:         rangeName,
+		Resolution:    resolution,
+		Currency:      currency,
+		From:          dates[0],
+		To:            dates[len(dates)-1],
+		Points:        make([]ValuePoint, len(dates)),
+	}
+	if !portfolio.ID.IsZero() {
+		history.PortfolioID = portfolio.ID.Hex()
+	}
+	for i, date := range dates {
+		history.Points[i].Date = date
+	}
+
+	// Giá trị của danh mục tổng hợp là tổng giá trị của từng danh mục tại cùng ngày
+	method := user.GetCostBasisMethod()
+	budget := newPricingBudget(maxPricedPointsPerRequest, valuePricingTimeout)
+	for _, id := range portfolioIDs {
+		snapshots := valueSeries(userID, id, ledgers[id], method, dates, today, budget)
+		pending := []time.Time{}
+		for i, snapshot := range snapshots {
+			point := &history.Points[i]
+			point.Value += snapshot.ValueUSD
+			point.CostBasis += snapshot.CostBasisUSD
+			point.MissingPrices = mergeSymbols(point.MissingPrices, snapshot.MissingPrices)
+			if snapshot.Pending {
+				point.Pending, history.Pending = true, true
+				pending = append(pending, snapshot.Date)
+			}
+		}
+		if len(pending) > 0 {
+			go backfillSnapshots(userID, id, method, pending, today)
+		}
+	}
+
+	if currency != "USD" {
+		// Chuỗi giá trị chỉ để hiển thị nên tỷ giá hiện tại được dùng khi thiếu tỷ giá lịch sử hoặc hết thời gian định giá
+		var currentRate float64
+		for i := range history.Points {
+			point := &history.Points[i]
+			if point.Pending {
+				continue
+			}
+			rate, err := 0.0, errNoHistoricalRate
+			if !budget.expired() {
+				rate, err = GetHistoricalRate("USD", currency, point.Date)
+			}
+			if errors.Is(err, errNoHistoricalRate) {
+				if currentRate == 0 {
+					currentRate, err = GetFiatRate("USD", currency)
+				}
+				rate = currentRate
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error fetching USD/%s rate: %v", currency, err)
+			}
+			point.Value *= rate
+			point.CostBasis *= rate
+		}
+	}
+
+	// Mức thay đổi được tính giữa điểm đầu và điểm cuối đã được định giá
+	var priced []ValuePoint
+	for _, point := range history.Points {
+		if !point.Pending {
+			priced = append(priced, point)
+		}
+	}
+	if len(priced) > 0 {
+		first, last := priced[0].Value, priced[len(priced)-1].Value
+		history.Change = last - first
+		if first > 0 {
+			history.ChangePercent = (last - first) / first * 100
+		}
+	}
+	return history, nil
+}
+
+// backfillSnapshots định giá nền các ngày dates chưa được định giá của danh mục portfolioID và lưu snapshot
+// để các lần gọi sau đọc được. Mỗi danh mục chỉ có một lần bổ sung chạy cùng lúc
+func backfillSnapshots(userID, portfolioID primitive.ObjectID, method string, dates []time.Time, today time.Time) {
+	if _, running := snapshotBackfills.LoadOrStore(portfolioID, true); running {
+		return
+	}
+	defer snapshotBackfills.Delete(portfolioID)
+
+	ledgers, err := loadLedgers(userID, []primitive.ObjectID{portfolioID})
+	if err != nil {
+		log.Printf("Warning: could not backfill snapshots of portfolio %s: %v", portfolioID.Hex(), err)
+		return
+	}
+	valueSeries(userID, portfolioID, ledgers[portfolioID], method, dates, today, newPricingBudget(-1, snapshotBackfillTimeout))
+}
+
+// loadLedgers đọc sổ giao dịch đã sắp xếp của từng danh mục trong portfolioIDs
+func loadLedgers(userID primitive.ObjectID, portfolioIDs []primitive.ObjectID) (map[primitive.ObjectID][]models.Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+	defer cancel()
+
+	ledgers := make(map[primitive.ObjectID][]models.Transaction, len(portfolioIDs))
+	for _, id := range portfolioIDs {
+		transactions, err := loadLedger(ctx, userID, id)
+		if err != nil {
+			return nil, err
+		}
+		sortTransactions(transactions)
+		ledgers[id] = transactions
+	}
+	return ledgers, nil
+}
+
+// valueRangeStart trả về ngày bắt đầu của khoảng rangeName tính đến hôm nay. ALL bắt đầu từ
+// ngày của giao dịch đầu tiên trong các sổ giao dịch (hôm nay nếu chưa có giao dịch)
+func valueRangeStart(rangeName string, today time.Time, ledgers map[primitive.ObjectID][]models.Transaction) time.Time {
+	switch rangeName {
+	case "1W":
+		return today.AddDate(0, 0, -7)
+	case "1M":
+		return today.AddDate(0, -1, 0)
+	case "YTD":
+		return time.Date(today.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	case "1Y":
+		return today.AddDate(-1, 0, 0)
+	}
+	start := today
+	for _, transactions := range ledgers {
+		if len(transactions) > 0 && transactions[0].Date.Before(start) {
+			start = startOfDay(transactions[0].Date)
+		}
+	}
+	return start
+}
+
+// valueSeriesDates trả về các ngày của chuỗi giá trị từ from đến to (luôn gồm to), tăng dần. Với week các
+// điểm cách nhau 7 ngày tính lùi từ to; với month các điểm là ngày cuối của từng tháng trước tháng của to
+func valueSeriesDates(from, to time.Time, resolution string) []time.Time {
+	dates := []time.Time{}
+	for date := to; !date.Before(from); {
+		dates = append(dates, date)
+		switch resolution {
+		case "day":
+			date = date.AddDate(0, 0, -1)
+		case "week":
+			date = date.AddDate(0, 0, -7)
+		default:
+			date = time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+		}
+	}
+	for left, right := 0, len(dates)-1; left < right; left, right = left+1, right-1 {
+		dates[left], dates[right] = dates[right], dates[left]
+	}
+	return dates
+}
+
+// valueSeries replay sổ giao dịch transactions (đã sắp xếp) của danh mục portfolioID và trả về snapshot cuối
+// ngày của từng ngày trong dates. Snapshot đã lưu được dùng lại khi số lượng và giá vốn vẫn khớp với sổ giao
+// dịch; các ngày còn lại được định giá từ ngày gần nhất trở về trước trong giới hạn của budget, ngày vượt quá
+// budget được đánh dấu Pending. Snapshot mới của các ngày đã kết thúc được lưu lại. Ngày hôm nay luôn được
+// định giá theo giá hiện tại. Giao dịch không replay được bị bỏ qua để một giao dịch lỗi không làm mất cả chuỗi
+func valueSeries(userID, portfolioID primitive.ObjectID, transactions []models.Transaction, method string, dates []time.Time, today time.Time, budget *pricingBudget) []models.PortfolioSnapshot {
+	stored, err := loadSnapshots(portfolioID, dates[0], dates[len(dates)-1])
+	if err != nil {
+		// Không đọc được snapshot thì định giá lại như khi chưa có snapshot
+		log.Printf("Warning: %v", err)
+		stored = map[int64]models.PortfolioSnapshot{}
+	}
+
+	portfolio := &models.Portfolio{ID: portfolioID, UserID: userID}
+	snapshots := make([]models.PortfolioSnapshot, len(dates))
+	unpriced := []int{}
+	next := 0
+	for i, date := range dates {
+		// Áp dụng mọi giao dịch trước khi ngày date kết thúc
+		end := date.Add(24 * time.Hour)
+		for next < len(transactions) && transactions[next].Date.Before(end) {
+			if err := applyTransaction(portfolio, &transactions[next], method); err != nil {
+				log.Printf("Warning: skipping transaction %s in value history of portfolio %s: %v", transactions[next].ID.Hex(), portfolioID.Hex(), err)
+			}
+			next++
+		}
+
+		snapshot := ledgerSnapshot(portfolio, date)
+		existing, found := stored[date.Unix()]
+		if date.Before(today) && found && sameSnapshotHoldings(existing, snapshot) && len(existing.MissingPrices) == 0 {
+			snapshots[i] = existing
+			continue
+		}
+		snapshots[i] = snapshot
+		unpriced = append(unpriced, i)
+	}
+
+	writes := []mongo.WriteModel{}
+	for k := len(unpriced) - 1; k >= 0; k-- {
+		snapshot := &snapshots[unpriced[k]]
+		if len(snapshot.Holdings) > 0 && !budget.take() {
+			snapshot.Pending = true
+			continue
+		}
+		priceSnapshot(snapshot)
+		if !snapshot.Date.Before(today) {
+			continue
+		}
+		filter := bson.M{"portfolio_id": portfolioID, "date": snapshot.Date}
+		if len(snapshot.Holdings) == 0 {
+			// Danh mục không còn coin vào ngày này, snapshot cũ (nếu có) không còn đúng
+			if _, found := stored[snapshot.Date.Unix()]; found {
+				writes = append(writes, mongo.NewDeleteOneModel().SetFilter(filter))
+			}
+		} else if len(snapshot.MissingPrices) == 0 {
+			update := bson.M{
+				"$set": bson.M{
+					"user_id":        userID,
+					"holdings":       snapshot.Holdings,
+					"prices":         snapshot.Prices,
+					"value_usd":      snapshot.ValueUSD,
+					"cost_basis_usd": snapshot.CostBasisUSD,
+				},
+				"$setOnInsert": bson.M{"created_at": time.Now()},
+			}
+			writes = append(writes, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+		}
+	}
+
+	if len(writes) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := configs.GetCollection("portfolio_snapshots").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			log.Printf("Warning: could not store portfolio snapshots: %v", err)
+		}
+	}
+	return snapshots
+}
+
+// loadSnapshots đọc các snapshot đã lưu của danh mục trong khoảng [from, to], theo Unix time của ngày
+func loadSnapshots(portfolioID primitive.ObjectID, from, to time.Time) (map[int64]models.PortfolioSnapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"portfolio_id": portfolioID, "date": bson.M{"$gte": from, "$lte": to}}
+	cursor, err := configs.GetCollection("portfolio_snapshots").Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching portfolio snapshots: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var snapshots []models.PortfolioSnapshot
+	if err := cursor.All(ctx, &snapshots); err != nil {
+		return nil, fmt.Errorf("error decoding portfolio snapshots: %v", err)
+	}
+	byDate := make(map[int64]models.PortfolioSnapshot, len(snapshots))
+	for _, snapshot := range snapshots {
+		byDate[snapshot.Date.Unix()] = snapshot
+	}
+	return byDate, nil
+}
+
+// ledgerSnapshot ghi lại số lượng và giá vốn USD của các coin đang giữ trong danh mục, chưa có giá
+func ledgerSnapshot(portfolio *models.Portfolio, date time.Time) models.PortfolioSnapshot {
+	snapshot := models.PortfolioSnapshot{
+		UserID:      portfolio.UserID,
+		PortfolioID: portfolio.ID,
+		Date:        date,
+		Holdings:    make(map[string]float64, len(portfolio.CoinHoldings)),
+		Prices:      map[string]float64{},
+	}
+	for coin, holding := range portfolio.CoinHoldings {
+		if holding.Quantity <= quantityEpsilon {
+			continue
+		}
+		snapshot.Holdings[coin] = holding.Quantity
+		snapshot.CostBasisUSD += holding.Quantity * holding.AvgBuyPrice
+	}
+	return snapshot
+}
+
+// sameSnapshotHoldings kiểm tra snapshot đã lưu có cùng số lượng từng coin và giá vốn với snapshot dựng từ sổ giao dịch
+func sameSnapshotHoldings(stored, replayed models.PortfolioSnapshot) bool {
+	if len(stored.Holdings) != len(replayed.Holdings) || differs(stored.CostBasisUSD, replayed.CostBasisUSD) {
+		return false
+	}
+	for coin, quantity := range replayed.Holdings {
+		storedQuantity, ok := stored.Holdings[coin]
+		if !ok || differs(storedQuantity, quantity) {
+			return false
+		}
+	}
+	return true
+}
+
+// priceSnapshot định giá snapshot theo giá đóng cửa USD của từng coin tại ngày của snapshot.
+// Coin không lấy được giá được ghi vào MissingPrices và không được tính vào giá trị
+func priceSnapshot(snapshot *models.PortfolioSnapshot) {
+	snapshot.ValueUSD, snapshot.MissingPrices = 0, nil
+	for coin, quantity := range snapshot.Holdings {
+		price, err := GetHistoricalRate(coin, "USD", snapshot.Date)
+		if err != nil {
+			log.Printf("Warning: no %s price for %s: %v", coin, snapshot.Date.Format("2006-01-02"), err)
+			snapshot.MissingPrices = append(snapshot.MissingPrices, coin)
+			continue
+		}
+		snapshot.Prices[coin] = price
+		snapshot.ValueUSD += quantity * price
+	}
+	sort.Strings(snapshot.MissingPrices)
+}
+
+// mergeSymbols gộp hai danh sách ký hiệu đã sắp xếp, bỏ các phần tử trùng
+func mergeSymbols(left, right []string) []string {
+	if len(right) == 0 {
+		return left
+	}
+	seen := make(map[string]bool, len(left)+len(right))
+	merged := []string{}
+	for _, symbol := range append(append([]string{}, left...), right...) {
+		if !seen[symbol] {
+			seen[symbol] = true
+			merged = append(merged, symbol)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// StartSnapshotScheduler chạy nền việc ghi snapshot giá trị cuối ngày của mọi danh mục chưa lưu trữ
+// theo chu kỳ SNAPSHOT_INTERVAL (đặt 0 để tắt)
+func StartSnapshotScheduler() {
+	interval := durationFromEnv("SNAPSHOT_INTERVAL", defaultSnapshotInterval)
+	if interval <= 0 {
+		log.Println("Portfolio snapshot scheduler disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			recordDailySnapshots()
+			<-ticker.C
+		}
+	}()
+}
+
+// recordDailySnapshots ghi snapshot của snapshotBackfillDays ngày đã kết thúc gần nhất cho mọi danh mục chưa lưu trữ.
+// Ngày đã có snapshot khớp với sổ giao dịch không cần lấy lại giá
+func recordDailySnapshots() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	userIDs, err := configs.GetCollection("portfolios").Distinct(ctx, "user_id", bson.M{"archived": bson.M{"$ne": true}})
+	cancel()
+	if err != nil {
+		log.Printf("Warning: could not list portfolios for snapshots: %v", err)
+		return
+	}
+
+	today := startOfDay(time.Now())
+	dates := valueSeriesDates(today.AddDate(0, 0, -snapshotBackfillDays), today.AddDate(0, 0, -1), "day")
+	for _, value := range userIDs {
+		userID, ok := value.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		if err := recordUserSnapshots(userID, dates, today); err != nil {
+			log.Printf("Warning: could not record snapshots for user %s: %v", userID.Hex(), err)
+		}
+	}
+}
+
+// recordUserSnapshots ghi snapshot của các ngày dates cho mọi danh mục chưa lưu trữ của người dùng
+func recordUserSnapshots(userID primitive.ObjectID, dates []time.Time, today time.Time) error {
+	user, err := GetUser(userID)
+	if err != nil {
+		return fmt.Errorf("error fetching user: %v", err)
+	}
+	portfolios, err := ListPortfolios(userID)
+	if err != nil {
+		return err
+	}
+	ids := []primitive.ObjectID{}
+	for _, portfolio := range portfolios {
+		if !portfolio.Archived {
+			ids = append(ids, portfolio.ID)
+		}
+	}
+	ledgers, err := loadLedgers(userID, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		valueSeries(userID, id, ledgers[id], user.GetCostBasisMethod(), dates, today, newPricingBudget(-1, snapshotBackfillTimeout))
+	}
+	return nil
+}